@@ -0,0 +1,134 @@
+package bencode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testInfo struct {
+	Pieces      string   `bencode:"pieces"`
+	PieceLength int      `bencode:"piece length"`
+	Length      int      `bencode:"length,omitempty"`
+	Name        string   `bencode:"name"`
+	Tags        []string `bencode:"tags,omitempty"`
+	Private     bool     `bencode:"private,omitempty"`
+	Ignored     string   `bencode:"-"`
+}
+
+type testTorrent struct {
+	Announce string     `bencode:"announce"`
+	Info     RawMessage `bencode:"info"`
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	var info testInfo
+	err := Unmarshal(strings.NewReader("d6:lengthi12e4:name3:abc12:piece lengthi4e6:pieces3:xyz7:privatei1e5:extrali1ei2eee"), &info)
+	assert.Nil(t, err)
+	assert.Equal(t, testInfo{Pieces: "xyz", PieceLength: 4, Length: 12, Name: "abc", Private: true}, info)
+}
+
+func TestMarshalSortsKeys(t *testing.T) {
+	data, err := EncodeBytes(testInfo{Pieces: "xyz", PieceLength: 4, Name: "abc", Ignored: "x"})
+	assert.Nil(t, err)
+	assert.Equal(t, "d4:name3:abc12:piece lengthi4e6:pieces3:xyze", string(data))
+
+	data, err = EncodeBytes(map[string]interface{}{"b": []interface{}{int64(1), "x"}, "a": []byte("raw"), "c": [2]byte{'h', 'i'}})
+	assert.Nil(t, err)
+	assert.Equal(t, "d1:a3:raw1:bli1e1:xe1:c2:hie", string(data))
+}
+
+func TestRawMessage(t *testing.T) {
+	// info keys are out of order on purpose, the raw bytes must be kept as is
+	input := "d8:announce3:url4:infod4:name1:n6:lengthi1eee"
+	var tor testTorrent
+	err := Unmarshal(strings.NewReader(input), &tor)
+	assert.Nil(t, err)
+	assert.Equal(t, "url", tor.Announce)
+	assert.Equal(t, "d4:name1:n6:lengthi1ee", string(tor.Info))
+
+	data, err := EncodeBytes(tor)
+	assert.Nil(t, err)
+	assert.Equal(t, input, string(data))
+}
+
+func TestDecodeGeneric(t *testing.T) {
+	v, err := Decode(strings.NewReader("d1:ai-3e1:bl2:xyee"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"a": int64(-3), "b": []interface{}{"xy"}}, v)
+}
+
+func TestInputOffset(t *testing.T) {
+	payload := []byte("d8:msg_typei1e5:piecei0eeRAWDATA")
+	d := NewDecoder(bytes.NewReader(payload))
+	var m map[string]int
+	assert.Nil(t, d.Decode(&m))
+	assert.Equal(t, "RAWDATA", string(payload[d.InputOffset():]))
+}
+
+func TestStrict(t *testing.T) {
+	for _, input := range []string{
+		"d1:bi1e1:ai2ee", // unsorted
+		"d1:ai1e1:ai2ee", // duplicate
+		"i03e",
+		"i-0e",
+		"02:ab",
+	} {
+		var v interface{}
+		err := Unmarshal(strings.NewReader(input), &v)
+		assert.Nil(t, err, input)
+
+		d := NewDecoder(strings.NewReader(input))
+		d.Strict = true
+		err = d.Decode(&v)
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"i12",
+		"ie",
+		"i1x2e",
+		"5:abc",
+		"-1:a",
+		"li1e",
+		"di1ei2ee",
+		"x",
+		strings.Repeat("l", MAX_DEPTH+1) + strings.Repeat("e", MAX_DEPTH+1),
+	} {
+		var v interface{}
+		err := Unmarshal(strings.NewReader(input), &v)
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestTypeMismatch(t *testing.T) {
+	var info testInfo
+	err := Unmarshal(strings.NewReader("d4:namei1ee"), &info)
+	assert.IsType(t, &UnmarshalTypeError{}, err)
+
+	var small int8
+	err = Unmarshal(strings.NewReader("i300e"), &small)
+	assert.NotNil(t, err)
+}
+
+func TestMaxStringLength(t *testing.T) {
+	input := "6:pieces100000:" + strings.Repeat("x", 100000)
+	d := NewDecoder(strings.NewReader("d" + input + "e"))
+	d.MaxStringLength = 1000
+	var v map[string]string
+	assert.NotNil(t, d.Decode(&v))
+
+	// a huge length with no data behind it fails without allocating it
+	var s string
+	err := Unmarshal(strings.NewReader("999999999999:abc"), &s)
+	assert.NotNil(t, err)
+
+	err = Unmarshal(strings.NewReader("d"+input+"e"), &v)
+	assert.Nil(t, err)
+	assert.Len(t, v["pieces"], 100000)
+}
@@ -0,0 +1,495 @@
+// Package bencode reads and writes the bencoding of BEP 3.
+//
+// Values map to Go types much like encoding/json: dictionaries decode into
+// structs (fields named by their `bencode:"key"` tag) or maps with string
+// keys, lists into slices, strings into string or []byte and integers into
+// any integer kind. Decoding into an interface{} gives map[string]interface{},
+// []interface{}, string and int64. A RawMessage keeps the exact bytes of a
+// value, which is what the infohash of a torrent must be computed on.
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// MAX_DEPTH is how deep lists and dictionaries may nest
+const MAX_DEPTH = 256
+
+// strings at most this long are allocated at once, longer ones grow as
+// their bytes arrive so a bogus length can't make us allocate it upfront
+const smallString = 64 * 1024
+
+// SyntaxError is returned for input that isn't valid bencode, or isn't
+// canonical in strict mode
+type SyntaxError struct {
+	Offset int64 // where in the input the error was found
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Msg, e.Offset)
+}
+
+// UnmarshalTypeError is returned when a value can't be stored in the Go value it is decoded into
+type UnmarshalTypeError struct {
+	Value string // "integer", "string", "list" or "dictionary"
+	Type  reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot decode %s into Go value of type %s", e.Value, e.Type)
+}
+
+// RawMessage is a bencoded value kept as is. Decoding stores the exact bytes
+// of the value, encoding writes them back untouched
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// Decoder reads bencoded values from a stream
+type Decoder struct {
+	// Strict rejects input that is valid but not canonical: unsorted or
+	// duplicate dictionary keys and numbers with leading zeros or -0
+	Strict bool
+	// MaxStringLength refuses longer strings, 0 means no limit
+	MaxStringLength int64
+
+	r       *bufio.Reader
+	offset  int64
+	capture *bytes.Buffer // receives every byte read while decoding a RawMessage
+	depth   int
+}
+
+// NewDecoder returns a decoder reading from r. It may read past the values it
+// decodes, see InputOffset to find where they end
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// InputOffset returns how many bytes of the input the decoded values took
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Decode reads the next value from the input and stores it in v, which must be a non-nil pointer
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("bencode: Decode needs a non-nil pointer, got %T", v)
+	}
+	d.depth = 0
+	return d.value(rv.Elem())
+}
+
+// Unmarshal decodes the bencoded value read from r into v
+func Unmarshal(r io.Reader, v interface{}) error {
+	return NewDecoder(r).Decode(v)
+}
+
+// Decode reads a single value from r into generic Go values
+func Decode(r io.Reader) (interface{}, error) {
+	var v interface{}
+	err := Unmarshal(r, &v)
+	return v, err
+}
+
+func (d *Decoder) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Offset: d.offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err == io.EOF {
+		return 0, d.errorf("unexpected end of input")
+	}
+	if err != nil {
+		return 0, err
+	}
+	d.offset++
+	if d.capture != nil {
+		d.capture.WriteByte(c)
+	}
+	return c, nil
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err == io.EOF {
+		return 0, d.errorf("unexpected end of input")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readNumber reads the digits of an integer or string length up to end
+func (d *Decoder) readNumber(end byte) (string, error) {
+	var digits []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if c == end {
+			break
+		}
+		if len(digits) > 20 {
+			return "", d.errorf("number too long")
+		}
+		digits = append(digits, c)
+	}
+	return string(digits), nil
+}
+
+// readInt reads an integer after its leading 'i'
+func (d *Decoder) readInt() (string, error) {
+	s, err := d.readNumber('e')
+	if err != nil {
+		return "", err
+	}
+	digits := s
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return "", d.errorf("empty integer")
+	}
+	for _, c := range []byte(digits) {
+		if c < '0' || c > '9' {
+			return "", d.errorf("invalid integer %q", s)
+		}
+	}
+	if d.Strict && (s == "-0" || len(digits) > 1 && digits[0] == '0') {
+		return "", d.errorf("non canonical integer %q", s)
+	}
+	return s, nil
+}
+
+// readString reads a string whose first length digit is c
+func (d *Decoder) readString(c byte) ([]byte, error) {
+	s, err := d.readNumber(':')
+	if err != nil {
+		return nil, err
+	}
+	s = string(c) + s
+	length, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || length < 0 || s[0] == '-' || s[0] == '+' {
+		return nil, d.errorf("invalid string length %q", s)
+	}
+	if d.Strict && len(s) > 1 && s[0] == '0' {
+		return nil, d.errorf("non canonical string length %q", s)
+	}
+	if d.MaxStringLength > 0 && length > d.MaxStringLength {
+		return nil, d.errorf("string of %d bytes is longer than %d", length, d.MaxStringLength)
+	}
+
+	var buf []byte
+	if length <= smallString {
+		buf = make([]byte, length)
+		_, err = io.ReadFull(d.r, buf)
+	} else {
+		var b bytes.Buffer
+		var n int64
+		n, err = io.CopyN(&b, d.r, length)
+		if n == length {
+			err = nil
+		}
+		buf = b.Bytes()
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, d.errorf("unexpected end of input in string")
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.offset += length
+	if d.capture != nil {
+		d.capture.Write(buf)
+	}
+	return buf, nil
+}
+
+func (d *Decoder) value(v reflect.Value) error {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > MAX_DEPTH {
+		return d.errorf("nested too deep")
+	}
+
+	if v.Type() == rawMessageType {
+		return d.raw(v)
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		generic, err := d.generic()
+		if err != nil {
+			return err
+		}
+		if generic != nil {
+			v.Set(reflect.ValueOf(generic))
+		}
+		return nil
+	}
+
+	c, err := d.readByte()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		return d.intValue(v)
+	case c >= '0' && c <= '9':
+		return d.stringValue(c, v)
+	case c == 'l':
+		return d.listValue(v)
+	case c == 'd':
+		return d.dictValue(v)
+	default:
+		return d.errorf("unexpected %q", c)
+	}
+}
+
+// raw stores the exact bytes of the next value in v
+func (d *Decoder) raw(v reflect.Value) error {
+	outer := d.capture
+	var buf bytes.Buffer
+	d.capture = &buf
+	err := d.skip()
+	d.capture = outer
+	if err != nil {
+		return err
+	}
+	if outer != nil {
+		outer.Write(buf.Bytes())
+	}
+	v.SetBytes(buf.Bytes())
+	return nil
+}
+
+// skip reads the next value and throws it away
+func (d *Decoder) skip() error {
+	_, err := d.generic()
+	return err
+}
+
+func (d *Decoder) intValue(v reflect.Value) error {
+	s, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return d.errorf("integer %s overflows %s", s, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return d.errorf("integer %s overflows %s", s, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		v.SetBool(s != "0")
+	default:
+		return &UnmarshalTypeError{Value: "integer", Type: v.Type()}
+	}
+	return nil
+}
+
+func (d *Decoder) stringValue(c byte, v reflect.Value) error {
+	b, err := d.readString(c)
+	if err != nil {
+		return err
+	}
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(b))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(b)
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(b) != v.Len() {
+			return d.errorf("string of %d bytes does not fit %s", len(b), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf(b))
+	default:
+		return &UnmarshalTypeError{Value: "string", Type: v.Type()}
+	}
+	return nil
+}
+
+func (d *Decoder) listValue(v reflect.Value) error {
+	if v.Kind() != reflect.Slice {
+		return &UnmarshalTypeError{Value: "list", Type: v.Type()}
+	}
+	v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	for {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err = d.readByte()
+			return err
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		err = d.value(elem)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+	}
+}
+
+// dictKey reads the next key of a dictionary, ok is false at its end. In
+// strict mode keys must be strictly increasing
+func (d *Decoder) dictKey(previous *string, first bool) (key string, ok bool, err error) {
+	c, err := d.readByte()
+	if err != nil {
+		return "", false, err
+	}
+	if c == 'e' {
+		return "", false, nil
+	}
+	if c < '0' || c > '9' {
+		return "", false, d.errorf("dictionary key is not a string")
+	}
+	b, err := d.readString(c)
+	if err != nil {
+		return "", false, err
+	}
+	key = string(b)
+	if d.Strict && !first && key <= *previous {
+		return "", false, d.errorf("dictionary key %q is not sorted or duplicated", key)
+	}
+	*previous = key
+	return key, true, nil
+}
+
+func (d *Decoder) dictValue(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnmarshalTypeError{Value: "dictionary", Type: v.Type()}
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Struct:
+	default:
+		return &UnmarshalTypeError{Value: "dictionary", Type: v.Type()}
+	}
+
+	var fields map[string]int
+	if v.Kind() == reflect.Struct {
+		fields = structFields(v.Type())
+	}
+	var previous string
+	for first := true; ; first = false {
+		key, ok, err := d.dictKey(&previous, first)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err = d.value(elem)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			continue
+		}
+		i, known := fields[key]
+		if !known {
+			err = d.skip()
+		} else {
+			err = d.value(v.Field(i))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// generic decodes the next value into map[string]interface{}, []interface{}, string or int64
+func (d *Decoder) generic() (interface{}, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > MAX_DEPTH {
+		return nil, d.errorf("nested too deep")
+	}
+
+	c, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == 'i':
+		s, err := d.readInt()
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, d.errorf("integer %s overflows int64", s)
+		}
+		return n, nil
+	case c >= '0' && c <= '9':
+		b, err := d.readString(c)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case c == 'l':
+		list := []interface{}{}
+		for {
+			c, err := d.peekByte()
+			if err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				_, err = d.readByte()
+				return list, err
+			}
+			elem, err := d.generic()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elem)
+		}
+	case c == 'd':
+		dict := map[string]interface{}{}
+		var previous string
+		for first := true; ; first = false {
+			key, ok, err := d.dictKey(&previous, first)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return dict, nil
+			}
+			dict[key], err = d.generic()
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, d.errorf("unexpected %q", c)
+	}
+}
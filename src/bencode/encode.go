@@ -0,0 +1,158 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// MarshalError is returned for Go values that have no bencoding
+type MarshalError struct {
+	Type reflect.Type
+}
+
+func (e *MarshalError) Error() string {
+	return fmt.Sprintf("bencode: unsupported type %s", e.Type)
+}
+
+// Marshal writes the bencoding of v to w. Dictionary keys are always sorted
+// so the output is canonical
+func Marshal(w io.Writer, v interface{}) error {
+	bw := bufio.NewWriter(w)
+	err := encode(bw, reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// EncodeBytes returns the bencoding of v
+func EncodeBytes(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := Marshal(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeString(w *bufio.Writer, s string) {
+	w.WriteString(strconv.Itoa(len(s)))
+	w.WriteByte(':')
+	w.WriteString(s)
+}
+
+func encode(w *bufio.Writer, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("bencode: cannot encode nil")
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("bencode: empty RawMessage")
+		}
+		w.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("bencode: cannot encode nil %s", v.Type())
+		}
+		return encode(w, v.Elem())
+	case reflect.String:
+		writeString(w, v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			w.WriteString("i1e")
+		} else {
+			w.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.WriteByte('i')
+		w.WriteString(strconv.FormatInt(v.Int(), 10))
+		w.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.WriteByte('i')
+		w.WriteString(strconv.FormatUint(v.Uint(), 10))
+		w.WriteByte('e')
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			writeString(w, string(b))
+			return nil
+		}
+		w.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			err := encode(w, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &MarshalError{v.Type()}
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		w.WriteByte('d')
+		for _, k := range keys {
+			elem := v.MapIndex(k)
+			if isNil(elem) {
+				continue
+			}
+			writeString(w, k.String())
+			err := encode(w, elem)
+			if err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	case reflect.Struct:
+		w.WriteByte('d')
+		for _, f := range typeFields(v.Type()) {
+			elem := v.Field(f.index)
+			if isNil(elem) || f.omitEmpty && isEmpty(elem) {
+				continue
+			}
+			writeString(w, f.key)
+			err := encode(w, elem)
+			if err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	default:
+		return &MarshalError{v.Type()}
+	}
+	return nil
+}
+
+// isNil reports values that have nothing to encode, they are left out of dictionaries
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	}
+	return false
+}
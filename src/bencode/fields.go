@@ -0,0 +1,54 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field is a struct field and the dictionary key it maps to
+type field struct {
+	key       string
+	index     int
+	omitEmpty bool
+}
+
+var fieldsCache sync.Map // reflect.Type -> []field
+
+// typeFields returns the encoded fields of a struct type sorted by key. A
+// field is named by its `bencode:"key,omitempty"` tag, by its Go name when
+// it has none, and `bencode:"-"` skips it
+func typeFields(t reflect.Type) []field {
+	if cached, ok := fieldsCache.Load(t); ok {
+		return cached.([]field)
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, field{key: name, index: i, omitEmpty: opts == "omitempty"})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+	fieldsCache.Store(t, fields)
+	return fields
+}
+
+// structFields maps the keys of a struct type to its field indexes
+func structFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int)
+	for _, f := range typeFields(t) {
+		fields[f.key] = f.index
+	}
+	return fields
+}
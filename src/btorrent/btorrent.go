@@ -0,0 +1,214 @@
+// Package btorrent is the entry point for programs embedding the client: a
+// Client owns the listening port and the rate limits, every torrent it opens
+// is a Session that downloads or seeds until its context is done.
+package btorrent
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"github.com/brkss/btorrent/src/dht"
+	"github.com/brkss/btorrent/src/magnet"
+	"github.com/brkss/btorrent/src/ratelimit"
+	"github.com/brkss/btorrent/src/torrentfile"
+	"github.com/brkss/btorrent/src/upload"
+)
+
+// Progress is a snapshot of a running download or seed
+type Progress = torrentfile.Progress
+
+// Client shares one listening port and one pair of rate limits between all
+// of its sessions
+type Client struct {
+	settings   torrentfile.Settings
+	outputDir  string
+	onProgress func(*Session, Progress)
+	server     *upload.Server
+	useDHT     bool
+	bootstrap  []string
+	dhtState   string
+
+	watchInterval time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithPort sets the port peers connect to, torrentfile.PORT by default
+func WithPort(port uint16) Option {
+	return func(c *Client) { c.settings.Port = port }
+}
+
+// WithMaxPeers caps the peers a session downloads from at once
+func WithMaxPeers(n int) Option {
+	return func(c *Client) { c.settings.MaxPeers = n }
+}
+
+// WithMaxConnections caps the incoming peers of all sessions together
+func WithMaxConnections(n int) Option {
+	return func(c *Client) { c.settings.MaxConnections = n }
+}
+
+// WithDownloadRate caps the download rate of all sessions together
+func WithDownloadRate(bytesPerSecond int64) Option {
+	return func(c *Client) { c.settings.DownloadLimiter = ratelimit.New(bytesPerSecond) }
+}
+
+// WithUploadRate caps the upload rate of all sessions together
+func WithUploadRate(bytesPerSecond int64) Option {
+	return func(c *Client) { c.settings.UploadLimiter = ratelimit.New(bytesPerSecond) }
+}
+
+// WithOutputDir sets the directory sessions download into, the working
+// directory by default
+func WithOutputDir(dir string) Option {
+	return func(c *Client) { c.outputDir = dir }
+}
+
+// WithProgress sets a function called with the progress of every session,
+// once per completed piece and every torrentfile.PROGRESS_INTERVAL. Calls for
+// one session never overlap
+func WithProgress(fn func(s *Session, p Progress)) Option {
+	return func(c *Client) { c.onProgress = fn }
+}
+
+// WithDHT runs a DHT node on the UDP port of the same number as the client's
+// port, it joins the network through bootstrap (host:port, see
+// dht.DEFAULT_BOOTSTRAP). Sessions of public torrents then also find peers there
+func WithDHT(bootstrap ...string) Option {
+	return func(c *Client) {
+		c.useDHT = true
+		c.bootstrap = bootstrap
+	}
+}
+
+// WithDHTState keeps the id, nodes and peers of the DHT node in the file at
+// path between runs, so it starts from the nodes it knew instead of
+// rediscovering the network
+func WithDHTState(path string) Option {
+	return func(c *Client) { c.dhtState = path }
+}
+
+// NewClient creates a client and starts listening for peers
+func NewClient(opts ...Option) (*Client, error) {
+	c := &Client{outputDir: ".", watchInterval: WATCH_INTERVAL}
+	c.settings.Port = torrentfile.PORT
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	var peerID [20]byte
+	_, err := rand.Read(peerID[:])
+	if err != nil {
+		return nil, err
+	}
+	c.server = upload.NewServer(peerID)
+	c.server.MaxConnections = c.settings.MaxConnections
+	err = c.server.Listen(c.settings.Port)
+	if err != nil {
+		return nil, err
+	}
+	c.settings.Server = c.server
+	if c.useDHT {
+		c.settings.DHT, err = dht.New(dht.Config{Port: c.settings.Port, Bootstrap: c.bootstrap, StateFile: c.dhtState})
+		if err != nil {
+			c.server.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// DHT returns the DHT node of the client, nil without WithDHT
+func (c *Client) DHT() *dht.Server {
+	return c.settings.DHT
+}
+
+// Close stops listening and disconnects incoming peers, sessions still
+// running keep their outgoing connections until their context is done
+func (c *Client) Close() error {
+	if c.settings.DHT != nil {
+		c.settings.DHT.Close()
+	}
+	return c.server.Close()
+}
+
+// Open opens a .torrent file or resolves a magnet link into a session
+func (c *Client) Open(ctx context.Context, torrentOrMagnet string) (*Session, error) {
+	var tf torrentfile.TorrentFile
+	var err error
+	if magnet.IsMagnet(torrentOrMagnet) {
+		tf, err = torrentfile.OpenMagnetWith(ctx, torrentOrMagnet, c.settings)
+	} else {
+		tf, err = torrentfile.Open(torrentOrMagnet)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.Add(tf), nil
+}
+
+// Add creates a session for a torrent that is already open, its data goes
+// into the output directory
+func (c *Client) Add(tf torrentfile.TorrentFile) *Session {
+	return &Session{client: c, torrent: tf, path: tf.DataPath(c.outputDir)}
+}
+
+// Session is one torrent of a Client
+type Session struct {
+	client  *Client
+	torrent torrentfile.TorrentFile
+	path    string
+
+	mu       sync.Mutex
+	progress Progress
+}
+
+// Torrent returns the metadata of the session
+func (s *Session) Torrent() *torrentfile.TorrentFile {
+	return &s.torrent
+}
+
+// Path returns where the data of the session is
+func (s *Session) Path() string {
+	return s.path
+}
+
+// SetPath changes where the data of the session is, it must be called
+// before Download or Seed
+func (s *Session) SetPath(path string) {
+	s.path = path
+}
+
+// Progress returns the last progress reported by Download or Seed
+func (s *Session) Progress() Progress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.progress
+}
+
+func (s *Session) settings() torrentfile.Settings {
+	settings := s.client.settings
+	settings.OnProgress = func(p Progress) {
+		s.mu.Lock()
+		s.progress = p
+		s.mu.Unlock()
+		if s.client.onProgress != nil {
+			s.client.onProgress(s, p)
+		}
+	}
+	return settings
+}
+
+// Download downloads the torrent and returns once every piece is on disk.
+// When ctx is done it stops, saves its progress and returns ctx.Err()
+func (s *Session) Download(ctx context.Context) error {
+	return s.torrent.DownloadWith(ctx, s.path, s.settings())
+}
+
+// Seed shares the data of the torrent until ctx is done
+func (s *Session) Seed(ctx context.Context) error {
+	return s.torrent.SeedWith(ctx, s.path, s.settings())
+}
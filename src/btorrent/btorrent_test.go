@@ -0,0 +1,325 @@
+package btorrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brkss/btorrent/src/magnet"
+	"github.com/brkss/btorrent/src/torrentfile"
+	"github.com/stretchr/testify/assert"
+)
+
+// freePort returns a port nothing listens on right now
+func freePort(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestClientDownload(t *testing.T) {
+	seedDir, leechDir := t.TempDir(), t.TempDir()
+	data := make([]byte, 200000)
+	rand.Read(data)
+	assert.Nil(t, os.WriteFile(filepath.Join(seedDir, "data.bin"), data, 0644))
+
+	// the tracker always hands out the seeder
+	seedPort := freePort(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := []byte{127, 0, 0, 1, 0, 0}
+		binary.BigEndian.PutUint16(peer[4:], seedPort)
+		w.Write([]byte("d8:intervali900e5:peers6:" + string(peer) + "e"))
+	}))
+	defer ts.Close()
+
+	meta, err := torrentfile.Create(filepath.Join(seedDir, "data.bin"), torrentfile.CreateOptions{
+		PieceLength:  16384,
+		AnnounceList: [][]string{{ts.URL}},
+	})
+	assert.Nil(t, err)
+	torrentPath := filepath.Join(t.TempDir(), "data.torrent")
+	assert.Nil(t, os.WriteFile(torrentPath, meta, 0644))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	seeding := make(chan struct{}, 1)
+	seeder, err := NewClient(WithPort(seedPort), WithOutputDir(seedDir), WithProgress(func(s *Session, p Progress) {
+		select {
+		case seeding <- struct{}{}:
+		default:
+		}
+	}))
+	assert.Nil(t, err)
+	defer seeder.Close()
+	seed, err := seeder.Open(ctx, torrentPath)
+	assert.Nil(t, err)
+	seedCtx, stopSeeding := context.WithCancel(ctx)
+	seedDone := make(chan error)
+	go func() { seedDone <- seed.Seed(seedCtx) }()
+	<-seeding
+
+	var pieces []int
+	leecher, err := NewClient(WithPort(freePort(t)), WithOutputDir(leechDir), WithProgress(func(s *Session, p Progress) {
+		if p.Piece >= 0 {
+			pieces = append(pieces, p.Piece)
+		}
+	}))
+	assert.Nil(t, err)
+	defer leecher.Close()
+	leech, err := leecher.Open(ctx, torrentPath)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(leechDir, "data.bin"), leech.Path())
+
+	assert.Nil(t, leech.Download(ctx))
+	got, err := os.ReadFile(leech.Path())
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+	assert.Len(t, pieces, 13)
+	last := leech.Progress()
+	assert.Equal(t, 13, last.PiecesDone)
+	assert.Equal(t, int64(0), last.Left)
+	assert.Equal(t, int64(len(data)), last.Downloaded)
+
+	stopSeeding()
+	assert.ErrorIs(t, <-seedDone, context.Canceled)
+}
+
+func TestSessionDownloadCancelled(t *testing.T) {
+	client, err := NewClient(WithPort(freePort(t)), WithOutputDir(t.TempDir()))
+	assert.Nil(t, err)
+	defer client.Close()
+
+	s := client.Add(torrentfile.TorrentFile{
+		Name:        "data",
+		Announce:    "http://127.0.0.1:1/announce",
+		PieceLength: 4,
+		Length:      4,
+		PieceHashes: [][20]byte{{1}},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, s.Download(ctx), context.Canceled)
+}
+
+func TestClientDownloadTrackerless(t *testing.T) {
+	seedDir, leechDir := t.TempDir(), t.TempDir()
+	data := make([]byte, 50000)
+	rand.Read(data)
+	assert.Nil(t, os.WriteFile(filepath.Join(seedDir, "data.bin"), data, 0644))
+	meta, err := torrentfile.Create(filepath.Join(seedDir, "data.bin"), torrentfile.CreateOptions{PieceLength: 16384})
+	assert.Nil(t, err)
+	torrentPath := filepath.Join(t.TempDir(), "data.torrent")
+	assert.Nil(t, os.WriteFile(torrentPath, meta, 0644))
+
+	seeder, err := NewClient(WithPort(freePort(t)), WithOutputDir(seedDir), WithDHT())
+	assert.Nil(t, err)
+	defer seeder.Close()
+	bootstrap := fmt.Sprintf("127.0.0.1:%d", seeder.DHT().Port())
+	leecher, err := NewClient(WithPort(freePort(t)), WithOutputDir(leechDir), WithDHT(bootstrap))
+	assert.Nil(t, err)
+	defer leecher.Close()
+	// the seeder only knows the DHT through the leecher joining it
+	for seeder.DHT().Nodes() == 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	seed, err := seeder.Open(ctx, torrentPath)
+	assert.Nil(t, err)
+	go seed.Seed(ctx)
+
+	leech, err := leecher.Open(ctx, torrentPath)
+	assert.Nil(t, err)
+	// wait for the seeder to announce itself
+	for ctx.Err() == nil {
+		peers, _ := leecher.DHT().GetPeers(ctx, leech.Torrent().InfoHash)
+		if len(peers) > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	assert.Nil(t, leech.Download(ctx))
+	got, err := os.ReadFile(leech.Path())
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestClientWatch(t *testing.T) {
+	seedDir, leechDir := t.TempDir(), t.TempDir()
+	// tonight's build only differs from yesterday's at the end
+	yesterday := make([]byte, 100000)
+	rand.Read(yesterday)
+	tonight := append([]byte{}, yesterday...)
+	rand.Read(tonight[len(tonight)-1000:])
+
+	seeder, err := NewClient(WithPort(freePort(t)), WithOutputDir(seedDir), WithDHT())
+	assert.Nil(t, err)
+	defer seeder.Close()
+	var mu sync.Mutex
+	downloaded := make(map[[20]byte]int64)
+	leecher, err := NewClient(WithPort(freePort(t)), WithOutputDir(leechDir), WithWatchInterval(time.Millisecond*100),
+		WithDHT(fmt.Sprintf("127.0.0.1:%d", seeder.DHT().Port())),
+		WithProgress(func(s *Session, p Progress) {
+			mu.Lock()
+			downloaded[s.Torrent().InfoHash] = p.Downloaded
+			mu.Unlock()
+		}))
+	assert.Nil(t, err)
+	defer leecher.Close()
+	for seeder.DHT().Nodes() == 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	// both builds are named data.bin
+	seed := func(name string, data []byte) *Session {
+		path := filepath.Join(seedDir, name, "data.bin")
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, os.WriteFile(path, data, 0644))
+		meta, err := torrentfile.Create(path, torrentfile.CreateOptions{PieceLength: 16384})
+		assert.Nil(t, err)
+		torrentPath := filepath.Join(seedDir, name+".torrent")
+		assert.Nil(t, os.WriteFile(torrentPath, meta, 0644))
+		s, err := seeder.Open(ctx, torrentPath)
+		assert.Nil(t, err)
+		s.SetPath(path)
+		go s.Seed(ctx)
+		return s
+	}
+	// waitFor waits until the leecher downloaded data
+	waitFor := func(data []byte) {
+		for ctx.Err() == nil {
+			got, _ := os.ReadFile(filepath.Join(leechDir, "data.bin"))
+			if bytes.Equal(got, data) {
+				return
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		t.Fatal("the leecher never got the data")
+	}
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	salt := []byte("nightly")
+	first := seed("yesterday", yesterday)
+	_, err = torrentfile.PublishMutable(ctx, seeder.DHT(), priv, salt, first.Torrent().InfoHash)
+	assert.Nil(t, err)
+	link := (&magnet.Magnet{Name: "data.bin", PublicKey: pub, Salt: salt}).String()
+	watching := make(chan error, 1)
+	go func() { watching <- leecher.Watch(ctx, link) }()
+	waitFor(yesterday)
+
+	second := seed("tonight", tonight)
+	_, err = torrentfile.PublishMutable(ctx, seeder.DHT(), priv, salt, second.Torrent().InfoHash)
+	assert.Nil(t, err)
+	waitFor(tonight)
+	// only the last piece changed, the others came from yesterday's data
+	mu.Lock()
+	assert.Less(t, downloaded[second.Torrent().InfoHash], int64(16384*2))
+	mu.Unlock()
+	_, err = os.Stat(filepath.Join(leechDir, "data.bin.previous"))
+	assert.True(t, os.IsNotExist(err))
+
+	cancel()
+	assert.ErrorIs(t, <-watching, context.Canceled)
+	assert.NotNil(t, leecher.Watch(context.Background(), "magnet:?xt=urn:btih:"+strings.Repeat("00", 20)))
+}
+
+func TestClientReuseFailureKeepsData(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewClient(WithPort(freePort(t)), WithOutputDir(dir))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	data := []byte("aaaabbbb")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "data.bin"), data, 0644))
+	previous := c.Add(torrentfile.TorrentFile{
+		Name:        "data.bin",
+		PieceLength: 4,
+		Length:      len(data),
+		PieceHashes: [][20]byte{sha1.Sum(data[:4]), sha1.Sum(data[4:])},
+	})
+	// the next torrent can't be laid out on disk: "a" is both a file and a directory
+	next := c.Add(torrentfile.TorrentFile{
+		Name:        "data.bin",
+		PieceLength: 4,
+		Length:      len(data),
+		PieceHashes: previous.Torrent().PieceHashes,
+		Files: []torrentfile.File{
+			{Length: 4, Path: []string{"a"}},
+			{Length: 4, Path: []string{"a", "b"}},
+		},
+	})
+	c.reuse(next, previous)
+	kept, err := filepath.Glob(filepath.Join(dir, "data.bin.previous*", "data.bin"))
+	assert.Nil(t, err)
+	assert.Len(t, kept, 1)
+	got, err := os.ReadFile(kept[0])
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestClientReuseMultiFile(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewClient(WithPort(freePort(t)), WithOutputDir(dir))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// both torrents download into dir, next to a file that isn't theirs
+	unrelated := filepath.Join(dir, "notes.txt")
+	assert.Nil(t, os.WriteFile(unrelated, []byte("keep me"), 0644))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "set"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "set", "a"), []byte("aaaa"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "set", "b"), []byte("bbbb"), 0644))
+	previous := c.Add(torrentfile.TorrentFile{
+		Name:        "set",
+		PieceLength: 4,
+		Length:      8,
+		PieceHashes: [][20]byte{sha1.Sum([]byte("aaaa")), sha1.Sum([]byte("bbbb"))},
+		Files: []torrentfile.File{
+			{Length: 4, Path: []string{"a"}},
+			{Length: 4, Path: []string{"b"}},
+		},
+	})
+	next := c.Add(torrentfile.TorrentFile{
+		Name:        "set",
+		PieceLength: 4,
+		Length:      8,
+		PieceHashes: [][20]byte{sha1.Sum([]byte("aaaa")), sha1.Sum([]byte("cccc"))},
+		Files: []torrentfile.File{
+			{Length: 4, Path: []string{"a"}},
+			{Length: 4, Path: []string{"c"}},
+		},
+	})
+	c.reuse(next, previous)
+
+	got, err := os.ReadFile(filepath.Join(dir, "set", "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aaaa"), got)
+	got, err = os.ReadFile(unrelated)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("keep me"), got)
+	// the old data was reused, nothing is left aside
+	_, err = os.Stat(filepath.Join(dir, "set", "b"))
+	assert.True(t, os.IsNotExist(err))
+	left, err := filepath.Glob(filepath.Join(dir, "set.previous*"))
+	assert.Nil(t, err)
+	assert.Empty(t, left)
+}
@@ -0,0 +1,169 @@
+package btorrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/brkss/btorrent/src/magnet"
+	"github.com/brkss/btorrent/src/torrentfile"
+)
+
+// WATCH_INTERVAL is how often Watch looks up an updatable torrent by default
+const WATCH_INTERVAL = time.Minute * 10
+
+// WithWatchInterval sets how often Watch looks for a new torrent
+func WithWatchInterval(d time.Duration) Option {
+	return func(c *Client) { c.watchInterval = d }
+}
+
+// Watch follows the link of an updatable torrent (BEP 46): it downloads then
+// seeds the torrent the link points to and looks the link up again every
+// watch interval. Once the publisher points it to a new torrent Watch
+// switches to it, the pieces both torrents have are copied from the old data
+// instead of downloaded again. Old data in the way of the new torrent is
+// moved aside and removed once some of it was reused, old data elsewhere is
+// left alone. It needs WithDHT and returns
+// ctx.Err() once ctx is done
+func (c *Client) Watch(ctx context.Context, link string) error {
+	m, err := magnet.Parse(link)
+	if err != nil {
+		return err
+	}
+	if !m.Mutable() {
+		return fmt.Errorf("%s is not the link of an updatable torrent", link)
+	}
+	if c.settings.DHT == nil {
+		return torrentfile.ErrNoDHT
+	}
+
+	var current *Session
+	stop := func() {}
+	defer func() { stop() }()
+	for {
+		infoHash, seq, err := torrentfile.ResolveMutable(ctx, c.settings.DHT, m.PublicKey, m.Salt)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			log.Printf("could not look up %x: %s\n", m.PublicKey, err)
+		case current == nil || current.torrent.InfoHash != infoHash:
+			next, err := c.Open(ctx, (&magnet.Magnet{InfoHash: infoHash, Name: m.Name, Trackers: m.Trackers, Peers: m.Peers}).String())
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Printf("could not open %x (seq %d): %s\n", infoHash, seq, err)
+				break
+			}
+			stop()
+			if current != nil {
+				log.Printf("%s changed to %x (seq %d)\n", current.torrent.Name, infoHash, seq)
+				c.reuse(next, current)
+			}
+			current = next
+			stop = c.run(ctx, current)
+		}
+		select {
+		case <-time.After(c.watchInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// run downloads then seeds s in the background, starting over after a
+// failure. The returned function stops it and waits until it stopped
+func (c *Client) run(ctx context.Context, s *Session) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			err := s.Download(ctx)
+			if err == nil {
+				err = s.Seed(ctx)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("%s failed: %s\n", s.torrent.Name, err)
+			select {
+			case <-time.After(c.watchInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// reuse copies the pieces next shares with the stopped previous session.
+// When the data of both is at the same place, the old data and its resume
+// file are moved aside first and removed once some of its pieces were copied
+func (c *Client) reuse(next, previous *Session) {
+	previousPath := previous.path
+	root := previous.torrent.RootPath(previous.path)
+	aside := ""
+	if root == next.torrent.RootPath(next.path) {
+		var err error
+		aside, err = moveAside(&previous.torrent, previous.path)
+		if err != nil {
+			log.Printf("could not move %s aside: %s\n", root, err)
+			return
+		}
+		if aside == "" {
+			return // nothing was downloaded
+		}
+		previousPath = aside
+		if len(previous.torrent.Files) == 0 {
+			previousPath = filepath.Join(aside, filepath.Base(root))
+		}
+	}
+
+	reused, err := next.torrent.ReusePieces(next.path, &previous.torrent, previousPath)
+	if err != nil && !errors.Is(err, torrentfile.ErrV2Only) {
+		log.Printf("could not reuse the pieces of %s: %s\n", previous.torrent.Name, err)
+	} else {
+		log.Printf("reused %d of %d pieces of %s\n", reused, len(next.torrent.PieceHashes), next.torrent.Name)
+	}
+	if aside == "" {
+		return
+	}
+	if err != nil || reused == 0 {
+		log.Printf("the previous data of %s is left in %s\n", previous.torrent.Name, aside)
+		return
+	}
+	os.RemoveAll(aside)
+}
+
+// moveAside moves the data of a download of t into path and its resume file
+// to a new directory next to them and returns it, or "" when there is no data
+func moveAside(t *torrentfile.TorrentFile, path string) (string, error) {
+	root := t.RootPath(path)
+	aside, err := os.MkdirTemp(filepath.Dir(root), filepath.Base(root)+".previous")
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(root, filepath.Join(aside, filepath.Base(root)))
+	if err != nil {
+		os.Remove(aside)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	resumePath := t.ResumePath(path)
+	err = os.Rename(resumePath, filepath.Join(aside, filepath.Base(resumePath)))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("could not move %s aside: %s\n", resumePath, err)
+	}
+	return aside, nil
+}
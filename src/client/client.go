@@ -3,6 +3,7 @@ package client
 import (
 	"bytes"
 	"fmt"
+	"log"
 	"net"
 	"time"
 
@@ -14,12 +15,14 @@ import (
 
 // client is a TCP connection with a peer
 type Client struct {
-	Conn     net.Conn
-	Choked   bool
-	Bitfield bitfield.Bitfield
-	peer     peer.Peer
-	infoHash [20]byte
-	peerID   [20]byte
+	Conn           net.Conn
+	Choked         bool
+	Bitfield       bitfield.Bitfield
+	PeerExtensions *ExtendedHandshake // nil until the peer sends its extended handshake
+	peer           peer.Peer
+	infoHash       [20]byte
+	peerID         [20]byte
+	extensions     bool
 }
 
 func completeHandshake(conn net.Conn, infoHash [20]byte, peerID [20]byte) (*handshake.Handshake, error) {
@@ -42,54 +45,118 @@ func completeHandshake(conn net.Conn, infoHash [20]byte, peerID [20]byte) (*hand
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(time.Second * 5))
-	defer conn.SetDeadline(time.Time{})
+// recvBitfield waits for the peer's bitfield, extended messages sent around
+// it (usually the extended handshake) are handled on the way
+func (c *Client) recvBitfield() error {
+	c.Conn.SetDeadline(time.Now().Add(time.Second * 5))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	for {
+		msg, err := message.Read(c.Conn)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			return fmt.Errorf("Expected bitfield but got %s", msg)
+		}
+		if msg.ID == message.MsgExtended {
+			_, _, err = c.HandleExtended(msg)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.ID != message.MsgBitfield {
+			return fmt.Errorf("expected a message bitfield but got : %d", msg.ID)
+		}
+		c.Bitfield = msg.Payload
+		return nil
+	}
+}
 
-	msg, err := message.Read(conn)
+// New create new connection with client, send a handshake and reciece a handshake
+// return error if any of those fail!
+func New(peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", peer.String(), time.Second*3)
 	if err != nil {
+		log.Printf("could not connect to %s: %s\n", peer.String(), err)
 		return nil, err
 	}
-	if msg == nil {
-		err := fmt.Errorf("Expected bitfield but got %s", msg)
+	res, err := completeHandshake(conn, infoHash, peerID)
+	if err != nil {
+		log.Printf("handshake with %s failed: %s\n", peer.String(), err)
+		conn.Close()
 		return nil, err
 	}
-	if msg.ID != message.MsgBitfield {
-		return nil, fmt.Errorf("expected a message bitfield but got : %d", msg.ID)
+
+	c := &Client{
+		Conn:       conn,
+		Choked:     false,
+		peer:       peer,
+		infoHash:   infoHash,
+		peerID:     peerID,
+		extensions: res.SupportsExtensions(),
 	}
 
-	return msg.Payload, nil
-}
+	if c.extensions {
+		err = c.SendExtendedHandshake(map[string]int{}, 0)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 
-// New create new connection with client, send a handshake and reciece a handshake
-// return error if any of those fail!
-func New(peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), time.Second*3)
+	err = c.recvBitfield()
 	if err != nil {
-		fmt.Println(">> got error init connection : ", err, peer.String())
+		log.Printf("could not receive bitfield from %s: %s\n", peer.String(), err)
+		conn.Close()
 		return nil, err
 	}
-	_, err = completeHandshake(conn, infoHash, peerID)
+
+	return c, nil
+}
+
+// Accept completes the handshake of an incoming connection, known tells
+// whether we serve the infohash the remote peer asked for
+func Accept(conn net.Conn, peerID [20]byte, known func(infoHash [20]byte) bool) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	req, err := handshake.Read(conn)
 	if err != nil {
-		fmt.Println(">> got error complete handshake : ", err, peer.String())
 		return nil, err
 	}
-
-	bitfield, err := recvBitfield(conn)
+	if !known(req.InfoHash) {
+		return nil, fmt.Errorf("Unknown Info Hash %x", req.InfoHash)
+	}
+	res := handshake.New(req.InfoHash, peerID)
+	_, err = conn.Write(res.Serialize())
 	if err != nil {
-		fmt.Println(">> got error recieving bitfield : ", err, peer.String())
 		return nil, err
 	}
 
+	p := peer.Peer{}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		p = peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
 	return &Client{
-		Conn:     conn,
-		Choked:   false,
-		Bitfield: bitfield,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
+		Conn:       conn,
+		Choked:     true,
+		peer:       p,
+		infoHash:   req.InfoHash,
+		peerID:     peerID,
+		extensions: req.SupportsExtensions(),
 	}, nil
+}
+
+// InfoHash returns the infohash this connection was established for
+func (c *Client) InfoHash() [20]byte {
+	return c.infoHash
+}
 
+// Peer returns the remote peer of the connection
+func (c *Client) Peer() peer.Peer {
+	return c.peer
 }
 
 // Read reads and consumes a message from the connection
@@ -106,6 +173,14 @@ func (c *Client) SendRequest(index, begin, length int) error {
 	return err
 }
 
+// SendCancel cancels a request previously sent to the peer
+func (c *Client) SendCancel(index, begin, length int) error {
+	msg := message.FormatCancel(length, index, begin)
+	_, err := c.Conn.Write(msg.Serialize())
+
+	return err
+}
+
 // SendIntrested sends an Intresseted message to a peer
 func (c *Client) SendInterested() error {
 	msg := message.Message{ID: message.MsgInterested}
@@ -135,3 +210,27 @@ func (c *Client) SendHave(index int) error {
 
 	return err
 }
+
+// SendChoke sends a Choke message to a peer
+func (c *Client) SendChoke() error {
+	msg := message.Message{ID: message.MsgChoke}
+	_, err := c.Conn.Write(msg.Serialize())
+
+	return err
+}
+
+// SendBitfield sends the pieces we have to a peer
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	msg := message.Message{ID: message.MsgBitfield, Payload: bf}
+	_, err := c.Conn.Write(msg.Serialize())
+
+	return err
+}
+
+// SendPiece sends a block of piece index starting at begin
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	msg := message.FormatPiece(index, begin, block)
+	_, err := c.Conn.Write(msg.Serialize())
+
+	return err
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/message"
+)
+
+const (
+	// ClientVersion is what we advertise in the "v" key of the extended handshake
+	ClientVersion = "btorrent 0.1"
+	// DefaultReqq is the number of outstanding requests we accept from a peer
+	DefaultReqq = 250
+	// ExtHandshakeID is the extended message id reserved for the extended handshake
+	ExtHandshakeID uint8 = 0
+	// maxHandshakeString is the longest string a peer may put in its extended handshake
+	maxHandshakeString = 4096
+)
+
+// ExtendedHandshake is the dictionary exchanged in extended message 0 (BEP 10)
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`
+	YourIP       string         `bencode:"yourip,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// Serialize bencodes the handshake dictionary
+func (h *ExtendedHandshake) Serialize() ([]byte, error) {
+	if h.M == nil {
+		h.M = map[string]int{}
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, *h)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ParseExtendedHandshake parses the payload of an extended message 0, without the leading id
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	h := ExtendedHandshake{}
+	d := bencode.NewDecoder(bytes.NewReader(payload))
+	d.MaxStringLength = maxHandshakeString
+	err := d.Decode(&h)
+	if err != nil {
+		return nil, err
+	}
+	if h.M == nil {
+		h.M = map[string]int{}
+	}
+	return &h, nil
+}
+
+// compactIP encodes ip as 4 bytes for IPv4 and 16 bytes for IPv6, as yourip expects
+func compactIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
+	}
+	return string(ip.To16())
+}
+
+// SupportsExtensions reports whether the peer set the extension protocol bit in its handshake
+func (c *Client) SupportsExtensions() bool {
+	return c.extensions
+}
+
+// PeerExtension returns the id the peer assigned to extension name, 0 if it does not support it
+func (c *Client) PeerExtension(name string) uint8 {
+	if c.PeerExtensions == nil {
+		return 0
+	}
+	return uint8(c.PeerExtensions.M[name])
+}
+
+// SendExtendedHandshake sends our extended handshake, extensions maps extension names to our local ids
+func (c *Client) SendExtendedHandshake(extensions map[string]int, metadataSize int) error {
+	h := ExtendedHandshake{
+		M:            extensions,
+		V:            ClientVersion,
+		YourIP:       compactIP(c.peer.IP),
+		Reqq:         DefaultReqq,
+		MetadataSize: metadataSize,
+	}
+	payload, err := h.Serialize()
+	if err != nil {
+		return err
+	}
+	_, err = c.Conn.Write(message.FormatExtended(ExtHandshakeID, payload).Serialize())
+	return err
+}
+
+// SendExtended sends payload as extension name, using the id the peer gave it
+func (c *Client) SendExtended(name string, payload []byte) error {
+	id := c.PeerExtension(name)
+	if id == 0 {
+		return fmt.Errorf("peer does not support extension %s", name)
+	}
+	_, err := c.Conn.Write(message.FormatExtended(id, payload).Serialize())
+	return err
+}
+
+// HandleExtended records the peer's extended handshake, other extended
+// messages are returned as (id, payload) for the caller to dispatch
+func (c *Client) HandleExtended(msg *message.Message) (uint8, []byte, error) {
+	if msg.ID != message.MsgExtended {
+		return 0, nil, fmt.Errorf("Expected Extended Message (%d) got (%d)", message.MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("extended message without id")
+	}
+	id, payload := msg.Payload[0], msg.Payload[1:]
+	if id == ExtHandshakeID {
+		h, err := ParseExtendedHandshake(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.PeerExtensions = h
+	}
+	return id, payload, nil
+}
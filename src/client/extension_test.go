@@ -0,0 +1,37 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/brkss/btorrent/src/message"
+	"github.com/brkss/btorrent/src/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	c := &Client{Conn: local, peer: peer.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}}
+
+	go c.SendExtendedHandshake(map[string]int{"ut_metadata": 1}, 1234)
+
+	msg, err := message.Read(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, message.MsgExtended, msg.ID)
+
+	other := &Client{}
+	id, _, err := other.HandleExtended(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, ExtHandshakeID, id)
+	assert.Equal(t, &ExtendedHandshake{
+		M:            map[string]int{"ut_metadata": 1},
+		V:            ClientVersion,
+		YourIP:       string([]byte{192, 0, 2, 1}),
+		Reqq:         DefaultReqq,
+		MetadataSize: 1234,
+	}, other.PeerExtensions)
+	assert.Equal(t, uint8(1), other.PeerExtension("ut_metadata"))
+	assert.Equal(t, uint8(0), other.PeerExtension("ut_pex"))
+}
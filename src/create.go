@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/brkss/btorrent/src/torrentfile"
+)
+
+// listFlag is a flag that can be given several times
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, " ") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// create writes a .torrent for a file or directory:
+// btorrent create [flags] <path>
+func create(args []string) error {
+	flags := newFlagSet("create", "<path>")
+	output := flags.String("o", "", "where to write the torrent (default <name>.torrent)")
+	meta := flags.String("meta", "v1", "metainfo version: v1, v2 or hybrid")
+	pieceLength := flags.Int("piece-length", 0, "piece length in bytes, a power of two (default picked from the size)")
+	name := flags.String("name", "", "name of the torrent (default the base name of path)")
+	comment := flags.String("comment", "", "free text comment")
+	createdBy := flags.String("created-by", "", "creator of the torrent (default btorrent)")
+	private := flags.Bool("private", false, "only share with peers from the trackers")
+	source := flags.String("source", "", "source tag, for private trackers")
+	var trackers, webSeeds listFlag
+	flags.Var(&trackers, "tracker", "tracker tier, comma separated announce URLs (repeatable)")
+	flags.Var(&webSeeds, "web-seed", "web seed URL (repeatable)")
+	err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	version, err := torrentfile.ParseMetaVersion(*meta)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errUsage, err)
+	}
+	opts := torrentfile.CreateOptions{
+		Version:     version,
+		PieceLength: *pieceLength,
+		Name:        *name,
+		URLList:     webSeeds,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		Source:      *source,
+	}
+	for _, tier := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	data, err := torrentfile.Create(flags.Arg(0), opts)
+	if err != nil {
+		return fmt.Errorf("creating torrent: %w", err)
+	}
+
+	out := *output
+	if out == "" {
+		base := *name
+		if base == "" {
+			base = filepath.Base(filepath.Clean(flags.Arg(0)))
+		}
+		out = base + ".torrent"
+	}
+	err = os.WriteFile(out, data, 0644)
+	if err != nil {
+		return fmt.Errorf("writing torrent: %w", err)
+	}
+	fmt.Println(out)
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/dht"
+	"github.com/brkss/btorrent/src/magnet"
+	"github.com/brkss/btorrent/src/torrentfile"
+)
+
+// DHT_TIMEOUT is how long dht get and put wait by default
+const DHT_TIMEOUT = time.Second * 30
+
+// nodeFlags are the flags of the commands running a DHT node of their own
+type nodeFlags struct {
+	port      *uint
+	timeout   *time.Duration
+	dhtState  *string
+	bootstrap listFlag
+}
+
+func addNodeFlags(flags *flag.FlagSet) *nodeFlags {
+	f := &nodeFlags{
+		port:     flags.Uint("port", 0, "UDP port of the DHT node (default any free port)"),
+		timeout:  flags.Duration("timeout", DHT_TIMEOUT, "give up after this long"),
+		dhtState: flags.String("dht-state", defaultDHTState(), "file keeping the DHT node id and known nodes between runs, empty to keep nothing"),
+	}
+	flags.Var(&f.bootstrap, "dht-bootstrap", "host:port of a node to join the DHT through (repeatable, default well known routers)")
+	return f
+}
+
+// start starts a DHT node and waits until it joined the network, the
+// returned context is done on interrupt or timeout
+func (f *nodeFlags) start() (*dht.Server, context.Context, context.CancelFunc, error) {
+	if *f.port > 65535 {
+		return nil, nil, nil, fmt.Errorf("%w: invalid port %d", errUsage, *f.port)
+	}
+	// the node lives for one command, no point in others keeping it around
+	d, err := dht.New(dht.Config{
+		Port:      uint16(*f.port),
+		Bootstrap: bootstrapNodes(f.bootstrap),
+		StateFile: stateFile(*f.dhtState),
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	interrupted, stop := interruptContext()
+	ctx, cancel := context.WithTimeout(interrupted, *f.timeout)
+	cancelAll := func() {
+		cancel()
+		stop()
+		d.Close()
+	}
+	err = d.Bootstrap(ctx)
+	if err != nil {
+		cancelAll()
+		return nil, nil, nil, err
+	}
+	return d, ctx, cancelAll, nil
+}
+
+// dhtCommand reads and writes items on the DHT (BEP 44):
+// btorrent dht <get|put|keygen|publish> [flags] [arguments]
+func dhtCommand(args []string) error {
+	subcommands := map[string]func([]string) error{
+		"get":     dhtGet,
+		"put":     dhtPut,
+		"keygen":  dhtKeygen,
+		"publish": dhtPublish,
+	}
+	if len(args) == 0 || subcommands[args[0]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: btorrent dht <get|put|keygen|publish> [flags] [arguments]")
+		fmt.Fprintln(os.Stderr, "\n  get      print the item at a target or of a public key")
+		fmt.Fprintln(os.Stderr, "  put      store an item, signed when a key is given")
+		fmt.Fprintln(os.Stderr, "  keygen   create a key to sign items with")
+		fmt.Fprintln(os.Stderr, "  publish  point the updatable torrent link of a key to a torrent")
+		return errUsage
+	}
+	return subcommands[args[0]](args[1:])
+}
+
+// dhtGet prints the immutable item at a 40 hex digits target, or the mutable
+// item of a 64 hex digits public key:
+// btorrent dht get [flags] <target|public key>
+func dhtGet(args []string) error {
+	flags := newFlagSet("dht get", "<target|public key>")
+	salt := flags.String("salt", "", "salt of the mutable item")
+	raw := flags.Bool("bencoded", false, "print the value bencoded even when it is a string")
+	node := addNodeFlags(flags)
+	err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	key, err := hex.DecodeString(flags.Arg(0))
+	if err != nil || len(key) != dht.NODE_ID_LENGTH && len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: %q is neither a target nor a public key", errUsage, flags.Arg(0))
+	}
+
+	d, ctx, stop, err := node.start()
+	if err != nil {
+		return err
+	}
+	defer stop()
+	var item *dht.Item
+	if len(key) == ed25519.PublicKeySize {
+		item, err = d.GetMutable(ctx, ed25519.PublicKey(key), []byte(*salt))
+	} else {
+		var target dht.NodeID
+		copy(target[:], key)
+		item, err = d.GetImmutable(ctx, target)
+	}
+	if err != nil {
+		return err
+	}
+	if item.Mutable() {
+		fmt.Fprintf(os.Stderr, "seq %d\n", item.Seq)
+	}
+
+	var s string
+	if !*raw && bencode.Unmarshal(bytes.NewReader(item.V), &s) == nil {
+		fmt.Println(s)
+	} else {
+		os.Stdout.Write(item.V)
+		fmt.Println()
+	}
+	return nil
+}
+
+// dhtPut stores a value, - reads it from stdin, and prints its target. With
+// a key the item is mutable and by default replaces the current one:
+// btorrent dht put [flags] <value|->
+func dhtPut(args []string) error {
+	flags := newFlagSet("dht put", "<value|->")
+	keyFile := flags.String("key", "", "key file of btorrent dht keygen, makes the item mutable")
+	salt := flags.String("salt", "", "salt of the mutable item")
+	seq := flags.Int64("seq", -1, "sequence number of the mutable item (default one more than the current one, which must not change meanwhile)")
+	isBencoded := flags.Bool("bencoded", false, "the value is bencoded already, not a string")
+	node := addNodeFlags(flags)
+	err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	value := []byte(flags.Arg(0))
+	if flags.Arg(0) == "-" {
+		value, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+	item := &dht.Item{V: value}
+	if !*isBencoded {
+		item.V, err = bencode.EncodeBytes(string(value))
+		if err != nil {
+			return err
+		}
+	}
+	var priv ed25519.PrivateKey
+	if *keyFile != "" {
+		priv, err = readKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		item.Salt = []byte(*salt)
+	}
+
+	d, ctx, stop, err := node.start()
+	if err != nil {
+		return err
+	}
+	defer stop()
+	switch {
+	case priv == nil:
+		err = d.Put(ctx, item)
+	case *seq >= 0:
+		item.Seq = *seq
+		item.Sign(priv)
+		err = d.Put(ctx, item)
+	default:
+		current, getErr := d.GetMutable(ctx, priv.Public().(ed25519.PublicKey), item.Salt)
+		switch getErr {
+		case nil:
+			item.Seq = current.Seq + 1
+			item.Sign(priv)
+			err = d.CompareAndPut(ctx, item, current.Seq)
+		case dht.ErrItemNotFound:
+			item.Sign(priv)
+			err = d.Put(ctx, item)
+		default:
+			err = getErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if item.Mutable() {
+		fmt.Fprintf(os.Stderr, "seq %d\n", item.Seq)
+	}
+	target := item.Target()
+	fmt.Println(target.String())
+	return nil
+}
+
+// dhtPublish points the updatable torrent link of a key to a torrent (BEP
+// 46) and prints the link, which stays the same from one torrent to the next.
+// The item is forgotten by the DHT unless published again within a few hours:
+// btorrent dht publish [flags] -key <key file> <torrent>
+func dhtPublish(args []string) error {
+	flags := newFlagSet("dht publish", "-key <key file> <torrent>")
+	keyFile := flags.String("key", "", "key file of btorrent dht keygen")
+	salt := flags.String("salt", "", "salt telling apart the updatable torrents of one key")
+	node := addNodeFlags(flags)
+	err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *keyFile == "" {
+		flags.Usage()
+		return errUsage
+	}
+	priv, err := readKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	tf, err := openTorrent(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	d, ctx, stop, err := node.start()
+	if err != nil {
+		return err
+	}
+	defer stop()
+	seq, err := torrentfile.PublishMutable(ctx, d, priv, []byte(*salt), tf.InfoHash)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "seq %d\n", seq)
+
+	m := magnet.Magnet{Name: tf.Name, PublicKey: priv.Public().(ed25519.PublicKey), Salt: []byte(*salt)}
+	for _, tier := range tf.AnnounceList {
+		m.Trackers = append(m.Trackers, tier...)
+	}
+	if len(m.Trackers) == 0 && tf.Announce != "" {
+		m.Trackers = []string{tf.Announce}
+	}
+	fmt.Println(m.String())
+	return nil
+}
+
+// dhtKeygen writes a new ed25519 key to a file only we can read and prints
+// its public key:
+// btorrent dht keygen [flags] <key file>
+func dhtKeygen(args []string) error {
+	flags := newFlagSet("dht keygen", "<key file>")
+	err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(flags.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(file, hex.EncodeToString(priv.Seed()))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(hex.EncodeToString(pub))
+	return nil
+}
+
+// readKey reads a key file of dhtKeygen, the hex of an ed25519 seed
+func readKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a key file of btorrent dht keygen", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,591 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/peer"
+)
+
+const (
+	QUERY_TIMEOUT        = time.Second * 2 // how long we wait for a node to answer
+	ALPHA                = 3               // queries a lookup has in flight at once
+	MAINTENANCE_INTERVAL = time.Minute     // how often tokens rotate, peers expire and buckets are refreshed
+	MAX_PACKET_SIZE      = 65536
+)
+
+// DEFAULT_BOOTSTRAP are well known nodes to join the mainline DHT through
+var DEFAULT_BOOTSTRAP = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var (
+	// ErrClosed is returned by queries of a closed Server
+	ErrClosed = errors.New("dht: server closed")
+	// ErrNoNodes is returned when the routing table is empty and no bootstrap node answered
+	ErrNoNodes = errors.New("dht: no node to ask")
+	errTimeout = errors.New("dht: query timed out")
+	errFamily  = errors.New("dht: no socket for the address family")
+)
+
+// Config tells New how to run the node
+type Config struct {
+	Port      uint16   // UDP port to listen on, any free port when 0
+	Bootstrap []string // host:port of the nodes we join the network through, see DEFAULT_BOOTSTRAP
+	StateFile string   // where our id, nodes and peers are kept between runs, nothing is kept when empty
+	NoIPv6    bool     // only run on IPv4, by default an IPv6 node runs too when the host has IPv6
+	ReadOnly  bool     // only ask, never answer, so others keep us out of their tables (BEP 43)
+}
+
+// Server is a node of the mainline DHT (BEP 5), on IPv4 and IPv6 when the
+// host has it (BEP 32). It answers the queries of other nodes, stores the
+// peers announced to it and looks up peers for us. Our ids follow our
+// external address and nodes whose id doesn't match theirs never enter the
+// routing tables (BEP 42)
+type Server struct {
+	v4        *family
+	v6        *family // nil without IPv6
+	tokens    *tokens
+	items     *itemStore
+	peers     *peerStore // announced to us
+	found     *peerStore // found by our lookups, never handed to other nodes
+	bootstrap []string
+	stateFile string
+	readOnly  bool
+
+	mu      sync.Mutex
+	pending map[string]*transaction
+	nextTx  uint16
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      sync.WaitGroup
+}
+
+// transaction is a query waiting for its reply
+type transaction struct {
+	addr  *net.UDPAddr
+	reply chan *msg
+}
+
+// New starts a node listening on cfg.Port, it joins the network in the
+// background. With a state file it keeps the id of the previous run and
+// starts from the nodes and peers it knew then, a state file that can't be
+// read is logged and ignored
+func New(cfg Config) (*Server, error) {
+	st := &bencodeState{}
+	if cfg.StateFile != "" {
+		loaded, err := loadState(cfg.StateFile)
+		if err != nil {
+			log.Printf("dht state %s ignored: %s\n", cfg.StateFile, err)
+		} else {
+			st = loaded
+		}
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(cfg.Port)})
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		v4:        newFamily(WANT_IPV4, conn, st.ID),
+		tokens:    newTokens(),
+		items:     newItemStore(),
+		peers:     newPeerStore(PEER_TTL),
+		found:     newPeerStore(FOUND_PEER_TTL),
+		bootstrap: cfg.Bootstrap,
+		stateFile: cfg.StateFile,
+		readOnly:  cfg.ReadOnly,
+		pending:   make(map[string]*transaction),
+		closed:    make(chan struct{}),
+	}
+	if !cfg.NoIPv6 {
+		conn6, err := net.ListenUDP("udp6", &net.UDPAddr{Port: int(s.Port())})
+		if err == nil {
+			s.v6 = newFamily(WANT_IPV6, conn6, st.ID6)
+		}
+	}
+	s.restore(st)
+	for _, f := range s.families() {
+		s.done.Add(1)
+		go s.readLoop(f)
+	}
+	s.done.Add(1)
+	go s.maintain()
+	return s, nil
+}
+
+func (s *Server) families() []*family {
+	if s.v6 == nil {
+		return []*family{s.v4}
+	}
+	return []*family{s.v4, s.v6}
+}
+
+// familyOf returns the family talking to ip, nil when we don't run it
+func (s *Server) familyOf(ip net.IP) *family {
+	if ip.To4() != nil {
+		return s.v4
+	}
+	return s.v6
+}
+
+// ID returns our IPv4 node id
+func (s *Server) ID() NodeID {
+	return s.v4.id()
+}
+
+// ID6 returns our IPv6 node id, false when we don't run on IPv6
+func (s *Server) ID6() (NodeID, bool) {
+	if s.v6 == nil {
+		return NodeID{}, false
+	}
+	return s.v6.id(), true
+}
+
+// Port returns the UDP port we listen on
+func (s *Server) Port() uint16 {
+	return uint16(s.v4.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// Nodes returns the number of nodes in the routing tables
+func (s *Server) Nodes() int {
+	count := 0
+	for _, f := range s.families() {
+		count += f.table().len()
+	}
+	return count
+}
+
+// answered returns the number of nodes that answered since t
+func (s *Server) answered(since time.Time) int {
+	count := 0
+	for _, f := range s.families() {
+		count += f.table().answered(since)
+	}
+	return count
+}
+
+// Close stops the node and writes the state file, pending lookups fail with ErrClosed
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		for _, f := range s.families() {
+			if closeErr := f.conn.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		s.done.Wait()
+		if saveErr := s.saveState(); err == nil {
+			err = saveErr
+		}
+	})
+	return err
+}
+
+// AddNode pings the node at addr (host:port), it joins the routing table if it answers
+func (s *Server) AddNode(addr string) {
+	go func() {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return
+		}
+		s.query(context.Background(), udpAddr, queryPing, &args{})
+	}()
+}
+
+func (s *Server) send(f *family, m *msg, addr *net.UDPAddr) error {
+	data, err := bencode.EncodeBytes(m)
+	if err != nil {
+		return err
+	}
+	_, err = f.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (s *Server) readLoop(f *family) {
+	defer s.done.Done()
+	buf := make([]byte, MAX_PACKET_SIZE)
+	for {
+		n, addr, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+				continue
+			}
+		}
+		m, err := parseMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch m.Y {
+		case typeQuery:
+			if !s.readOnly {
+				s.handleQuery(f, m, addr)
+			}
+		case typeResponse, typeError:
+			s.deliver(m, addr)
+		}
+	}
+}
+
+// deliver hands a reply to the query waiting for it, replies coming from
+// another address than the one we asked are dropped
+func (s *Server) deliver(m *msg, addr *net.UDPAddr) {
+	s.mu.Lock()
+	tx, ok := s.pending[m.T]
+	if ok && tx.addr.IP.Equal(addr.IP) && tx.addr.Port == addr.Port {
+		delete(s.pending, m.T)
+	} else {
+		ok = false
+	}
+	s.mu.Unlock()
+	if ok {
+		tx.reply <- m
+	}
+}
+
+// query sends q to addr and waits for the reply, the routing table learns
+// whether the node answered
+func (s *Server) query(ctx context.Context, addr *net.UDPAddr, q string, a *args) (*reply, error) {
+	f := s.familyOf(addr.IP)
+	if f == nil {
+		return nil, errFamily
+	}
+	id := f.id()
+	a.ID = string(id[:])
+	tx := &transaction{addr: addr, reply: make(chan *msg, 1)}
+	s.mu.Lock()
+	var t string
+	for {
+		s.nextTx++
+		t = string(binary.BigEndian.AppendUint16(nil, s.nextTx))
+		if _, used := s.pending[t]; !used {
+			break
+		}
+	}
+	s.pending[t] = tx
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, t)
+		s.mu.Unlock()
+	}()
+
+	out := &msg{T: t, Y: typeQuery, Q: q, A: a}
+	if s.readOnly {
+		out.RO = 1
+	}
+	err := s.send(f, out, addr)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(QUERY_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case m := <-tx.reply:
+		if m.Y == typeError {
+			return nil, remoteError(m.E)
+		}
+		if m.R == nil {
+			return nil, &Error{ERROR_PROTOCOL, "response without r"}
+		}
+		id, err := nodeID(m.R.ID)
+		if err != nil {
+			return nil, err
+		}
+		f.learnIP(addr, m.IP)
+		if validID(id, addr.IP) {
+			f.table().seen(id, addr)
+		}
+		return m.R, nil
+	case <-timer.C:
+		f.table().failed(addr)
+		return nil, errTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (s *Server) handleQuery(f *family, m *msg, addr *net.UDPAddr) {
+	fail := func(code int, message string) {
+		s.send(f, errorMsg(m.T, code, message), addr)
+	}
+	if m.A == nil {
+		fail(ERROR_PROTOCOL, "missing arguments")
+		return
+	}
+	id, err := nodeID(m.A.ID)
+	if err != nil {
+		fail(ERROR_PROTOCOL, err.Error())
+		return
+	}
+	if m.RO == 0 && validID(id, addr.IP) {
+		f.table().seen(id, addr)
+	}
+
+	self := f.id()
+	r := &reply{ID: string(self[:])}
+	switch m.Q {
+	case queryPing:
+	case queryFindNode:
+		target, err := nodeID(m.A.Target)
+		if err != nil {
+			fail(ERROR_PROTOCOL, "invalid target")
+			return
+		}
+		s.closestNodes(r, f, m.A.Want, target)
+	case queryGetPeers:
+		infoHash, err := nodeID(m.A.InfoHash)
+		if err != nil {
+			fail(ERROR_PROTOCOL, "invalid info_hash")
+			return
+		}
+		r.Token = s.tokens.token(addr.IP)
+		s.closestNodes(r, f, m.A.Want, infoHash)
+		for _, p := range s.peers.get(infoHash, MAX_VALUES) {
+			// peers of the other family are no use to the querying node
+			if s.familyOf(p.IP) == f {
+				r.Values = append(r.Values, compactPeer(p))
+			}
+		}
+	case queryAnnouncePeer:
+		infoHash, err := nodeID(m.A.InfoHash)
+		if err != nil {
+			fail(ERROR_PROTOCOL, "invalid info_hash")
+			return
+		}
+		if !s.tokens.valid(m.A.Token, addr.IP) {
+			fail(ERROR_PROTOCOL, "bad token")
+			return
+		}
+		port := m.A.Port
+		if m.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			fail(ERROR_PROTOCOL, "invalid port")
+			return
+		}
+		s.peers.add(infoHash, peer.Peer{IP: addr.IP, Port: uint16(port)})
+	case queryGet:
+		target, err := nodeID(m.A.Target)
+		if err != nil {
+			fail(ERROR_PROTOCOL, "invalid target")
+			return
+		}
+		r.Token = s.tokens.token(addr.IP)
+		s.closestNodes(r, f, m.A.Want, target)
+		// with seq the asker only wants a newer item
+		if it := s.items.get(target); it != nil && (m.A.Seq == nil || !it.Mutable() || it.Seq > *m.A.Seq) {
+			r.V = it.V
+			if it.Mutable() {
+				r.K, r.Sig, r.Seq = string(it.K), string(it.Sig), &it.Seq
+			}
+		}
+	case queryPut:
+		if !s.tokens.valid(m.A.Token, addr.IP) {
+			fail(ERROR_PROTOCOL, "bad token")
+			return
+		}
+		it := &Item{V: m.A.V, Salt: []byte(m.A.Salt)}
+		if m.A.K != "" {
+			it.K, it.Sig = ed25519.PublicKey(m.A.K), []byte(m.A.Sig)
+			if m.A.Seq != nil {
+				it.Seq = *m.A.Seq
+			}
+		}
+		if e := it.check(); e != nil {
+			fail(e.Code, e.Message)
+			return
+		}
+		if e := s.items.put(it, m.A.CAS); e != nil {
+			fail(e.Code, e.Message)
+			return
+		}
+	default:
+		fail(ERROR_METHOD, "method unknown")
+		return
+	}
+	s.send(f, &msg{T: m.T, Y: typeResponse, R: r, IP: compactPeer(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)})}, addr)
+}
+
+// closestNodes puts the nodes closest to target in r, from the tables want
+// asks for or from the table of the querying family without want (BEP 32)
+func (s *Server) closestNodes(r *reply, f *family, want []string, target NodeID) {
+	if len(want) == 0 {
+		want = []string{f.want}
+	}
+	for _, w := range want {
+		switch {
+		case w == WANT_IPV4:
+			r.Nodes = encodeNodes(s.v4.table().closest(target, K))
+		case w == WANT_IPV6 && s.v6 != nil:
+			r.Nodes6 = encodeNodes6(s.v6.table().closest(target, K))
+		}
+	}
+}
+
+// compactPeer returns the compact peer info of p, as in tracker responses
+func compactPeer(p peer.Peer) string {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP
+	}
+	return string(binary.BigEndian.AppendUint16(append([]byte{}, ip...), p.Port))
+}
+
+func (s *Server) maintain() {
+	defer s.done.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.closed
+		cancel()
+	}()
+
+	err := s.Bootstrap(ctx)
+	if err != nil && ctx.Err() == nil {
+		log.Printf("dht bootstrap failed: %s\n", err)
+	}
+	ticker := time.NewTicker(MAINTENANCE_INTERVAL)
+	defer ticker.Stop()
+	saved := time.Now()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		s.tokens.rotate()
+		s.peers.expire()
+		s.found.expire()
+		s.items.expire()
+		if time.Since(saved) >= STATE_SAVE_INTERVAL {
+			err := s.saveState()
+			if err != nil {
+				log.Printf("dht state not saved: %s\n", err)
+			}
+			saved = time.Now()
+		}
+		if s.Nodes() == 0 {
+			s.Bootstrap(ctx)
+			continue
+		}
+		for _, f := range s.families() {
+			for _, target := range f.table().stale() {
+				s.lookup(ctx, f, target, queryFindNode, nil)
+			}
+		}
+	}
+}
+
+// Bootstrap joins the network: the bootstrap nodes are asked for the nodes
+// closest to us, then a lookup of our own id fills the routing tables. Nodes
+// restored from the state file are tried first, the bootstrap nodes are only
+// asked when fewer than K of them still answer
+func (s *Server) Bootstrap(ctx context.Context) error {
+	if s.Nodes() > 0 {
+		start := time.Now()
+		s.lookupSelf(ctx)
+		if s.answered(start) >= K || ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	// an IPv4 router can hand out IPv6 nodes too
+	want := []string{WANT_IPV4}
+	if s.v6 != nil {
+		want = append(want, WANT_IPV6)
+	}
+	var wg sync.WaitGroup
+	for _, addr := range s.bootstrap {
+		for _, f := range s.families() {
+			udpAddr, err := net.ResolveUDPAddr(f.network, addr)
+			if err != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(f *family) {
+				defer wg.Done()
+				id := f.id()
+				r, err := s.query(ctx, udpAddr, queryFindNode, &args{Target: string(id[:]), Want: want})
+				if err != nil {
+					return
+				}
+				nodes, _ := decodeNodes(r.Nodes)
+				nodes6, _ := decodeNodes6(r.Nodes6)
+				for _, n := range append(nodes, nodes6...) {
+					s.query(ctx, n.addr, queryPing, &args{})
+				}
+			}(f)
+		}
+	}
+	wg.Wait()
+	if s.Nodes() == 0 {
+		return ErrNoNodes
+	}
+	s.lookupSelf(ctx)
+	return ctx.Err()
+}
+
+// lookupSelf looks our own ids up, which fills the buckets close to us
+func (s *Server) lookupSelf(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, f := range s.families() {
+		if f.table().len() == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(f *family) {
+			defer wg.Done()
+			s.lookup(ctx, f, f.id(), queryFindNode, nil)
+		}(f)
+	}
+	wg.Wait()
+}
+
+// GetPeers looks infoHash up and returns the peers the nodes close to it know
+func (s *Server) GetPeers(ctx context.Context, infoHash [20]byte) ([]peer.Peer, error) {
+	_, peers, err := s.lookupAll(ctx, NodeID(infoHash), queryGetPeers, nil)
+	return peers, err
+}
+
+// Announce looks infoHash up then tells the closest nodes that we are a
+// peer of it listening on port, the peers found on the way are returned
+func (s *Server) Announce(ctx context.Context, infoHash [20]byte, port uint16) ([]peer.Peer, error) {
+	closest, peers, err := s.lookupAll(ctx, NodeID(infoHash), queryGetPeers, nil)
+	if err != nil {
+		return peers, err
+	}
+	var wg sync.WaitGroup
+	for _, n := range closest {
+		if n.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(n *lookupNode) {
+			defer wg.Done()
+			s.query(ctx, n.addr, queryAnnouncePeer, &args{
+				InfoHash: string(infoHash[:]),
+				Port:     int(port),
+				Token:    n.token,
+			})
+		}(n)
+	}
+	wg.Wait()
+	return peers, nil
+}
@@ -0,0 +1,200 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// network starts n nodes on localhost, all bootstrapping through the first one
+func network(t *testing.T, n int) []*Server {
+	first, err := New(Config{})
+	assert.Nil(t, err)
+	t.Cleanup(func() { first.Close() })
+	nodes := []*Server{first}
+	bootstrap := []string{fmt.Sprintf("127.0.0.1:%d", first.Port())}
+	for i := 1; i < n; i++ {
+		s, err := New(Config{Bootstrap: bootstrap})
+		assert.Nil(t, err)
+		t.Cleanup(func() { s.Close() })
+		nodes = append(nodes, s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	for _, s := range nodes[1:] {
+		assert.Nil(t, s.Bootstrap(ctx))
+	}
+	return nodes
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := network(t, 12)
+	for _, s := range nodes {
+		assert.Greater(t, s.Nodes(), 0)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	infoHash := [20]byte{1, 2, 3}
+	_, err := nodes[3].Announce(ctx, infoHash, 4242)
+	assert.Nil(t, err)
+
+	peers, err := nodes[9].GetPeers(ctx, infoHash)
+	assert.Nil(t, err)
+	assert.Len(t, peers, 1)
+	assert.Equal(t, "127.0.0.1:4242", peers[0].String())
+}
+
+func TestQueryErrors(t *testing.T) {
+	nodes := network(t, 2)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(nodes[0].Port())}
+	ctx := context.Background()
+
+	_, err := nodes[1].query(ctx, addr, "unknown", &args{})
+	assert.Equal(t, &Error{ERROR_METHOD, "method unknown"}, err)
+
+	_, err = nodes[1].query(ctx, addr, queryAnnouncePeer, &args{InfoHash: string(make([]byte, 20)), Port: 1, Token: "nope"})
+	assert.Equal(t, &Error{ERROR_PROTOCOL, "bad token"}, err)
+
+	r, err := nodes[1].query(ctx, addr, queryPing, &args{})
+	assert.Nil(t, err)
+	id := nodes[0].ID()
+	assert.Equal(t, string(id[:]), r.ID)
+}
+
+func TestIPv6(t *testing.T) {
+	first, err := New(Config{})
+	assert.Nil(t, err)
+	defer first.Close()
+	if _, ok := first.ID6(); !ok {
+		t.Skip("no IPv6")
+	}
+	bootstrap := []string{fmt.Sprintf("127.0.0.1:%d", first.Port()), fmt.Sprintf("[::1]:%d", first.Port())}
+	var nodes []*Server
+	for i := 0; i < 4; i++ {
+		s, err := New(Config{Bootstrap: bootstrap})
+		assert.Nil(t, err)
+		defer s.Close()
+		nodes = append(nodes, s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	for _, s := range nodes {
+		assert.Nil(t, s.Bootstrap(ctx))
+		assert.Greater(t, s.v6.table().len(), 0)
+	}
+	// an IPv4 node hands out IPv6 nodes too when asked with want
+	late, err := New(Config{Bootstrap: bootstrap[:1]})
+	assert.Nil(t, err)
+	defer late.Close()
+	assert.Nil(t, late.Bootstrap(ctx))
+	assert.Greater(t, late.v6.table().len(), 0)
+
+	infoHash := [20]byte{7, 8, 9}
+	_, err = nodes[0].Announce(ctx, infoHash, 4242)
+	assert.Nil(t, err)
+	peers, err := nodes[3].GetPeers(ctx, infoHash)
+	assert.Nil(t, err)
+	var addrs []string
+	for _, p := range peers {
+		addrs = append(addrs, p.String())
+	}
+	assert.ElementsMatch(t, []string{"127.0.0.1:4242", "[::1]:4242"}, addrs)
+}
+
+func TestTableBuckets(t *testing.T) {
+	self := NodeID{}
+	tbl := newTable(self)
+	addr := func(i int) *net.UDPAddr { return &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 6881} }
+
+	// every id with the first bit set lands in bucket 0
+	for i := 0; i < K+2; i++ {
+		tbl.seen(NodeID{0x80, byte(i)}, addr(i))
+	}
+	assert.Equal(t, K, tbl.len())
+
+	// a failing node makes room for a new one
+	tbl.failed(addr(0))
+	tbl.failed(addr(0))
+	assert.Equal(t, K-1, tbl.len())
+	tbl.seen(NodeID{0x80, 0xff}, addr(0xff))
+	assert.Equal(t, K, tbl.len())
+
+	tbl.seen(NodeID{0x01}, addr(100))
+	closest := tbl.closest(NodeID{0x01, 0x01}, 2)
+	assert.Equal(t, NodeID{0x01}, closest[0].id)
+	assert.Equal(t, NodeID{0x80, 0x01}, closest[1].id)
+
+	// our own id never gets in
+	tbl.seen(self, addr(200))
+	assert.Equal(t, K+1, tbl.len())
+}
+
+func TestRandomIDWithPrefix(t *testing.T) {
+	id := randomID()
+	for _, prefix := range []int{0, 1, 7, 8, 13, 159} {
+		assert.Equal(t, prefix, commonPrefix(id, randomIDWithPrefix(id, prefix)))
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []node{
+		{id: NodeID{1}, addr: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}},
+		{id: NodeID{2}, addr: &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 1}},
+	}
+	data := encodeNodes(nodes)
+	assert.Len(t, data, 2*COMPACT_NODE_LENGTH)
+	decoded, err := decodeNodes(data)
+	assert.Nil(t, err)
+	assert.Len(t, decoded, 2)
+	assert.Equal(t, NodeID{2}, decoded[1].id)
+	assert.Equal(t, "5.6.7.8:1", decoded[1].addr.String())
+
+	_, err = decodeNodes(data[1:])
+	assert.NotNil(t, err)
+
+	// each family only encodes its own nodes
+	nodes = append(nodes, node{id: NodeID{3}, addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}})
+	assert.Len(t, encodeNodes(nodes), 2*COMPACT_NODE_LENGTH)
+	data = encodeNodes6(nodes)
+	assert.Len(t, data, COMPACT_NODE6_LENGTH)
+	decoded, err = decodeNodes6(data)
+	assert.Nil(t, err)
+	assert.Equal(t, NodeID{3}, decoded[0].id)
+	assert.Equal(t, "[2001:db8::1]:6881", decoded[0].addr.String())
+}
+
+func TestTokens(t *testing.T) {
+	tk := newTokens()
+	ip := net.IPv4(1, 2, 3, 4)
+	token := tk.token(ip)
+	assert.True(t, tk.valid(token, ip))
+	assert.False(t, tk.valid(token, net.IPv4(1, 2, 3, 5)))
+
+	// still valid after one rotation, not after two
+	tk.rotated = time.Time{}
+	tk.rotate()
+	assert.True(t, tk.valid(token, ip))
+	tk.rotated = time.Time{}
+	tk.rotate()
+	assert.False(t, tk.valid(token, ip))
+}
+
+func TestReadOnly(t *testing.T) {
+	nodes := network(t, 2)
+	ro, err := New(Config{ReadOnly: true, Bootstrap: []string{fmt.Sprintf("127.0.0.1:%d", nodes[0].Port())}})
+	assert.Nil(t, err)
+	defer ro.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	assert.Nil(t, ro.Bootstrap(ctx))
+
+	// it learns about others, nobody learns about it
+	assert.Equal(t, 2, ro.Nodes())
+	assert.Equal(t, 1, nodes[0].Nodes())
+	assert.Equal(t, 1, nodes[1].Nodes())
+}
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// family is our node on one address family (BEP 32): IPv4 and IPv6 each
+// have their socket, their id and their routing table
+type family struct {
+	want    string // WANT_IPV4 or WANT_IPV6
+	network string // udp4 or udp6
+	conn    *net.UDPConn
+	votes   *ipVotes
+	current atomic.Pointer[table] // replaced when our id changes, its self is our id
+}
+
+// newFamily returns the family of conn, it keeps savedID when it is an id
+func newFamily(want string, conn *net.UDPConn, savedID string) *family {
+	id, err := nodeID(savedID)
+	if err != nil {
+		id = randomID()
+	}
+	network := "udp4"
+	if want == WANT_IPV6 {
+		network = "udp6"
+	}
+	f := &family{want: want, network: network, conn: conn, votes: newIPVotes()}
+	f.current.Store(newTable(id))
+	return f
+}
+
+func (f *family) table() *table {
+	return f.current.Load()
+}
+
+func (f *family) id() NodeID {
+	return f.table().self
+}
+
+// setID changes our id, the known nodes move to a table around it
+func (f *family) setID(id NodeID) {
+	t := newTable(id)
+	for _, n := range f.table().all() {
+		t.restore(n)
+	}
+	f.current.Store(t)
+}
+
+// learnIP takes the address voter sees us at into account, our id changes
+// when the address most nodes agree on doesn't match it (BEP 42)
+func (f *family) learnIP(voter *net.UDPAddr, compact string) {
+	ip, ok := parseCompactIP(compact)
+	if !ok || (ip.To4() != nil) != (f.want == WANT_IPV4) {
+		return
+	}
+	external, ok := f.votes.add(voter.IP, ip)
+	if ok && !validID(f.id(), external) {
+		f.setID(secureID(external))
+	}
+}
+
+// parseCompactIP returns the address of a compact IPv4 or IPv6 address and port
+func parseCompactIP(compact string) (net.IP, bool) {
+	switch len(compact) {
+	case net.IPv4len + 2:
+		return net.IP([]byte(compact[:net.IPv4len])), true
+	case net.IPv6len + 2:
+		return net.IP([]byte(compact[:net.IPv6len])), true
+	}
+	return nil, false
+}
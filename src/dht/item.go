@@ -0,0 +1,293 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brkss/btorrent/src/bencode"
+)
+
+const (
+	MAX_ITEM_SIZE    = 1000          // bytes of the bencoded value of an item
+	MAX_SALT_SIZE    = 64            // bytes of the salt of a mutable item
+	ITEM_TTL         = time.Hour * 2 // stored items are forgotten unless they are put again
+	MAX_STORED_ITEMS = 10000
+)
+
+// ErrItemNotFound is returned by gets no node has an item for
+var ErrItemNotFound = errors.New("dht: item not found")
+
+// Item is a value stored on the DHT (BEP 44). An immutable item is only its
+// value and lives at the SHA-1 of it. A mutable item is signed by the owner
+// of K and lives at the SHA-1 of K and Salt, a put with a higher Seq
+// replaces it
+type Item struct {
+	V    bencode.RawMessage // bencoded value, at most MAX_ITEM_SIZE bytes
+	K    ed25519.PublicKey  // nil for an immutable item
+	Salt []byte
+	Seq  int64
+	Sig  []byte
+}
+
+// ImmutableTarget returns where the immutable item of bencoded value v lives
+func ImmutableTarget(v []byte) NodeID {
+	return sha1.Sum(v)
+}
+
+// MutableTarget returns where the mutable items of k and salt live
+func MutableTarget(k ed25519.PublicKey, salt []byte) NodeID {
+	return sha1.Sum(append(append([]byte{}, k...), salt...))
+}
+
+// Mutable reports whether the item is signed
+func (it *Item) Mutable() bool {
+	return it.K != nil
+}
+
+// Target returns where the item lives
+func (it *Item) Target() NodeID {
+	if it.Mutable() {
+		return MutableTarget(it.K, it.Salt)
+	}
+	return ImmutableTarget(it.V)
+}
+
+// signedData is what the signature of a mutable item covers
+func (it *Item) signedData() []byte {
+	var buf bytes.Buffer
+	if len(it.Salt) > 0 {
+		buf.WriteString("4:salt" + strconv.Itoa(len(it.Salt)) + ":")
+		buf.Write(it.Salt)
+	}
+	buf.WriteString("3:seqi" + strconv.FormatInt(it.Seq, 10) + "e1:v")
+	buf.Write(it.V)
+	return buf.Bytes()
+}
+
+// Sign makes the item a mutable item of the public key of priv
+func (it *Item) Sign(priv ed25519.PrivateKey) {
+	it.K = priv.Public().(ed25519.PublicKey)
+	it.Sig = ed25519.Sign(priv, it.signedData())
+}
+
+// check returns the KRPC error a node answers a put of the item with
+func (it *Item) check() *Error {
+	if len(it.V) == 0 {
+		return &Error{ERROR_PROTOCOL, "missing v"}
+	}
+	if len(it.V) > MAX_ITEM_SIZE {
+		return &Error{ERROR_TOO_BIG, "message (v field) too big"}
+	}
+	if !it.Mutable() {
+		return nil
+	}
+	if len(it.K) != ed25519.PublicKeySize {
+		return &Error{ERROR_PROTOCOL, "invalid k"}
+	}
+	if len(it.Salt) > MAX_SALT_SIZE {
+		return &Error{ERROR_SALT_TOO_BIG, "salt (salt field) too big"}
+	}
+	if len(it.Sig) != ed25519.SignatureSize || !ed25519.Verify(it.K, it.signedData(), it.Sig) {
+		return &Error{ERROR_BAD_SIGNATURE, "invalid signature"}
+	}
+	return nil
+}
+
+// itemFromReply returns the item of a get reply for target, salt is what
+// the asker used since replies don't carry it. Items that don't live at
+// target or are badly signed are errors
+func itemFromReply(r *reply, target NodeID, salt []byte) (*Item, error) {
+	it := &Item{V: r.V, Salt: salt}
+	if r.K != "" {
+		it.K = ed25519.PublicKey(r.K)
+		it.Sig = []byte(r.Sig)
+		if r.Seq != nil {
+			it.Seq = *r.Seq
+		}
+	}
+	if err := it.check(); err != nil {
+		return nil, fmt.Errorf("dht: bad item: %s", err.Message)
+	}
+	if it.Target() != target {
+		return nil, fmt.Errorf("dht: item doesn't match target %s", target)
+	}
+	return it, nil
+}
+
+// itemStore keeps the items put to us
+type itemStore struct {
+	mu    sync.Mutex
+	items map[NodeID]storedItem
+}
+
+type storedItem struct {
+	item  *Item
+	added time.Time
+}
+
+func newItemStore() *itemStore {
+	return &itemStore{items: make(map[NodeID]storedItem)}
+}
+
+func (s *itemStore) get(target NodeID) *Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	si, ok := s.items[target]
+	if !ok || time.Since(si.added) >= ITEM_TTL {
+		return nil
+	}
+	return si.item
+}
+
+// put stores a checked item, cas is the seq the putter expects us to hold
+func (s *itemStore) put(it *Item, cas *int64) *Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target := it.Target()
+	si, ok := s.items[target]
+	if ok && time.Since(si.added) >= ITEM_TTL {
+		ok = false
+	}
+	if ok && it.Mutable() {
+		if cas != nil && *cas != si.item.Seq {
+			return &Error{ERROR_CAS_MISMATCH, "the CAS hash mismatched, re-read value and try again"}
+		}
+		if it.Seq < si.item.Seq || it.Seq == si.item.Seq && !bytes.Equal(it.V, si.item.V) {
+			return &Error{ERROR_SEQ_TOO_LOW, "sequence number less than current"}
+		}
+	}
+	if !ok && len(s.items) >= MAX_STORED_ITEMS {
+		return &Error{ERROR_SERVER, "storage full"}
+	}
+	s.items[target] = storedItem{it, time.Now()}
+	return nil
+}
+
+// expire forgets items that weren't put again in time
+func (s *itemStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for target, si := range s.items {
+		if time.Since(si.added) >= ITEM_TTL {
+			delete(s.items, target)
+		}
+	}
+}
+
+// GetImmutable looks up the immutable item at target
+func (s *Server) GetImmutable(ctx context.Context, target NodeID) (*Item, error) {
+	return s.get(ctx, target, nil, false)
+}
+
+// GetMutable looks up the mutable item of k and salt, the one with the
+// highest seq any node has
+func (s *Server) GetMutable(ctx context.Context, k ed25519.PublicKey, salt []byte) (*Item, error) {
+	return s.get(ctx, MutableTarget(k, salt), salt, true)
+}
+
+func (s *Server) get(ctx context.Context, target NodeID, salt []byte, mutable bool) (*Item, error) {
+	var mu sync.Mutex
+	var best *Item
+	consider := func(it *Item) {
+		mu.Lock()
+		defer mu.Unlock()
+		if it.Mutable() == mutable && (best == nil || it.Seq > best.Seq) {
+			best = it
+		}
+	}
+	if it := s.items.get(target); it != nil {
+		consider(it)
+	}
+	_, _, err := s.lookupAll(ctx, target, queryGet, func(r *reply) {
+		if len(r.V) == 0 {
+			return
+		}
+		// nodes handing out forged items are ignored
+		it, err := itemFromReply(r, target, salt)
+		if err == nil {
+			consider(it)
+		}
+	})
+	if best != nil {
+		return best, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, ErrItemNotFound
+}
+
+// Put stores item on the nodes closest to its target, a mutable item must be
+// signed with Sign first. It fails when a node holds a newer item, even if
+// others took it, or with the error of one of the nodes when none of them
+// stored it
+func (s *Server) Put(ctx context.Context, item *Item) error {
+	return s.put(ctx, item, nil)
+}
+
+// CompareAndPut puts a mutable item only on the nodes whose stored item has
+// seq cas, so concurrent publishers don't overwrite each other
+func (s *Server) CompareAndPut(ctx context.Context, item *Item, cas int64) error {
+	return s.put(ctx, item, &cas)
+}
+
+func (s *Server) put(ctx context.Context, it *Item, cas *int64) error {
+	if e := it.check(); e != nil {
+		return e
+	}
+	closest, _, err := s.lookupAll(ctx, it.Target(), queryGet, nil)
+	if err != nil {
+		return err
+	}
+	base := args{V: it.V, CAS: cas}
+	if it.Mutable() {
+		seq := it.Seq
+		base.K, base.Sig, base.Salt, base.Seq = string(it.K), string(it.Sig), string(it.Salt), &seq
+	}
+
+	errs := make(chan error, len(closest))
+	sent := 0
+	for _, n := range closest {
+		if n.token == "" {
+			continue
+		}
+		sent++
+		a := base
+		a.Token = n.token
+		go func(n *lookupNode) {
+			_, err := s.query(ctx, n.addr, queryPut, &a)
+			errs <- err
+		}(n)
+	}
+	if sent == 0 {
+		return ErrNoNodes
+	}
+	stored := 0
+	var conflict error
+	for i := 0; i < sent; i++ {
+		e := <-errs
+		var remote *Error
+		switch {
+		case e == nil:
+			stored++
+		case errors.As(e, &remote) && (remote.Code == ERROR_CAS_MISMATCH || remote.Code == ERROR_SEQ_TOO_LOW):
+			conflict = e
+		case err == nil:
+			err = e
+		}
+	}
+	if conflict != nil {
+		return conflict
+	}
+	if stored > 0 {
+		return nil
+	}
+	return err
+}
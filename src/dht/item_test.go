@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestItemSignature(t *testing.T) {
+	// the signed buffer of the examples of BEP 44
+	it := &Item{V: []byte("12:Hello World!"), Seq: 1}
+	assert.Equal(t, "3:seqi1e1:v12:Hello World!", string(it.signedData()))
+	it.Salt = []byte("foobar")
+	assert.Equal(t, "4:salt6:foobar3:seqi1e1:v12:Hello World!", string(it.signedData()))
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	it.Sign(priv)
+	assert.Nil(t, it.check())
+	it.Seq++
+	assert.Equal(t, ERROR_BAD_SIGNATURE, it.check().Code)
+
+	assert.Equal(t, ERROR_TOO_BIG, (&Item{V: make([]byte, MAX_ITEM_SIZE+1)}).check().Code)
+	// the examples' immutable item lives at the SHA-1 of its bencoding
+	assert.Equal(t, "e5f96f6f38320f0f33959cb4d3d656452117aadb", ImmutableTarget(it.V).String())
+}
+
+func TestPutGet(t *testing.T) {
+	nodes := network(t, 8)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	immutable := &Item{V: []byte("5:hello")}
+	assert.Nil(t, nodes[1].Put(ctx, immutable))
+	got, err := nodes[6].GetImmutable(ctx, immutable.Target())
+	assert.Nil(t, err)
+	assert.Equal(t, immutable.V, got.V)
+	_, err = nodes[6].GetImmutable(ctx, ImmutableTarget([]byte("7:missing")))
+	assert.ErrorIs(t, err, ErrItemNotFound)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	salt := []byte("nightly")
+	mutable := &Item{V: []byte("i1e"), Salt: salt, Seq: 1}
+	mutable.Sign(priv)
+	assert.Nil(t, nodes[2].Put(ctx, mutable))
+
+	updated := &Item{V: []byte("i2e"), Salt: salt, Seq: 2}
+	updated.Sign(priv)
+	assert.Nil(t, nodes[3].CompareAndPut(ctx, updated, 1))
+	got, err = nodes[7].GetMutable(ctx, pub, salt)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), got.Seq)
+	assert.Equal(t, updated.V, got.V)
+
+	// a publisher that didn't see seq 2 is told so
+	concurrent := &Item{V: []byte("i3e"), Salt: salt, Seq: 3}
+	concurrent.Sign(priv)
+	err = nodes[5].CompareAndPut(ctx, concurrent, 1)
+	assert.Equal(t, &Error{ERROR_CAS_MISMATCH, "the CAS hash mismatched, re-read value and try again"}, err)
+	// and an older item is refused
+	err = nodes[4].Put(ctx, mutable)
+	assert.Equal(t, &Error{ERROR_SEQ_TOO_LOW, "sequence number less than current"}, err)
+	// the salt is part of the target
+	_, err = nodes[7].GetMutable(ctx, pub, nil)
+	assert.ErrorIs(t, err, ErrItemNotFound)
+}
@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/brkss/btorrent/src/bencode"
+)
+
+// MAX_KRPC_STRING is the longest string a message may hold, items are at
+// most MAX_ITEM_SIZE and node lists far shorter
+const MAX_KRPC_STRING = 4096
+
+// KRPC message types
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+)
+
+// queries of BEP 5
+const (
+	queryPing         = "ping"
+	queryFindNode     = "find_node"
+	queryGetPeers     = "get_peers"
+	queryAnnouncePeer = "announce_peer"
+	queryGet          = "get" // BEP 44
+	queryPut          = "put"
+)
+
+// values of want (BEP 32), the node tables a find_node or get_peers asks for
+const (
+	WANT_IPV4 = "n4"
+	WANT_IPV6 = "n6"
+)
+
+// KRPC error codes
+const (
+	ERROR_GENERIC  = 201
+	ERROR_SERVER   = 202
+	ERROR_PROTOCOL = 203
+	ERROR_METHOD   = 204
+	// BEP 44
+	ERROR_TOO_BIG       = 205 // v is longer than MAX_ITEM_SIZE
+	ERROR_BAD_SIGNATURE = 206
+	ERROR_SALT_TOO_BIG  = 207 // salt is longer than MAX_SALT_SIZE
+	ERROR_CAS_MISMATCH  = 301
+	ERROR_SEQ_TOO_LOW   = 302 // seq is less than the one of the stored item
+)
+
+// msg is a KRPC message, the fields of every query and response are merged
+// in args and reply, which is what the wire format does too
+type msg struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q,omitempty"`
+	A *args         `bencode:"a,omitempty"`
+	R *reply        `bencode:"r,omitempty"`
+	E []interface{} `bencode:"e,omitempty"`
+	// read only nodes (BEP 43) must not be added to routing tables
+	RO int `bencode:"ro,omitempty"`
+	// compact address the query came from, so nodes learn their external IP (BEP 42)
+	IP string `bencode:"ip,omitempty"`
+}
+
+type args struct {
+	ID          string   `bencode:"id"`
+	Target      string   `bencode:"target,omitempty"`
+	InfoHash    string   `bencode:"info_hash,omitempty"`
+	Port        int      `bencode:"port,omitempty"`
+	ImpliedPort int      `bencode:"implied_port,omitempty"`
+	Token       string   `bencode:"token,omitempty"`
+	Want        []string `bencode:"want,omitempty"`
+	// get and put of BEP 44, seq and cas are pointers because 0 is a value
+	V    bencode.RawMessage `bencode:"v,omitempty"`
+	K    string             `bencode:"k,omitempty"`
+	Sig  string             `bencode:"sig,omitempty"`
+	Salt string             `bencode:"salt,omitempty"`
+	Seq  *int64             `bencode:"seq,omitempty"`
+	CAS  *int64             `bencode:"cas,omitempty"`
+}
+
+type reply struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Nodes6 string   `bencode:"nodes6,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+	// item of a get reply (BEP 44)
+	V   bencode.RawMessage `bencode:"v,omitempty"`
+	K   string             `bencode:"k,omitempty"`
+	Sig string             `bencode:"sig,omitempty"`
+	Seq *int64             `bencode:"seq,omitempty"`
+}
+
+// Error is a KRPC error sent back by a node
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
+func errorMsg(t string, code int, message string) *msg {
+	return &msg{T: t, Y: typeError, E: []interface{}{code, message}}
+}
+
+// remoteError turns the e list of an error message into an Error
+func remoteError(e []interface{}) *Error {
+	err := &Error{Code: ERROR_GENERIC}
+	if len(e) > 0 {
+		if code, ok := e[0].(int64); ok {
+			err.Code = int(code)
+		}
+	}
+	if len(e) > 1 {
+		err.Message, _ = e[1].(string)
+	}
+	return err
+}
+
+func parseMsg(data []byte) (*msg, error) {
+	var m msg
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	d.MaxStringLength = MAX_KRPC_STRING
+	err := d.Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	if m.T == "" {
+		return nil, fmt.Errorf("message has no transaction id")
+	}
+	return &m, nil
+}
+
+// nodeID checks and converts a node id of the wire
+func nodeID(s string) (NodeID, error) {
+	var id NodeID
+	if len(s) != NODE_ID_LENGTH {
+		return id, fmt.Errorf("invalid node id length %d", len(s))
+	}
+	copy(id[:], s)
+	return id, nil
+}
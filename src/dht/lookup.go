@@ -0,0 +1,190 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"sort"
+
+	"github.com/brkss/btorrent/src/peer"
+)
+
+// lookupNode is a node met during a lookup
+type lookupNode struct {
+	node
+	queried  bool
+	answered bool
+	failed   bool
+	token    string // write token of a get_peers reply
+}
+
+// lookupAll runs the lookup of target on every family at once, it only
+// fails when all of them fail. onReply is called from both at once
+func (s *Server) lookupAll(ctx context.Context, target NodeID, q string, onReply func(*reply)) ([]*lookupNode, []peer.Peer, error) {
+	type result struct {
+		closest []*lookupNode
+		peers   []peer.Peer
+		err     error
+	}
+	families := s.families()
+	results := make(chan result, len(families))
+	for _, f := range families {
+		go func(f *family) {
+			closest, peers, err := s.lookup(ctx, f, target, q, onReply)
+			results <- result{closest, peers, err}
+		}(f)
+	}
+
+	var closest []*lookupNode
+	var peers []peer.Peer
+	var err error
+	seenPeers := make(map[string]bool)
+	failed := 0
+	for range families {
+		res := <-results
+		closest = append(closest, res.closest...)
+		for _, p := range res.peers {
+			if !seenPeers[p.String()] {
+				seenPeers[p.String()] = true
+				peers = append(peers, p)
+			}
+		}
+		if res.err != nil {
+			failed++
+			// the error of an empty table says less than any other
+			if err == nil || err == ErrNoNodes {
+				err = res.err
+			}
+		}
+	}
+	if failed < len(families) && ctx.Err() == nil {
+		err = nil
+	}
+	return closest, peers, err
+}
+
+// lookup walks towards target in the table of f, asking ALPHA nodes at a
+// time for nodes closer to it, until the K closest nodes it heard of all
+// answered or failed. It returns the nodes that answered, closest first, and
+// with get_peers the peers they gave along the way. onReply, when not nil,
+// sees every reply
+func (s *Server) lookup(ctx context.Context, f *family, target NodeID, q string, onReply func(*reply)) ([]*lookupNode, []peer.Peer, error) {
+	self := f.id()
+	known := make(map[string]*lookupNode)
+	var candidates []*lookupNode
+	add := func(n node) {
+		key := n.addr.String()
+		if n.id == self || known[key] != nil {
+			return
+		}
+		ln := &lookupNode{node: n}
+		known[key] = ln
+		candidates = append(candidates, ln)
+	}
+	for _, n := range f.table().closest(target, K) {
+		add(n)
+	}
+
+	seenPeers := make(map[string]bool)
+	var peers []peer.Peer
+	addPeers := func(found []peer.Peer) {
+		for _, p := range found {
+			if !seenPeers[p.String()] {
+				seenPeers[p.String()] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+	if q == queryGetPeers {
+		// peers announced to us count too, we may be one of the closest
+		// nodes, and so do the peers earlier lookups found
+		addPeers(s.peers.get(target, MAX_VALUES))
+		addPeers(s.found.get(target, MAX_VALUES))
+	}
+	if len(candidates) == 0 {
+		return nil, peers, ErrNoNodes
+	}
+
+	type result struct {
+		ln  *lookupNode
+		r   *reply
+		err error
+	}
+	results := make(chan result)
+	inFlight := 0
+	for {
+		sort.Slice(candidates, func(i, j int) bool { return closer(target, candidates[i].id, candidates[j].id) })
+		alive := 0
+		for _, ln := range candidates {
+			if alive == K || inFlight == ALPHA || ctx.Err() != nil {
+				break
+			}
+			if ln.failed {
+				continue
+			}
+			alive++
+			if ln.queried {
+				continue
+			}
+			ln.queried = true
+			inFlight++
+			go func(ln *lookupNode) {
+				a := &args{}
+				if q == queryGetPeers {
+					a.InfoHash = string(target[:])
+				} else {
+					a.Target = string(target[:])
+				}
+				r, err := s.query(ctx, ln.addr, q, a)
+				results <- result{ln, r, err}
+			}(ln)
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		res := <-results
+		inFlight--
+		if res.err != nil {
+			res.ln.failed = true
+			continue
+		}
+		res.ln.answered = true
+		res.ln.token = res.r.Token
+		if onReply != nil {
+			onReply(res.r)
+		}
+		nodes, _ := decodeNodes(res.r.Nodes)
+		if f.want == WANT_IPV6 {
+			nodes, _ = decodeNodes6(res.r.Nodes6)
+		}
+		for _, n := range nodes {
+			add(n)
+		}
+		for _, value := range res.r.Values {
+			found, err := peer.Unmarshal([]byte(value))
+			if len(value) == net.IPv6len+2 {
+				found, err = peer.Unmarshal6([]byte(value))
+			}
+			if err == nil {
+				addPeers(found)
+				for _, p := range found {
+					s.found.add(target, p)
+				}
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, peers, ctx.Err()
+	}
+
+	var closest []*lookupNode
+	for _, ln := range candidates {
+		if ln.answered {
+			closest = append(closest, ln)
+			if len(closest) == K {
+				break
+			}
+		}
+	}
+	return closest, peers, nil
+}
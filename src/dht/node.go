@@ -0,0 +1,151 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+	"time"
+)
+
+const (
+	NODE_ID_LENGTH       = 20
+	COMPACT_NODE_LENGTH  = NODE_ID_LENGTH + 6  // id, IPv4 address and port
+	COMPACT_NODE6_LENGTH = NODE_ID_LENGTH + 18 // id, IPv6 address and port
+	MAX_FAILURES         = 2                   // unanswered queries in a row before a node is dropped
+	GOOD_NODE_TIMEOUT    = time.Minute * 15    // a node we haven't heard from for this long is questionable
+)
+
+// NodeID identifies a node, infohashes live in the same 160 bit keyspace
+type NodeID [NODE_ID_LENGTH]byte
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// randomID returns a random node id
+func randomID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+// distance returns the XOR distance between a and b
+func distance(a, b NodeID) NodeID {
+	var d NodeID
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to target than b
+func closer(target, a, b NodeID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// commonPrefix returns the number of leading bits a and b share
+func commonPrefix(a, b NodeID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return NODE_ID_LENGTH * 8
+}
+
+// randomIDWithPrefix returns a random id sharing exactly prefix leading bits with id
+func randomIDWithPrefix(id NodeID, prefix int) NodeID {
+	r := randomID()
+	for i := 0; i < prefix; i++ {
+		mask := byte(0x80) >> (i % 8)
+		r[i/8] = r[i/8]&^mask | id[i/8]&mask
+	}
+	if prefix < NODE_ID_LENGTH*8 {
+		mask := byte(0x80) >> (prefix % 8)
+		r[prefix/8] = r[prefix/8]&^mask | ^id[prefix/8]&mask
+	}
+	return r
+}
+
+// node is a remote DHT node
+type node struct {
+	id       NodeID
+	addr     *net.UDPAddr
+	lastSeen time.Time // last time it answered us or queried us
+	failures int       // queries in a row it didn't answer
+}
+
+// good reports whether the node answered recently
+func (n *node) good() bool {
+	return n.failures == 0 && time.Since(n.lastSeen) < GOOD_NODE_TIMEOUT
+}
+
+// encodeNodes returns the compact node info of the IPv4 nodes of nodes (BEP 5)
+func encodeNodes(nodes []node) string {
+	return encodeCompactNodes(nodes, net.IPv4len)
+}
+
+// encodeNodes6 returns the compact node info of the IPv6 nodes of nodes (BEP 32)
+func encodeNodes6(nodes []node) string {
+	return encodeCompactNodes(nodes, net.IPv6len)
+}
+
+func encodeCompactNodes(nodes []node, ipLen int) string {
+	buf := make([]byte, 0, len(nodes)*(NODE_ID_LENGTH+ipLen+2))
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ipLen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = n.addr.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.addr.Port))
+	}
+	return string(buf)
+}
+
+// decodeNodes parses compact IPv4 node info, nodes with an unusable address are skipped
+func decodeNodes(data string) ([]node, error) {
+	return decodeCompactNodes(data, net.IPv4len)
+}
+
+// decodeNodes6 parses compact IPv6 node info, nodes with an unusable address are skipped
+func decodeNodes6(data string) ([]node, error) {
+	return decodeCompactNodes(data, net.IPv6len)
+}
+
+func decodeCompactNodes(data string, ipLen int) ([]node, error) {
+	size := NODE_ID_LENGTH + ipLen + 2
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("malformed compact nodes of length %d", len(data))
+	}
+	var nodes []node
+	for i := 0; i < len(data); i += size {
+		var n node
+		copy(n.id[:], data[i:i+NODE_ID_LENGTH])
+		ip := net.IP([]byte(data[i+NODE_ID_LENGTH : i+NODE_ID_LENGTH+ipLen]))
+		port := binary.BigEndian.Uint16([]byte(data[i+NODE_ID_LENGTH+ipLen : i+size]))
+		// an IPv4 mapped address has nothing to do in an IPv6 table
+		if port == 0 || ip.IsUnspecified() || ipLen == net.IPv6len && ip.To4() != nil {
+			continue
+		}
+		n.addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
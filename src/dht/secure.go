@@ -0,0 +1,88 @@
+package dht
+
+import (
+	"hash/crc32"
+	"net"
+	"sync"
+)
+
+// EXTERNAL_IP_VOTES is how many nodes must tell us our address before we
+// trust the answer most of them gave
+const EXTERNAL_IP_VOTES = 10
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+	v4Mask     = []byte{0x03, 0x0f, 0x3f, 0xff}
+	v6Mask     = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// secureHash is the crc32c of ip masked and mixed with r, the first 21 bits
+// of an id valid for ip (BEP 42)
+func secureHash(ip net.IP, r byte) uint32 {
+	mask := v6Mask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, v4Mask
+	}
+	masked := make([]byte, len(mask))
+	for i := range mask {
+		masked[i] = ip[i] & mask[i]
+	}
+	masked[0] |= r << 5
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// secureID returns a random id valid for ip, its last byte picks r
+func secureID(ip net.IP) NodeID {
+	id := randomID()
+	crc := secureHash(ip, id[NODE_ID_LENGTH-1]&0x07)
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	return id
+}
+
+// validID reports whether id was derived from ip, nodes on local addresses
+// may use any id
+func validID(id NodeID, ip net.IP) bool {
+	if localIP(ip) {
+		return true
+	}
+	crc := secureHash(ip, id[NODE_ID_LENGTH-1]&0x07)
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+func localIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// ipVotes collects the addresses nodes see us at, one vote per node IP
+type ipVotes struct {
+	mu    sync.Mutex
+	votes map[string]string
+}
+
+func newIPVotes() *ipVotes {
+	return &ipVotes{votes: make(map[string]string)}
+}
+
+// add records that voter sees us at ip. Once EXTERNAL_IP_VOTES nodes voted it
+// returns the address more than half of them saw, if any, and starts over
+func (v *ipVotes) add(voter net.IP, ip net.IP) (net.IP, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.votes[voter.String()] = ip.String()
+	if len(v.votes) < EXTERNAL_IP_VOTES {
+		return nil, false
+	}
+	counts := make(map[string]int)
+	for _, voted := range v.votes {
+		counts[voted]++
+	}
+	v.votes = make(map[string]string)
+	for voted, count := range counts {
+		if count*2 > EXTERNAL_IP_VOTES {
+			return net.ParseIP(voted), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,84 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/brkss/btorrent/src/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecureID(t *testing.T) {
+	// the examples of BEP 42, only the first 21 bits and the last byte are set
+	for _, tt := range []struct {
+		ip     string
+		r      byte
+		prefix []byte
+	}{
+		{"124.31.75.21", 1, []byte{0x5f, 0xbf, 0xbf}},
+		{"21.75.31.124", 86, []byte{0x5a, 0x3c, 0xe9}},
+		{"65.23.51.170", 22, []byte{0xa5, 0xd4, 0x32}},
+		{"84.124.73.14", 65, []byte{0x1b, 0x03, 0x21}},
+		{"43.213.53.83", 90, []byte{0xe5, 0x6f, 0x6c}},
+	} {
+		ip := net.ParseIP(tt.ip)
+		crc := secureHash(ip, tt.r&0x07)
+		assert.Equal(t, tt.prefix[0], byte(crc>>24), tt.ip)
+		assert.Equal(t, tt.prefix[1], byte(crc>>16), tt.ip)
+		assert.Equal(t, tt.prefix[2]&0xf8, byte(crc>>8)&0xf8, tt.ip)
+
+		id := NodeID{tt.prefix[0], tt.prefix[1], tt.prefix[2]}
+		id[NODE_ID_LENGTH-1] = tt.r
+		assert.True(t, validID(id, ip), tt.ip)
+		id[1] ^= 0x01
+		assert.False(t, validID(id, ip), tt.ip)
+	}
+
+	for _, ip := range []string{"1.2.3.4", "2001:db8::1"} {
+		assert.True(t, validID(secureID(net.ParseIP(ip)), net.ParseIP(ip)))
+	}
+	// any id goes on local addresses
+	assert.True(t, validID(randomID(), net.IPv4(192, 168, 1, 1)))
+	assert.True(t, validID(randomID(), net.IPv6loopback))
+}
+
+func TestEnforceSecureIDs(t *testing.T) {
+	s, err := New(Config{})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// a documentation address, nothing answers the replies sent there
+	public := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 4), Port: 6881}
+	m := &msg{T: "aa", Y: typeQuery, Q: queryPing, A: &args{}}
+	bad := randomID()
+	for validID(bad, public.IP) {
+		bad = randomID()
+	}
+	m.A.ID = string(bad[:])
+	s.handleQuery(s.v4, m, public)
+	assert.Equal(t, 0, s.Nodes())
+
+	good := secureID(public.IP)
+	m.A.ID = string(good[:])
+	s.handleQuery(s.v4, m, public)
+	assert.Equal(t, 1, s.Nodes())
+}
+
+func TestExternalIPVotes(t *testing.T) {
+	s, err := New(Config{NoIPv6: true})
+	assert.Nil(t, err)
+	defer s.Close()
+	external := net.IPv4(1, 2, 3, 4)
+	compact := compactPeer(peer.Peer{IP: external, Port: 6881})
+
+	// one node repeating itself is one vote
+	for i := 0; i < EXTERNAL_IP_VOTES; i++ {
+		s.v4.learnIP(&net.UDPAddr{IP: net.IPv4(5, 5, 5, 5), Port: 6881}, compact)
+	}
+	assert.False(t, validID(s.ID(), external))
+
+	for i := 0; i < EXTERNAL_IP_VOTES; i++ {
+		s.v4.learnIP(&net.UDPAddr{IP: net.IPv4(5, 5, 5, byte(i+10)), Port: 6881}, compact)
+	}
+	assert.True(t, validID(s.ID(), external))
+}
@@ -0,0 +1,172 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/peer"
+)
+
+const (
+	STATE_SAVE_INTERVAL = time.Minute * 10 // how often the state file is written while running
+	NODE_STATE_TTL      = time.Hour * 24   // saved nodes not seen for this long aren't loaded back
+	FOUND_PEER_TTL      = time.Hour * 2    // peers our lookups found are remembered this long
+)
+
+// bencodeState is what the state file holds, times are unix seconds
+type bencodeState struct {
+	ID    string       `bencode:"id"`
+	ID6   string       `bencode:"id6,omitempty"`
+	Nodes []stateNode  `bencode:"nodes"` // of both families
+	Peers []statePeers `bencode:"peers"` // announced to us
+	Found []statePeers `bencode:"found"` // found by our lookups
+}
+
+type stateNode struct {
+	ID       string `bencode:"id"`
+	Addr     string `bencode:"addr"`
+	LastSeen int64  `bencode:"last_seen"`
+}
+
+type statePeers struct {
+	InfoHash string      `bencode:"info_hash"`
+	Peers    []statePeer `bencode:"peers"`
+}
+
+type statePeer struct {
+	Addr  string `bencode:"addr"`
+	Added int64  `bencode:"added"`
+}
+
+// loadState reads the state file at path, a missing file is an empty state
+func loadState(path string) (*bencodeState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &bencodeState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// we always write it canonical, anything else was damaged
+	st := &bencodeState{}
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	d.Strict = true
+	err = d.Decode(st)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// restore puts the saved nodes and peers back, entries too old are left out
+func (s *Server) restore(st *bencodeState) {
+	for _, sn := range st.Nodes {
+		id, err := nodeID(sn.ID)
+		if err != nil || time.Since(time.Unix(sn.LastSeen, 0)) >= NODE_STATE_TTL {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", sn.Addr)
+		if err != nil {
+			continue
+		}
+		f := s.familyOf(addr.IP)
+		if f == nil || !validID(id, addr.IP) {
+			continue
+		}
+		f.table().restore(node{id: id, addr: addr, lastSeen: time.Unix(sn.LastSeen, 0)})
+	}
+	restorePeers(s.peers, st.Peers)
+	restorePeers(s.found, st.Found)
+}
+
+func restorePeers(store *peerStore, saved []statePeers) {
+	for _, sp := range saved {
+		infoHash, err := nodeID(sp.InfoHash)
+		if err != nil {
+			continue
+		}
+		for _, p := range sp.Peers {
+			host, port, err := net.SplitHostPort(p.Addr)
+			if err != nil {
+				continue
+			}
+			ip := net.ParseIP(host)
+			n, err := strconv.ParseUint(port, 10, 16)
+			if ip == nil || err != nil {
+				continue
+			}
+			store.addAt(infoHash, peer.Peer{IP: ip, Port: uint16(n)}, time.Unix(p.Added, 0))
+		}
+	}
+}
+
+func snapshotPeers(store *peerStore) []statePeers {
+	byHash := make(map[[20]byte]*statePeers)
+	var saved []statePeers
+	store.each(func(infoHash [20]byte, p peer.Peer, added time.Time) {
+		sp, ok := byHash[infoHash]
+		if !ok {
+			sp = &statePeers{InfoHash: string(infoHash[:])}
+			byHash[infoHash] = sp
+		}
+		sp.Peers = append(sp.Peers, statePeer{Addr: p.String(), Added: added.Unix()})
+	})
+	for _, sp := range byHash {
+		saved = append(saved, *sp)
+	}
+	return saved
+}
+
+// saveState writes our ids, the nodes of the routing tables and the peers we
+// know to the state file, through a temporary file so a crash never leaves
+// half of it
+func (s *Server) saveState() error {
+	if s.stateFile == "" {
+		return nil
+	}
+	id := s.v4.id()
+	st := bencodeState{ID: string(id[:])}
+	if s.v6 != nil {
+		id6 := s.v6.id()
+		st.ID6 = string(id6[:])
+	}
+	for _, f := range s.families() {
+		for _, n := range f.table().all() {
+			if n.failures > 0 {
+				continue
+			}
+			st.Nodes = append(st.Nodes, stateNode{ID: string(n.id[:]), Addr: n.addr.String(), LastSeen: n.lastSeen.Unix()})
+		}
+	}
+	st.Peers = snapshotPeers(s.peers)
+	st.Found = snapshotPeers(s.found)
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, st)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.stateFile), filepath.Base(s.stateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.stateFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateRestart(t *testing.T) {
+	nodes := network(t, 4)
+	path := filepath.Join(t.TempDir(), "dht.state")
+	bootstrap := []string{fmt.Sprintf("127.0.0.1:%d", nodes[0].Port())}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	s, err := New(Config{Bootstrap: bootstrap, StateFile: path})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Bootstrap(ctx))
+	infoHash := [20]byte{4, 5, 6}
+	s.found.add(infoHash, peer.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	s.peers.add(infoHash, peer.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881})
+	known := s.Nodes()
+	assert.Nil(t, s.Close())
+
+	// no bootstrap node this time, the saved ones are enough
+	restarted, err := New(Config{StateFile: path})
+	assert.Nil(t, err)
+	defer restarted.Close()
+	assert.Equal(t, s.ID(), restarted.ID())
+	assert.Equal(t, known, restarted.Nodes())
+	assert.Nil(t, restarted.Bootstrap(ctx))
+	assert.Len(t, restarted.found.get(infoHash, MAX_VALUES), 1)
+	assert.Len(t, restarted.peers.get(infoHash, MAX_VALUES), 1)
+}
+
+func TestStateAgesOut(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.state")
+	now, old := time.Now().Unix(), time.Now().Add(-NODE_STATE_TTL).Unix()
+	infoHash := string(make([]byte, 20))
+	fresh, stale := NodeID{1}, NodeID{2}
+	st := bencodeState{
+		ID: string(make([]byte, 19)), // not an id, a new one is picked
+		Nodes: []stateNode{
+			{ID: string(fresh[:]), Addr: "10.0.0.1:6881", LastSeen: now},
+			{ID: string(stale[:]), Addr: "10.0.0.2:6881", LastSeen: old},
+		},
+		Peers: []statePeers{{InfoHash: infoHash, Peers: []statePeer{
+			{Addr: "10.0.0.3:6881", Added: now},
+			{Addr: "10.0.0.4:6881", Added: time.Now().Add(-PEER_TTL).Unix()},
+		}}},
+		Found: []statePeers{{InfoHash: infoHash, Peers: []statePeer{
+			{Addr: "10.0.0.5:6881", Added: time.Now().Add(-FOUND_PEER_TTL).Unix()},
+		}}},
+	}
+	data, err := bencode.EncodeBytes(st)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+
+	s, err := New(Config{StateFile: path})
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.NotEqual(t, NodeID{}, s.ID())
+	assert.Equal(t, 1, s.Nodes())
+	peers := s.peers.get([20]byte{}, MAX_VALUES)
+	assert.Len(t, peers, 1)
+	assert.Equal(t, "10.0.0.3:6881", peers[0].String())
+	assert.Empty(t, s.found.get([20]byte{}, MAX_VALUES))
+}
@@ -0,0 +1,154 @@
+package dht
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/brkss/btorrent/src/peer"
+)
+
+const (
+	TOKEN_ROTATION     = time.Minute * 5  // a token stays valid between one and two rotations
+	PEER_TTL           = time.Minute * 30 // announced peers are forgotten unless they announce again
+	MAX_VALUES         = 50               // peers returned by one get_peers, keeps replies in one packet
+	MAX_STORED_PEERS   = 1000             // peers kept per infohash
+	MAX_STORED_HASHES  = 10000            // infohashes we keep peers for
+	TOKEN_LENGTH       = 8
+	TOKEN_SECRET_BYTES = 16
+)
+
+// tokens hands out the write tokens of get_peers replies, a token is only
+// valid for the IP it was given to so nodes can't announce others
+type tokens struct {
+	mu      sync.Mutex
+	secrets [2][TOKEN_SECRET_BYTES]byte // current and previous
+	rotated time.Time
+}
+
+func newTokens() *tokens {
+	t := &tokens{rotated: time.Now()}
+	cryptorand.Read(t.secrets[0][:])
+	cryptorand.Read(t.secrets[1][:])
+	return t
+}
+
+func (t *tokens) rotate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.rotated) < TOKEN_ROTATION {
+		return
+	}
+	t.secrets[1] = t.secrets[0]
+	cryptorand.Read(t.secrets[0][:])
+	t.rotated = time.Now()
+}
+
+func tokenFor(secret [TOKEN_SECRET_BYTES]byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip)
+	return string(h.Sum(nil)[:TOKEN_LENGTH])
+}
+
+// token returns the token to give to ip
+func (t *tokens) token(ip net.IP) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return tokenFor(t.secrets[0], ip)
+}
+
+// valid reports whether token was given to ip recently
+func (t *tokens) valid(token string, ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return token == tokenFor(t.secrets[0], ip) || token == tokenFor(t.secrets[1], ip)
+}
+
+// peerStore keeps peers per infohash for ttl
+type peerStore struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	peers map[[20]byte]map[string]storedPeer
+}
+
+type storedPeer struct {
+	peer  peer.Peer
+	added time.Time
+}
+
+func newPeerStore(ttl time.Duration) *peerStore {
+	return &peerStore{ttl: ttl, peers: make(map[[20]byte]map[string]storedPeer)}
+}
+
+func (s *peerStore) add(infoHash [20]byte, p peer.Peer) {
+	s.addAt(infoHash, p, time.Now())
+}
+
+// addAt adds a peer seen at added, peers too old already are ignored
+func (s *peerStore) addAt(infoHash [20]byte, p peer.Peer, added time.Time) {
+	if time.Since(added) >= s.ttl {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers, ok := s.peers[infoHash]
+	if !ok {
+		if len(s.peers) >= MAX_STORED_HASHES {
+			return
+		}
+		peers = make(map[string]storedPeer)
+		s.peers[infoHash] = peers
+	}
+	if _, known := peers[p.String()]; !known && len(peers) >= MAX_STORED_PEERS {
+		return
+	}
+	peers[p.String()] = storedPeer{p, added}
+}
+
+// get returns up to n random peers of infoHash
+func (s *peerStore) get(infoHash [20]byte, n int) []peer.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var peers []peer.Peer
+	for _, sp := range s.peers[infoHash] {
+		if time.Since(sp.added) < s.ttl {
+			peers = append(peers, sp.peer)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// expire forgets peers that didn't announce again in time
+func (s *peerStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for infoHash, peers := range s.peers {
+		for key, sp := range peers {
+			if time.Since(sp.added) >= s.ttl {
+				delete(peers, key)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
+
+// each calls fn with every peer of the store
+func (s *peerStore) each(fn func(infoHash [20]byte, p peer.Peer, added time.Time)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for infoHash, peers := range s.peers {
+		for _, sp := range peers {
+			fn(infoHash, sp.peer, sp.added)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	K              = 8                // nodes per bucket, and nodes returned by find_node
+	BUCKET_REFRESH = time.Minute * 15 // a bucket nothing happened in for this long is refreshed
+)
+
+type bucket struct {
+	nodes   []*node // least recently seen first
+	changed time.Time
+}
+
+// table is the Kademlia routing table: bucket i holds the nodes sharing
+// exactly i leading bits with our id, so we know many nodes close to us and
+// a few far away
+type table struct {
+	mu      sync.Mutex
+	self    NodeID
+	buckets [NODE_ID_LENGTH*8 + 1]bucket
+}
+
+func newTable(self NodeID) *table {
+	t := &table{self: self}
+	now := time.Now()
+	for i := range t.buckets {
+		t.buckets[i].changed = now
+	}
+	return t
+}
+
+func (t *table) bucket(id NodeID) *bucket {
+	return &t.buckets[commonPrefix(t.self, id)]
+}
+
+// seen records that id answered from addr, a new node takes the place of a
+// failing one when its bucket is full and is ignored when every node of the
+// bucket is fine. A known id coming from another address is ignored too
+func (t *table) seen(id NodeID, addr *net.UDPAddr) {
+	if id == t.self {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucket(id)
+	now := time.Now()
+	for i, n := range b.nodes {
+		if n.id != id {
+			continue
+		}
+		if !n.addr.IP.Equal(addr.IP) || n.addr.Port != addr.Port {
+			return
+		}
+		n.lastSeen = now
+		n.failures = 0
+		b.nodes = append(append(b.nodes[:i:i], b.nodes[i+1:]...), n)
+		b.changed = now
+		return
+	}
+
+	fresh := &node{id: id, addr: addr, lastSeen: now}
+	if len(b.nodes) < K {
+		b.nodes = append(b.nodes, fresh)
+		b.changed = now
+		return
+	}
+	for i, n := range b.nodes {
+		if !n.good() {
+			b.nodes = append(append(b.nodes[:i:i], b.nodes[i+1:]...), fresh)
+			b.changed = now
+			return
+		}
+	}
+}
+
+// restore puts back a node saved by a previous run, as long as its bucket has room
+func (t *table) restore(n node) {
+	if n.id == t.self {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(n.id)
+	if len(b.nodes) >= K {
+		return
+	}
+	for _, known := range b.nodes {
+		if known.id == n.id {
+			return
+		}
+	}
+	b.nodes = append([]*node{&n}, b.nodes...)
+}
+
+// failed records that the node at addr didn't answer, it is dropped after MAX_FAILURES
+func (t *table) failed(addr *net.UDPAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		for j, n := range b.nodes {
+			if n.addr.IP.Equal(addr.IP) && n.addr.Port == addr.Port {
+				n.failures++
+				if n.failures >= MAX_FAILURES {
+					b.nodes = append(b.nodes[:j:j], b.nodes[j+1:]...)
+				}
+				return
+			}
+		}
+	}
+}
+
+// closest returns the n known nodes closest to target
+func (t *table) closest(target NodeID, n int) []node {
+	nodes := t.all()
+	sort.Slice(nodes, func(i, j int) bool { return closer(target, nodes[i].id, nodes[j].id) })
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// all returns a copy of every node in the table
+func (t *table) all() []node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var nodes []node
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			nodes = append(nodes, *n)
+		}
+	}
+	return nodes
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count := 0
+	for i := range t.buckets {
+		count += len(t.buckets[i].nodes)
+	}
+	return count
+}
+
+// answered returns the number of nodes that answered since t
+func (t *table) answered(since time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count := 0
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if !n.lastSeen.Before(since) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// stale returns random targets falling in the buckets that need a refresh,
+// buckets deeper than the deepest non empty one are empty by nature and skipped
+func (t *table) stale() []NodeID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	deepest := 0
+	for i := range t.buckets {
+		if len(t.buckets[i].nodes) > 0 {
+			deepest = i
+		}
+	}
+	var targets []NodeID
+	for i := 0; i <= deepest && i < NODE_ID_LENGTH*8; i++ {
+		if time.Since(t.buckets[i].changed) > BUCKET_REFRESH {
+			targets = append(targets, randomIDWithPrefix(t.self, i))
+			t.buckets[i].changed = time.Now()
+		}
+	}
+	return targets
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/brkss/btorrent/src/btorrent"
+	"github.com/brkss/btorrent/src/dht"
+	"github.com/brkss/btorrent/src/magnet"
+	"github.com/brkss/btorrent/src/ratelimit"
+	"github.com/brkss/btorrent/src/torrentfile"
+	"github.com/brkss/btorrent/src/upload"
+)
+
+// DAEMON_POLL_INTERVAL is how often the daemon looks for new torrents
+const DAEMON_POLL_INTERVAL = time.Second * 5
+
+// transferFlags are the flags of the commands that talk to peers
+type transferFlags struct {
+	port           *uint
+	maxPeers       *int
+	maxConnections *int
+	downloadRate   *int64
+	uploadRate     *int64
+	dht            *bool
+	dhtState       *string
+	bootstrap      listFlag
+}
+
+func addTransferFlags(flags *flag.FlagSet) *transferFlags {
+	f := &transferFlags{
+		port:           flags.Uint("port", uint(torrentfile.PORT), "port to listen on and announce, TCP for peers and UDP for the DHT"),
+		maxPeers:       flags.Int("max-peers", 0, "peers to download from at once (default no limit)"),
+		maxConnections: flags.Int("max-connections", upload.MAX_CONNECTIONS, "incoming peers at once"),
+		downloadRate:   flags.Int64("download-rate", 0, "download limit in KiB/s (default no limit)"),
+		uploadRate:     flags.Int64("upload-rate", 0, "upload limit in KiB/s (default no limit)"),
+		dht:            flags.Bool("dht", true, "find peers of public torrents on the DHT"),
+		dhtState:       flags.String("dht-state", defaultDHTState(), "file keeping the DHT node id and known nodes between runs, empty to keep nothing"),
+	}
+	flags.Var(&f.bootstrap, "dht-bootstrap", "host:port of a node to join the DHT through (repeatable, default well known routers)")
+	return f
+}
+
+func (f *transferFlags) bootstrapNodes() []string {
+	return bootstrapNodes(f.bootstrap)
+}
+
+// bootstrapNodes returns the nodes of -dht-bootstrap, the well known ones
+// when none was given
+func bootstrapNodes(bootstrap listFlag) []string {
+	if len(bootstrap) == 0 {
+		return dht.DEFAULT_BOOTSTRAP
+	}
+	return bootstrap
+}
+
+// defaultDHTState is the state file in the user cache directory, none when
+// there is no such directory
+func defaultDHTState() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "btorrent", "dht.state")
+}
+
+func (f *transferFlags) stateFile() string {
+	return stateFile(*f.dhtState)
+}
+
+// stateFile returns the DHT state file of -dht-state, its directory is
+// created when missing
+func stateFile(path string) string {
+	if path == "" {
+		return ""
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		log.Printf("dht state not kept: %s\n", err)
+		return ""
+	}
+	return path
+}
+
+// startDHT starts the DHT node of settings when the flags ask for one, a
+// node that can't listen is only worth a warning
+func (f *transferFlags) startDHT(settings *torrentfile.Settings) {
+	if !*f.dht {
+		return
+	}
+	d, err := dht.New(dht.Config{Port: settings.Port, Bootstrap: f.bootstrapNodes(), StateFile: f.stateFile()})
+	if err != nil {
+		log.Printf("could not start the dht, using trackers only: %s\n", err)
+		return
+	}
+	settings.DHT = d
+}
+
+func (f *transferFlags) settings() (torrentfile.Settings, error) {
+	if *f.port == 0 || *f.port > 65535 {
+		return torrentfile.Settings{}, fmt.Errorf("%w: invalid port %d", errUsage, *f.port)
+	}
+	return torrentfile.Settings{
+		Port:            uint16(*f.port),
+		MaxPeers:        *f.maxPeers,
+		MaxConnections:  *f.maxConnections,
+		DownloadLimiter: ratelimit.New(*f.downloadRate * 1024),
+		UploadLimiter:   ratelimit.New(*f.uploadRate * 1024),
+	}, nil
+}
+
+// options are the client options matching the flags
+func (f *transferFlags) options() ([]btorrent.Option, error) {
+	settings, err := f.settings()
+	if err != nil {
+		return nil, err
+	}
+	opts := []btorrent.Option{
+		btorrent.WithPort(settings.Port),
+		btorrent.WithMaxPeers(settings.MaxPeers),
+		btorrent.WithMaxConnections(settings.MaxConnections),
+		btorrent.WithDownloadRate(settings.DownloadLimiter.Rate()),
+		btorrent.WithUploadRate(settings.UploadLimiter.Rate()),
+	}
+	if *f.dht {
+		opts = append(opts, btorrent.WithDHT(f.bootstrapNodes()...), btorrent.WithDHTState(f.stateFile()))
+	}
+	return opts, nil
+}
+
+// interruptContext returns a context done on Ctrl-C or SIGTERM, so transfers
+// save their progress before exiting
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// download fetches a torrent or magnet link, into path when given or into
+// the output directory otherwise:
+// btorrent download [flags] <torrent|magnet> [path]
+func download(args []string) error {
+	flags := newFlagSet("download", "<torrent|magnet> [path]")
+	output := flags.String("o", ".", "directory to download into")
+	watch := flags.Bool("watch", false, "follow an updatable torrent link (magnet:?xs=urn:btpk:...), switching to every new torrent it points to and seeding meanwhile")
+	watchInterval := flags.Duration("watch-interval", btorrent.WATCH_INTERVAL, "how often -watch looks for a new torrent")
+	transfer := addTransferFlags(flags)
+	err := parseFlags(flags, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	if *watch {
+		if flags.NArg() > 1 {
+			return fmt.Errorf("%w: -watch downloads into the output directory, not a path", errUsage)
+		}
+		return watchTorrent(flags.Arg(0), *output, *watchInterval, transfer)
+	}
+	settings, err := transfer.settings()
+	if err != nil {
+		return err
+	}
+	transfer.startDHT(&settings)
+	if settings.DHT != nil {
+		defer settings.DHT.Close()
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	tf, err := openTorrentWith(ctx, flags.Arg(0), settings)
+	if err != nil {
+		return err
+	}
+	path := flags.Arg(1)
+	if path == "" {
+		path = tf.DataPath(*output)
+	}
+
+	err = tf.DownloadWith(ctx, path, settings)
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", tf.Name, err)
+	}
+	return nil
+}
+
+// watchTorrent downloads then seeds the torrent an updatable torrent link
+// points to, and the next one each time it changes, until interrupted
+func watchTorrent(link, output string, interval time.Duration, transfer *transferFlags) error {
+	m, err := magnet.Parse(link)
+	if err != nil || !m.Mutable() {
+		return fmt.Errorf("%w: -watch needs a magnet:?xs=urn:btpk: link", errUsage)
+	}
+	if !*transfer.dht {
+		return fmt.Errorf("%w: -watch needs the dht", errUsage)
+	}
+	opts, err := transfer.options()
+	if err != nil {
+		return err
+	}
+	client, err := btorrent.NewClient(append(opts, btorrent.WithOutputDir(output), btorrent.WithWatchInterval(interval))...)
+	if err != nil {
+		return fmt.Errorf("listening on port %d: %w", *transfer.port, err)
+	}
+	defer client.Close()
+	ctx, stop := interruptContext()
+	defer stop()
+	err = client.Watch(ctx, link)
+	if err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+// seed shares data that is already on disk until interrupted:
+// btorrent seed [flags] <torrent> [path]
+func seed(args []string) error {
+	flags := newFlagSet("seed", "<torrent> [path]")
+	output := flags.String("o", ".", "directory the data was downloaded into")
+	transfer := addTransferFlags(flags)
+	err := parseFlags(flags, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	settings, err := transfer.settings()
+	if err != nil {
+		return err
+	}
+	tf, err := openTorrent(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	path := flags.Arg(1)
+	if path == "" {
+		path = tf.DataPath(*output)
+	}
+	transfer.startDHT(&settings)
+	if settings.DHT != nil {
+		defer settings.DHT.Close()
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	err = tf.SeedWith(ctx, path, settings)
+	if err != nil && err != context.Canceled {
+		return fmt.Errorf("seeding %s: %w", tf.Name, err)
+	}
+	return nil
+}
+
+// daemon downloads then seeds every .torrent that shows up in a directory,
+// all of them share one client so one listening port and the rate limits:
+// btorrent daemon [flags] <watch-dir>
+func daemon(args []string) error {
+	flags := newFlagSet("daemon", "<watch-dir>")
+	output := flags.String("o", ".", "directory to download into")
+	transfer := addTransferFlags(flags)
+	err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	opts, err := transfer.options()
+	if err != nil {
+		return err
+	}
+	watchDir := flags.Arg(0)
+	_, err = os.Stat(watchDir)
+	if err != nil {
+		return err
+	}
+
+	client, err := btorrent.NewClient(append(opts, btorrent.WithOutputDir(*output))...)
+	if err != nil {
+		return fmt.Errorf("listening on port %d: %w", *transfer.port, err)
+	}
+	defer client.Close()
+	ctx, stop := interruptContext()
+	defer stop()
+
+	// a torrent that can't be opened is retried once it is modified, it may
+	// have been picked up while still being written. One whose download or
+	// seed failed is retried at the next poll
+	seen := make(map[string]time.Time)
+	var seenMu sync.Mutex
+	var running sync.WaitGroup
+	defer running.Wait()
+	for {
+		paths, err := filepath.Glob(filepath.Join(watchDir, "*.torrent"))
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			stat, err := os.Stat(p)
+			if err != nil {
+				continue
+			}
+			seenMu.Lock()
+			modTime, ok := seen[p]
+			seenMu.Unlock()
+			if ok && (modTime.IsZero() || modTime.Equal(stat.ModTime())) {
+				continue
+			}
+			s, err := client.Open(ctx, p)
+			seenMu.Lock()
+			if err != nil {
+				log.Printf("skipping %s: %s\n", p, err)
+				seen[p] = stat.ModTime()
+				seenMu.Unlock()
+				continue
+			}
+			seen[p] = time.Time{}
+			seenMu.Unlock()
+			running.Add(1)
+			go func(p string) {
+				defer running.Done()
+				err := daemonSession(ctx, s)
+				if err != nil && ctx.Err() == nil {
+					seenMu.Lock()
+					delete(seen, p)
+					seenMu.Unlock()
+				}
+			}(p)
+		}
+		select {
+		case <-time.After(DAEMON_POLL_INTERVAL):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// daemonSession downloads then seeds s until ctx is done, the error of the
+// step that failed is returned
+func daemonSession(ctx context.Context, s *btorrent.Session) error {
+	name := s.Torrent().Name
+	log.Printf("downloading %s into %s\n", name, s.Path())
+	err := s.Download(ctx)
+	if err != nil {
+		if err != context.Canceled {
+			log.Printf("downloading %s failed: %s\n", name, err)
+		}
+		return err
+	}
+	log.Printf("%s is complete, seeding\n", name)
+	err = s.Seed(ctx)
+	if err != nil && err != context.Canceled {
+		log.Printf("seeding %s failed: %s\n", name, err)
+	}
+	return err
+}
@@ -8,17 +8,25 @@ import (
 // Handshake is a spcial message that peer uses to identifie itself
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
-// New create a new hanshake with pstr standard
+// New create a new hanshake with pstr standard, advertising extension protocol support
 func New(infoHash, peerID [20]byte) *Handshake {
-	return &Handshake{
+	h := &Handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.Reserved[5] |= 0x10 // bit 20 from the right, BEP 10
+	return h
+}
+
+// SupportsExtensions reports whether the peer set the extension protocol bit (BEP 10)
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&0x10 != 0
 }
 
 // Serialize  serializes the handshake to a buffer into this form
@@ -28,7 +36,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -52,12 +60,15 @@ func Read(r io.Reader) (*Handshake, error) {
 	if err != nil {
 		return nil, err
 	}
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
+	copy(reserved[:], handshakeBuff[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuff[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuff[pstrlen+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuff[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
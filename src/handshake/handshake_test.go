@@ -0,0 +1,27 @@
+package handshake
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSerializeRead(t *testing.T) {
+	h := New([20]byte{1, 2, 3}, [20]byte{4, 5, 6})
+	buf := h.Serialize()
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0x10, 0, 0}, buf[20:28])
+
+	got, err := Read(bytes.NewReader(buf))
+	assert.Nil(t, err)
+	assert.Equal(t, h, got)
+	assert.True(t, got.SupportsExtensions())
+}
+
+func TestReadKeepsReservedBits(t *testing.T) {
+	h := &Handshake{Pstr: "BitTorrent protocol", Reserved: [8]byte{0, 0, 0, 0, 0, 0, 0, 0x05}}
+	got, err := Read(bytes.NewReader(h.Serialize()))
+	assert.Nil(t, err)
+	assert.Equal(t, h.Reserved, got.Reserved)
+	assert.False(t, got.SupportsExtensions())
+}
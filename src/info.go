@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/brkss/btorrent/src/torrentfile"
+)
+
+// torrentInfo is what `btorrent info --json` prints
+type torrentInfo struct {
+	Name         string     `json:"name"`
+	InfoHash     string     `json:"info_hash,omitempty"`
+	InfoHashV2   string     `json:"info_hash_v2,omitempty"`
+	MetaVersion  int        `json:"meta_version"`
+	Size         int        `json:"size"`
+	PieceLength  int        `json:"piece_length"`
+	Pieces       int        `json:"pieces"`
+	Private      bool       `json:"private"`
+	Source       string     `json:"source,omitempty"`
+	Comment      string     `json:"comment,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	Trackers     [][]string `json:"trackers"`
+	WebSeeds     []string   `json:"web_seeds"`
+	Files        []infoFile `json:"files"`
+}
+
+type infoFile struct {
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+}
+
+func newTorrentInfo(tf *torrentfile.TorrentFile) torrentInfo {
+	ti := torrentInfo{
+		Name:        tf.Name,
+		MetaVersion: tf.MetaVersion,
+		PieceLength: tf.PieceLength,
+		Pieces:      len(tf.PieceHashes),
+		Private:     tf.Private,
+		Source:      tf.Source,
+		Comment:     tf.Comment,
+		CreatedBy:   tf.CreatedBy,
+		Trackers:    tf.AnnounceList,
+		WebSeeds:    append(append([]string{}, tf.URLList...), tf.HTTPSeeds...),
+		Files:       []infoFile{},
+	}
+	if len(tf.PieceHashes) > 0 {
+		ti.InfoHash = hex.EncodeToString(tf.InfoHash[:])
+	}
+	if tf.MetaVersion == 2 {
+		ti.InfoHashV2 = hex.EncodeToString(tf.InfoHashV2[:])
+	}
+	if ti.Pieces == 0 && tf.PieceLength > 0 {
+		// v2 only: pieces never span files
+		for _, f := range tf.Files {
+			ti.Pieces += (f.Length + tf.PieceLength - 1) / tf.PieceLength
+		}
+		if len(tf.Files) == 0 {
+			ti.Pieces = (tf.Length + tf.PieceLength - 1) / tf.PieceLength
+		}
+	}
+	if !tf.CreationDate.IsZero() {
+		date := tf.CreationDate.UTC()
+		ti.CreationDate = &date
+	}
+	if len(ti.Trackers) == 0 && tf.Announce != "" {
+		ti.Trackers = [][]string{{tf.Announce}}
+	}
+	if ti.Trackers == nil {
+		ti.Trackers = [][]string{}
+	}
+	if len(tf.Files) == 0 {
+		ti.Files = append(ti.Files, infoFile{Path: tf.Name, Length: tf.Length})
+	}
+	for _, f := range tf.Files {
+		if !f.Pad {
+			ti.Files = append(ti.Files, infoFile{Path: path.Join(f.Path...), Length: f.Length})
+		}
+	}
+	// pad files of hybrid torrents take no room on disk
+	ti.Size = 0
+	for _, f := range ti.Files {
+		ti.Size += f.Length
+	}
+	return ti
+}
+
+// info prints what a torrent holds:
+// btorrent info [--json] <torrent>
+func info(args []string) error {
+	flags := newFlagSet("info", "<torrent>")
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+	err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	tf, err := openTorrent(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	ti := newTorrentInfo(&tf)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ti)
+	}
+
+	fmt.Printf("Name:          %s\n", ti.Name)
+	if ti.InfoHash != "" {
+		fmt.Printf("Info hash:     %s\n", ti.InfoHash)
+	}
+	if ti.InfoHashV2 != "" {
+		fmt.Printf("Info hash v2:  %s\n", ti.InfoHashV2)
+	}
+	fmt.Printf("Size:          %s (%d bytes)\n", humanSize(int64(ti.Size)), ti.Size)
+	fmt.Printf("Pieces:        %d x %s\n", ti.Pieces, humanSize(int64(ti.PieceLength)))
+	flagsLine := []string{fmt.Sprintf("v%d", ti.MetaVersion)}
+	if tf.MetaVersion == 2 && len(tf.PieceHashes) > 0 {
+		flagsLine[0] = "hybrid"
+	}
+	if ti.Private {
+		flagsLine = append(flagsLine, "private")
+	}
+	fmt.Printf("Flags:         %s\n", strings.Join(flagsLine, ", "))
+	if ti.Source != "" {
+		fmt.Printf("Source:        %s\n", ti.Source)
+	}
+	if ti.CreatedBy != "" {
+		fmt.Printf("Created by:    %s\n", ti.CreatedBy)
+	}
+	if ti.CreationDate != nil {
+		fmt.Printf("Creation date: %s\n", ti.CreationDate.Format(time.RFC3339))
+	}
+	if ti.Comment != "" {
+		fmt.Printf("Comment:       %s\n", ti.Comment)
+	}
+	if len(ti.Trackers) > 0 {
+		fmt.Println("Trackers:")
+		for i, tier := range ti.Trackers {
+			fmt.Printf("  tier %d: %s\n", i+1, strings.Join(tier, ", "))
+		}
+	}
+	if len(ti.WebSeeds) > 0 {
+		fmt.Println("Web seeds:")
+		for _, seed := range ti.WebSeeds {
+			fmt.Printf("  %s\n", seed)
+		}
+	}
+	fmt.Println("Files:")
+	printTree(ti.Files, len(tf.Files) > 0, tf.Name)
+	return nil
+}
+
+// printTree prints the files indented under their directories
+func printTree(files []infoFile, multi bool, name string) {
+	indent := "  "
+	if multi {
+		fmt.Printf("  %s/\n", name)
+		indent = "    "
+	}
+	var shown []string // directories of the previous file
+	for _, f := range files {
+		elems := strings.Split(f.Path, "/")
+		dirs := elems[:len(elems)-1]
+		common := 0
+		for common < len(dirs) && common < len(shown) && dirs[common] == shown[common] {
+			common++
+		}
+		for i := common; i < len(dirs); i++ {
+			fmt.Printf("%s%s%s/\n", indent, strings.Repeat("  ", i), dirs[i])
+		}
+		fmt.Printf("%s%s%s (%s)\n", indent, strings.Repeat("  ", len(dirs)), elems[len(elems)-1], humanSize(int64(f.Length)))
+		shown = dirs
+	}
+}
+
+// humanSize formats a number of bytes with a binary unit
+func humanSize(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brkss/btorrent/src/magnet"
+	"github.com/brkss/btorrent/src/torrentfile"
+)
+
+// magnetLink prints the magnet link of a torrent, with its trackers:
+// btorrent magnet [flags] <torrent>
+func magnetLink(args []string) error {
+	flags := newFlagSet("magnet", "<torrent>")
+	err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	tf, err := openTorrent(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(tf.PieceHashes) == 0 {
+		return torrentfile.ErrV2Only
+	}
+
+	m := magnet.Magnet{InfoHash: tf.InfoHash, Name: tf.Name}
+	if len(tf.AnnounceList) > 0 {
+		for _, tier := range tf.AnnounceList {
+			m.Trackers = append(m.Trackers, tier...)
+		}
+	} else if tf.Announce != "" {
+		m.Trackers = []string{tf.Announce}
+	}
+	fmt.Println(m.String())
+	return nil
+}
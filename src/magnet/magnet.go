@@ -0,0 +1,167 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/brkss/btorrent/src/peer"
+)
+
+const (
+	btihPrefix = "urn:btih:"
+	btpkPrefix = "urn:btpk:"
+)
+
+// Magnet hold what a magnet link tells us about a torrent, the info
+// dictionary itself has to be fetched from peers
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	Peers    []peer.Peer
+	// set by magnet:?xs=urn:btpk: links of updatable torrents (BEP 46), the
+	// current infohash is in the DHT item of PublicKey and Salt
+	PublicKey []byte
+	Salt      []byte
+}
+
+// Mutable reports whether the link points to an updatable torrent, whose
+// infohash must be looked up first
+func (m *Magnet) Mutable() bool {
+	return m.PublicKey != nil
+}
+
+// IsMagnet reports whether s looks like a magnet link
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), "magnet:")
+}
+
+// Parse parses a magnet:?xt=urn:btih:... link, the infohash may be hex or
+// base32 encoded, or a magnet:?xs=urn:btpk:...&s=... link with a hex public
+// key and salt
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %s", uri)
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{Name: query.Get("dn")}
+	found := false
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), btihPrefix) {
+			continue
+		}
+		m.InfoHash, err = parseInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	for _, xs := range query["xs"] {
+		if !strings.HasPrefix(strings.ToLower(xs), btpkPrefix) {
+			continue
+		}
+		m.PublicKey, err = hex.DecodeString(xs[len(btpkPrefix):])
+		if err != nil || len(m.PublicKey) != 32 {
+			return nil, fmt.Errorf("invalid public key %q", xs[len(btpkPrefix):])
+		}
+		m.Salt, err = hex.DecodeString(query.Get("s"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid salt %q: %w", query.Get("s"), err)
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("magnet link has no urn:btih exact topic nor urn:btpk source")
+	}
+
+	m.Trackers = append(m.Trackers, query["tr"]...)
+	// some clients number their trackers tr.1, tr.2, ...
+	var numbered []string
+	for key := range query {
+		if strings.HasPrefix(key, "tr.") {
+			numbered = append(numbered, key)
+		}
+	}
+	sort.Strings(numbered)
+	for _, key := range numbered {
+		m.Trackers = append(m.Trackers, query[key]...)
+	}
+
+	for _, pe := range query["x.pe"] {
+		p, err := parsePeer(pe)
+		if err != nil {
+			return nil, err
+		}
+		m.Peers = append(m.Peers, p)
+	}
+	return m, nil
+}
+
+// String returns the magnet link, the infohash is hex encoded. Links of
+// updatable torrents only give the public key and salt
+func (m *Magnet) String() string {
+	var b strings.Builder
+	if m.Mutable() {
+		b.WriteString("magnet:?xs=" + btpkPrefix + hex.EncodeToString(m.PublicKey))
+		if len(m.Salt) > 0 {
+			b.WriteString("&s=" + hex.EncodeToString(m.Salt))
+		}
+	} else {
+		b.WriteString("magnet:?xt=" + btihPrefix + hex.EncodeToString(m.InfoHash[:]))
+	}
+	if m.Name != "" {
+		b.WriteString("&dn=" + url.QueryEscape(m.Name))
+	}
+	for _, tr := range m.Trackers {
+		b.WriteString("&tr=" + url.QueryEscape(tr))
+	}
+	for _, p := range m.Peers {
+		b.WriteString("&x.pe=" + url.QueryEscape(p.String()))
+	}
+	return b.String()
+}
+
+func parseInfoHash(s string) ([20]byte, error) {
+	var hash [20]byte
+	var buf []byte
+	var err error
+	switch len(s) {
+	case 40:
+		buf, err = hex.DecodeString(s)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, fmt.Errorf("invalid infohash length %d", len(s))
+	}
+	if err != nil {
+		return hash, fmt.Errorf("invalid infohash %q: %w", s, err)
+	}
+	copy(hash[:], buf)
+	return hash, nil
+}
+
+func parsePeer(s string) (peer.Peer, error) {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		return peer.Peer{}, fmt.Errorf("invalid peer address %q: %w", s, err)
+	}
+	if addr.Port <= 0 || addr.Port > 65535 {
+		return peer.Peer{}, fmt.Errorf("invalid peer port in %q", s)
+	}
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, nil
+}
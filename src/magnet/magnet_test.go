@@ -0,0 +1,69 @@
+package magnet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/brkss/btorrent/src/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+var expectedHash = [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182}
+
+func TestParseHex(t *testing.T) {
+	m, err := Parse("magnet:?xt=urn:btih:d8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6" +
+		"&dn=debian.iso&tr=http%3A%2F%2Ftracker%2Fannounce&tr=udp%3A%2F%2Fother%3A80" +
+		"&x.pe=127.0.0.1:6881")
+	assert.Nil(t, err)
+	assert.Equal(t, expectedHash, m.InfoHash)
+	assert.Equal(t, "debian.iso", m.Name)
+	assert.Equal(t, []string{"http://tracker/announce", "udp://other:80"}, m.Trackers)
+	assert.Equal(t, []peer.Peer{{IP: net.IPv4(127, 0, 0, 1), Port: 6881}}, m.Peers)
+}
+
+func TestParseBase32(t *testing.T) {
+	m, err := Parse("magnet:?xt=urn:btih:3D3TTTWDFCKWZTC3X4PYNWP5Z7N2RTVW")
+	assert.Nil(t, err)
+	assert.Equal(t, expectedHash, m.InfoHash)
+}
+
+func TestParseMutable(t *testing.T) {
+	pk := "8543d3e6115f0f98c944077a4493dcd543e49c739fd998550a1f614ab36ed63e"
+	m, err := Parse("magnet:?xs=urn:btpk:" + pk + "&s=6e696768746c79&dn=nightly")
+	assert.Nil(t, err)
+	assert.True(t, m.Mutable())
+	assert.Len(t, m.PublicKey, 32)
+	assert.Equal(t, []byte("nightly"), m.Salt)
+	assert.Equal(t, "magnet:?xs=urn:btpk:"+pk+"&s=6e696768746c79&dn=nightly", m.String())
+
+	_, err = Parse("magnet:?xs=urn:btpk:abcd")
+	assert.NotNil(t, err)
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := Parse("magnet:?dn=nothing")
+	assert.NotNil(t, err)
+	_, err = Parse("magnet:?xt=urn:btih:abc")
+	assert.NotNil(t, err)
+	_, err = Parse("http://example.com")
+	assert.NotNil(t, err)
+}
+
+func TestString(t *testing.T) {
+	m := &Magnet{
+		InfoHash: expectedHash,
+		Name:     "debian 12.iso",
+		Trackers: []string{"http://tracker/announce?key=1"},
+		Peers:    []peer.Peer{{IP: net.IPv4(127, 0, 0, 1), Port: 6881}},
+	}
+	uri := m.String()
+	assert.Equal(t, "magnet:?xt=urn:btih:d8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6&dn=debian+12.iso"+
+		"&tr=http%3A%2F%2Ftracker%2Fannounce%3Fkey%3D1&x.pe=127.0.0.1%3A6881", uri)
+
+	parsed, err := Parse(uri)
+	assert.Nil(t, err)
+	assert.Equal(t, m.InfoHash, parsed.InfoHash)
+	assert.Equal(t, m.Name, parsed.Name)
+	assert.Equal(t, m.Trackers, parsed.Trackers)
+	assert.Equal(t, m.Peers[0].String(), parsed.Peers[0].String())
+}
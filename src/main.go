@@ -1,26 +1,195 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 
+	"github.com/brkss/btorrent/src/dht"
+	"github.com/brkss/btorrent/src/magnet"
 	"github.com/brkss/btorrent/src/torrentfile"
 )
 
+// exit codes, so scripts can tell what went wrong
+const (
+	EXIT_OK            = 0
+	EXIT_FAILURE       = 1 // anything not listed below
+	EXIT_USAGE         = 2 // bad command line
+	EXIT_BAD_TORRENT   = 3 // the torrent or magnet link can't be read
+	EXIT_NETWORK       = 4 // no tracker answered, no peers, no metadata
+	EXIT_HASH_FAILURE  = 5 // data on disk doesn't match the torrent
+	EXIT_STORAGE_ERROR = 6 // reading or writing local files failed
+	EXIT_INTERRUPTED   = 130
+)
+
+var (
+	// errUsage is returned for a bad command line, the usage is already printed
+	errUsage = errors.New("usage")
+	// errIncomplete is returned when some pieces on disk don't match their hash
+	errIncomplete = errors.New("data is incomplete or corrupt")
+)
+
+// torrentError is returned when a torrent or magnet link can't be opened
+type torrentError struct {
+	path string
+	err  error
+}
+
+func (e *torrentError) Error() string {
+	return fmt.Sprintf("invalid torrent %s: %s", e.path, e.err)
+}
+
+func (e *torrentError) Unwrap() error { return e.err }
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"download", "download a torrent or magnet link", download},
+	{"seed", "share data that is already on disk", seed},
+	{"info", "print what a torrent contains", info},
+	{"create", "create a torrent from a file or directory", create},
+	{"verify", "check data on disk against a torrent", verify},
+	{"magnet", "print the magnet link of a torrent", magnetLink},
+	{"daemon", "download then seed every torrent dropped in a directory", daemon},
+	{"dht", "get and put items on the DHT, publish updatable torrents", dhtCommand},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: btorrent <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun 'btorrent <command> -h' for the flags of a command")
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		log.Fatal("Invalid Argements")
-		return
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return EXIT_USAGE
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		usage()
+		return EXIT_OK
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+	var err error
+	switch {
+	case cmd != nil:
+		err = cmd.run(args[1:])
+	case len(args) == 2:
+		// the original form: btorrent <torrent> <path>
+		err = download(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		usage()
+		return EXIT_USAGE
+	}
+	if err != nil && err != errUsage && err != flag.ErrHelp {
+		fmt.Fprintf(os.Stderr, "btorrent: %s\n", err)
+	}
+	return exitCode(err)
+}
+
+func exitCode(err error) int {
+	var pathErr *fs.PathError
+	var torrentErr *torrentError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return EXIT_OK
+	case errors.Is(err, errUsage), errors.Is(err, torrentfile.ErrNoDHT):
+		return EXIT_USAGE
+	case errors.Is(err, context.Canceled):
+		return EXIT_INTERRUPTED
+	case errors.Is(err, torrentfile.ErrTrackerUnreachable),
+		errors.Is(err, torrentfile.ErrNoPeers),
+		errors.Is(err, torrentfile.ErrMetadataUnavailable),
+		errors.Is(err, dht.ErrNoNodes),
+		errors.Is(err, dht.ErrItemNotFound):
+		return EXIT_NETWORK
+	case errors.As(err, &torrentErr), errors.Is(err, torrentfile.ErrV2Only):
+		return EXIT_BAD_TORRENT
+	case errors.Is(err, errIncomplete):
+		return EXIT_HASH_FAILURE
+	case errors.As(err, &pathErr):
+		return EXIT_STORAGE_ERROR
+	}
+	return EXIT_FAILURE
+}
+
+// newFlagSet returns the flags of a command with -q and -v already defined,
+// args describes the arguments that follow the flags
+func newFlagSet(name, args string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: btorrent %s [flags] %s\n", name, args)
+		flags.PrintDefaults()
+	}
+	flags.Bool("q", false, "quiet, only print results and errors")
+	flags.Bool("v", false, "verbose, log with timestamps and source lines")
+	return flags
+}
+
+// parseFlags parses args and checks that between minArgs and maxArgs
+// arguments are left, maxArgs < 0 allows any number
+func parseFlags(flags *flag.FlagSet, args []string, minArgs, maxArgs int) error {
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return err
 	}
-	torrentPath := os.Args[1]
-	output := os.Args[2]
-	tf, err := torrentfile.Open(torrentPath)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Invalid Torrent File : %s\n %s", torrentPath, err))
+		return errUsage
+	}
+	if flags.NArg() < minArgs || maxArgs >= 0 && flags.NArg() > maxArgs {
+		flags.Usage()
+		return errUsage
+	}
+	if flags.Lookup("q").Value.String() == "true" {
+		log.SetOutput(io.Discard)
+	}
+	if flags.Lookup("v").Value.String() == "true" {
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+	}
+	return nil
+}
+
+// openTorrent opens a .torrent file or resolves a magnet link
+func openTorrent(torrentPath string) (torrentfile.TorrentFile, error) {
+	return openTorrentWith(context.Background(), torrentPath, torrentfile.Settings{})
+}
+
+// openTorrentWith is openTorrent resolving magnet links with settings, so
+// through the DHT too when there is one
+func openTorrentWith(ctx context.Context, torrentPath string, settings torrentfile.Settings) (torrentfile.TorrentFile, error) {
+	if magnet.IsMagnet(torrentPath) {
+		tf, err := torrentfile.OpenMagnetWith(ctx, torrentPath, settings)
+		if err != nil && !errors.Is(err, torrentfile.ErrNoPeers) && !errors.Is(err, torrentfile.ErrMetadataUnavailable) && err != context.Canceled {
+			return tf, &torrentError{torrentPath, err}
+		}
+		return tf, err
 	}
-	err = tf.DownloadToFile(output)
+	tf, err := torrentfile.Open(torrentPath)
 	if err != nil {
-		log.Fatal("fatal: downloading file : ", err)
+		return tf, &torrentError{torrentPath, err}
 	}
+	return tf, nil
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brkss/btorrent/src/dht"
+	"github.com/brkss/btorrent/src/torrentfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, EXIT_OK, exitCode(nil))
+	assert.Equal(t, EXIT_USAGE, exitCode(fmt.Errorf("%w: bad meta", errUsage)))
+	assert.Equal(t, EXIT_BAD_TORRENT, exitCode(&torrentError{"x.torrent", &fs.PathError{Op: "open"}}))
+	assert.Equal(t, EXIT_NETWORK, exitCode(fmt.Errorf("downloading x: %w", torrentfile.ErrTrackerUnreachable)))
+	assert.Equal(t, EXIT_NETWORK, exitCode(&torrentError{"magnet:", torrentfile.ErrNoPeers}))
+	assert.Equal(t, EXIT_NETWORK, exitCode(dht.ErrItemNotFound))
+	assert.Equal(t, EXIT_USAGE, exitCode(&torrentError{"magnet:", torrentfile.ErrNoDHT}))
+	assert.Equal(t, EXIT_HASH_FAILURE, exitCode(errIncomplete))
+	assert.Equal(t, EXIT_STORAGE_ERROR, exitCode(fmt.Errorf("seeding x: %w", &fs.PathError{Op: "open"})))
+	assert.Equal(t, EXIT_FAILURE, exitCode(fmt.Errorf("something else")))
+}
+
+func TestRunUsage(t *testing.T) {
+	assert.Equal(t, EXIT_USAGE, run(nil))
+	assert.Equal(t, EXIT_USAGE, run([]string{"nope"}))
+	assert.Equal(t, EXIT_USAGE, run([]string{"info"}))
+	assert.Equal(t, EXIT_USAGE, run([]string{"download", "-port", "70000", "x.torrent"}))
+	assert.Equal(t, EXIT_BAD_TORRENT, run([]string{"info", "does-not-exist.torrent"}))
+	assert.Equal(t, EXIT_USAGE, run([]string{"dht"}))
+	assert.Equal(t, EXIT_USAGE, run([]string{"dht", "get", "not-hex"}))
+	assert.Equal(t, EXIT_USAGE, run([]string{"dht", "publish", "x.torrent"}))
+	assert.Equal(t, EXIT_USAGE, run([]string{"download", "-watch", "x.torrent"}))
+}
+
+func TestDHTPutGet(t *testing.T) {
+	var bootstrap []string
+	for i := 0; i < 3; i++ {
+		d, err := dht.New(dht.Config{NoIPv6: true, Bootstrap: bootstrap})
+		assert.Nil(t, err)
+		defer d.Close()
+		bootstrap = []string{fmt.Sprintf("127.0.0.1:%d", d.Port())}
+	}
+	flags := []string{"-q", "-dht-state", "", "-dht-bootstrap", bootstrap[0]}
+	key := filepath.Join(t.TempDir(), "key")
+	assert.Equal(t, EXIT_OK, run([]string{"dht", "keygen", key}))
+	assert.Equal(t, EXIT_STORAGE_ERROR, run([]string{"dht", "keygen", key}))
+	priv, err := readKey(key)
+	assert.Nil(t, err)
+	pub := hex.EncodeToString(priv.Public().(ed25519.PublicKey))
+
+	assert.Equal(t, EXIT_OK, run(append([]string{"dht", "put"}, append(flags, "hello")...)))
+	assert.Equal(t, EXIT_OK, run(append([]string{"dht", "get"}, append(flags, dht.ImmutableTarget([]byte("5:hello")).String())...)))
+	// the second put replaces the first one
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, EXIT_OK, run(append([]string{"dht", "put", "-key", key, "-salt", "s"}, append(flags, "v")...)))
+	}
+	assert.Equal(t, EXIT_OK, run(append([]string{"dht", "get", "-salt", "s"}, append(flags, pub)...)))
+	assert.Equal(t, EXIT_NETWORK, run(append([]string{"dht", "get"}, append(flags, pub)...)))
+
+	data := filepath.Join(t.TempDir(), "nightly.bin")
+	assert.Nil(t, os.WriteFile(data, []byte("nightly build"), 0644))
+	meta, err := torrentfile.Create(data, torrentfile.CreateOptions{PieceLength: 16384})
+	assert.Nil(t, err)
+	torrentPath := data + ".torrent"
+	assert.Nil(t, os.WriteFile(torrentPath, meta, 0644))
+	tf, err := torrentfile.Open(torrentPath)
+	assert.Nil(t, err)
+	assert.Equal(t, EXIT_OK, run(append([]string{"dht", "publish", "-key", key, "-salt", "nightly"}, append(flags, torrentPath)...)))
+
+	d, err := dht.New(dht.Config{NoIPv6: true, Bootstrap: bootstrap})
+	assert.Nil(t, err)
+	defer d.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	assert.Nil(t, d.Bootstrap(ctx))
+	infoHash, _, err := torrentfile.ResolveMutable(ctx, d, priv.Public().(ed25519.PublicKey), []byte("nightly"))
+	assert.Nil(t, err)
+	assert.Equal(t, tf.InfoHash, infoHash)
+}
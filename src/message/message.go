@@ -27,8 +27,14 @@ const (
 	MsgPiece messageID = 7
 	// MsgCancel cancels a request
 	MsgCancel messageID = 8
+	// MsgExtended carries an extension protocol message (BEP 10)
+	MsgExtended messageID = 20
 )
 
+// MAX_LENGTH is the longest message Read accepts, a 128 KiB block or the
+// bitfield of a torrent of 8M pieces fit, a peer can't make us allocate more
+const MAX_LENGTH = 1 << 20
+
 type Message struct {
 	ID      messageID
 	Payload []byte
@@ -43,6 +49,13 @@ func FormatRequest(length int, index int, begin int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+// FormatCancel create a cancel message for a block previously requested
+func FormatCancel(length int, index int, begin int) *Message {
+	msg := FormatRequest(length, index, begin)
+	msg.ID = MsgCancel
+	return msg
+}
+
 // FormatHave create a Have message
 func FormatHave(index int) *Message {
 	payload := make([]byte, 4)
@@ -50,6 +63,37 @@ func FormatHave(index int) *Message {
 	return &Message{ID: MsgHave, Payload: payload}
 }
 
+// FormatPiece create a piece message carrying block at begin inside piece index
+func FormatPiece(index int, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// ParseRequest parses a request message into the requested piece index, begin offset and length
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest {
+		return 0, 0, 0, fmt.Errorf("Expected Request Message (%d) got (%d)", MsgRequest, msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Expected Payload with 12 as length got %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// FormatExtended create an extension protocol message, extID 0 is the extended handshake
+func FormatExtended(extID uint8, payload []byte) *Message {
+	buf := make([]byte, len(payload)+1)
+	buf[0] = extID
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
 // ParsePiece parses a piece message and copy its content into a buffer
 func ParsePiece(index int, buf []byte, message *Message) (int, error) {
 	if message.ID != MsgPiece {
@@ -58,11 +102,11 @@ func ParsePiece(index int, buf []byte, message *Message) (int, error) {
 	if len(message.Payload) < 8 {
 		return 0, fmt.Errorf("Payload too short %d < 8", len(message.Payload))
 	}
-	parsedIndex := int(binary.BigEndian.Uint16(message.Payload[0:4]))
+	parsedIndex := int(binary.BigEndian.Uint32(message.Payload[0:4]))
 	if index != parsedIndex {
 		return 0, fmt.Errorf("Expected index %d got %d", index, parsedIndex)
 	}
-	begin := int(binary.BigEndian.Uint16(message.Payload[4:8]))
+	begin := int(binary.BigEndian.Uint32(message.Payload[4:8]))
 	if begin >= len(buf) {
 		return 0, fmt.Errorf("Begin offset too high : %d >= %d", begin, len(buf))
 	}
@@ -74,6 +118,19 @@ func ParsePiece(index int, buf []byte, message *Message) (int, error) {
 	return len(data), nil
 }
 
+// ParseBlock parses a piece message into its piece index, begin offset and block data
+func ParseBlock(msg *Message) (index, begin int, data []byte, err error) {
+	if msg.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("Expected Message Piece (ID: %d). got ID %d", MsgPiece, msg.ID)
+	}
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("Payload too short %d < 8", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
 // ParseHave parses a have message
 func ParseHave(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
@@ -115,6 +172,9 @@ func Read(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > MAX_LENGTH {
+		return nil, fmt.Errorf("message of %d bytes exceeds the maximum of %d", length, MAX_LENGTH)
+	}
 
 	messageBuf := make([]byte, length)
 	_, err = io.ReadFull(r, messageBuf)
@@ -152,6 +212,8 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -0,0 +1,55 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePiece(t *testing.T) {
+	buf := make([]byte, 32768)
+	msg := FormatPiece(70000, 16384, []byte("block"))
+	n, err := ParsePiece(70000, buf, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("block"), buf[16384:16389])
+
+	_, err = ParsePiece(1, buf, msg)
+	assert.NotNil(t, err)
+}
+
+func TestParseRequest(t *testing.T) {
+	index, begin, length, err := ParseRequest(FormatRequest(16384, 4, 32768))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 32768, 16384}, []int{index, begin, length})
+
+	_, _, _, err = ParseRequest(FormatHave(4))
+	assert.NotNil(t, err)
+}
+
+func TestSerializeRead(t *testing.T) {
+	msg := FormatHave(42)
+	got, err := Read(bytes.NewReader(msg.Serialize()))
+	assert.Nil(t, err)
+	assert.Equal(t, msg, got)
+
+	var keepAlive *Message
+	got, err = Read(bytes.NewReader(keepAlive.Serialize()))
+	assert.Nil(t, err)
+	assert.Nil(t, got)
+
+	// the length prefix alone can't make us allocate gigabytes
+	_, err = Read(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, byte(MsgPiece)}))
+	assert.NotNil(t, err)
+	piece := FormatPiece(0, 0, make([]byte, 131072))
+	got, err = Read(bytes.NewReader(piece.Serialize()))
+	assert.Nil(t, err)
+	assert.Equal(t, piece, got)
+}
+
+func TestFormatCancel(t *testing.T) {
+	msg := FormatCancel(16384, 4, 32768)
+	assert.Equal(t, MsgCancel, msg.ID)
+	assert.Equal(t, []byte{0, 0, 0, 4, 0, 0, 0x80, 0, 0, 0, 0x40, 0}, msg.Payload)
+}
@@ -0,0 +1,237 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/client"
+	"github.com/brkss/btorrent/src/handshake"
+	"github.com/brkss/btorrent/src/message"
+	"github.com/brkss/btorrent/src/peer"
+)
+
+const (
+	UtMetadataID    = 1       // id we advertise for ut_metadata in our extended handshake
+	blockSize       = 16384   // metadata is exchanged in 16KiB pieces
+	maxMetadataSize = 8 << 20 // refuse peers that claim an absurd info dictionary size
+	maxDictString   = 1024    // ut_metadata dictionaries hold no long string
+)
+
+// ut_metadata message types (BEP 9)
+const (
+	msgRequest = 0
+	msgData    = 1
+	msgReject  = 2
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// Fetch downloads the info dictionary of infoHash from the first peer able
+// to give it to us, the returned bytes are verified against infoHash
+func Fetch(peers []peer.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	return FetchContext(context.Background(), peers, peerID, infoHash)
+}
+
+// FetchContext is Fetch giving up with ctx.Err() once ctx is done, the
+// connections still asking other peers are closed as soon as one answered
+func FetchContext(ctx context.Context, peers []peer.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers to fetch metadata from")
+	}
+	type result struct {
+		info []byte
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(peers))
+	for _, p := range peers {
+		go func(p peer.Peer) {
+			info, err := fetchFrom(ctx, p, peerID, infoHash)
+			results <- result{info, err}
+		}(p)
+	}
+
+	var err error
+	for range peers {
+		var res result
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if res.err == nil {
+			return res.info, nil
+		}
+		err = res.err
+	}
+	return nil, fmt.Errorf("could not fetch metadata from %d peers, last error: %w", len(peers), err)
+}
+
+func fetchFrom(ctx context.Context, p peer.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	dialer := net.Dialer{Timeout: time.Second * 3}
+	conn, err := dialer.DialContext(ctx, "tcp", p.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	info, err := fetchFromConn(conn, peerID, infoHash)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		log.Printf("could not fetch metadata from %s: %s\n", p, err)
+		return nil, err
+	}
+	return info, nil
+}
+
+func fetchFromConn(conn net.Conn, peerID, infoHash [20]byte) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+	defer conn.SetDeadline(time.Time{})
+
+	_, err := conn.Write(handshake.New(infoHash, peerID).Serialize())
+	if err != nil {
+		return nil, err
+	}
+	res, err := handshake.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(res.InfoHash[:], infoHash[:]) {
+		return nil, fmt.Errorf("Invalid Info Hash Expected %x and got %x", infoHash, res.InfoHash)
+	}
+	if !res.SupportsExtensions() {
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	local := client.ExtendedHandshake{
+		M:    map[string]int{"ut_metadata": UtMetadataID},
+		V:    client.ClientVersion,
+		Reqq: client.DefaultReqq,
+	}
+	payload, err := local.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(message.FormatExtended(client.ExtHandshakeID, payload).Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	// wait for the peer's extended handshake, skipping bitfield/have/etc
+	var peerExt *client.ExtendedHandshake
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended || len(msg.Payload) == 0 || msg.Payload[0] != client.ExtHandshakeID {
+			continue
+		}
+		peerExt, err = client.ParseExtendedHandshake(msg.Payload[1:])
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	peerMetadataID, ok := peerExt.M["ut_metadata"]
+	if !ok || peerMetadataID == 0 {
+		return nil, fmt.Errorf("peer does not support ut_metadata")
+	}
+	size := peerExt.MetadataSize
+	if size <= 0 || size > maxMetadataSize {
+		return nil, fmt.Errorf("invalid metadata size %d", size)
+	}
+
+	var buf bytes.Buffer
+	numPieces := (size + blockSize - 1) / blockSize
+	for i := 0; i < numPieces; i++ {
+		buf.Reset()
+		err = bencode.Marshal(&buf, metadataMsg{MsgType: msgRequest, Piece: i})
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.Write(message.FormatExtended(uint8(peerMetadataID), buf.Bytes()).Serialize())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info := make([]byte, size)
+	received := 0
+	done := make([]bool, numPieces)
+	for received < numPieces {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended || len(msg.Payload) == 0 || msg.Payload[0] != UtMetadataID {
+			continue
+		}
+		var m metadataMsg
+		data, err := decodeDict(msg.Payload[1:], &m)
+		if err != nil {
+			return nil, err
+		}
+		switch m.MsgType {
+		case msgReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", m.Piece)
+		case msgData:
+			if m.Piece < 0 || m.Piece >= numPieces {
+				return nil, fmt.Errorf("metadata piece %d out of range", m.Piece)
+			}
+			begin := m.Piece * blockSize
+			end := begin + blockSize
+			if end > size {
+				end = size
+			}
+			if len(data) != end-begin {
+				return nil, fmt.Errorf("metadata piece %d has length %d, expected %d", m.Piece, len(data), end-begin)
+			}
+			copy(info[begin:end], data)
+			if !done[m.Piece] {
+				done[m.Piece] = true
+				received++
+			}
+		}
+	}
+
+	hash := sha1.Sum(info)
+	if !bytes.Equal(hash[:], infoHash[:]) {
+		return nil, fmt.Errorf("metadata hash %x does not match infohash %x", hash, infoHash)
+	}
+	return info, nil
+}
+
+// decodeDict decodes the bencoded dictionary at the start of payload into v
+// and returns whatever follows it (ut_metadata data messages append raw bytes)
+func decodeDict(payload []byte, v interface{}) ([]byte, error) {
+	d := bencode.NewDecoder(bytes.NewReader(payload))
+	d.MaxStringLength = maxDictString
+	err := d.Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return payload[d.InputOffset():], nil
+}
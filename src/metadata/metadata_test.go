@@ -0,0 +1,135 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/client"
+	"github.com/brkss/btorrent/src/handshake"
+	"github.com/brkss/btorrent/src/message"
+	"github.com/brkss/btorrent/src/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+// servePeer plays a peer that has info and answers ut_metadata requests
+func servePeer(t *testing.T, conn net.Conn, info []byte) {
+	defer conn.Close()
+	req, err := handshake.Read(conn)
+	if err != nil {
+		return
+	}
+	res := handshake.New(req.InfoHash, [20]byte{9})
+	conn.Write(res.Serialize())
+	conn.Write((&message.Message{ID: message.MsgBitfield, Payload: []byte{0xff}}).Serialize())
+
+	ext := client.ExtendedHandshake{M: map[string]int{"ut_metadata": 3}, MetadataSize: len(info)}
+	payload, _ := ext.Serialize()
+	conn.Write(message.FormatExtended(client.ExtHandshakeID, payload).Serialize())
+
+	var buf bytes.Buffer
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != message.MsgExtended || msg.Payload[0] != 3 {
+			continue
+		}
+		var m metadataMsg
+		_, err = decodeDict(msg.Payload[1:], &m)
+		assert.Nil(t, err)
+		begin := m.Piece * blockSize
+		end := begin + blockSize
+		if end > len(info) {
+			end = len(info)
+		}
+		buf.Reset()
+		bencode.Marshal(&buf, metadataMsg{MsgType: msgData, Piece: m.Piece, TotalSize: len(info)})
+		buf.Write(info[begin:end])
+		conn.Write(message.FormatExtended(UtMetadataID, buf.Bytes()).Serialize())
+	}
+}
+
+func dialTestPeer(t *testing.T, info []byte) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err == nil {
+			servePeer(t, conn, info)
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	return conn
+}
+
+func TestFetchFromConn(t *testing.T) {
+	info := []byte("d4:name4:test6:pieces" + "20000:" + strings.Repeat("x", 20000) + "e")
+	infoHash := sha1.Sum(info)
+	local := dialTestPeer(t, info)
+	defer local.Close()
+
+	got, err := fetchFromConn(local, [20]byte{1}, infoHash)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(info, got))
+}
+
+func TestFetchFromConnBadHash(t *testing.T) {
+	info := []byte("d4:name4:teste")
+	local := dialTestPeer(t, info)
+	defer local.Close()
+
+	_, err := fetchFromConn(local, [20]byte{1}, [20]byte{1, 2, 3})
+	assert.NotNil(t, err)
+}
+
+func TestFetchContextCanceled(t *testing.T) {
+	// a peer that accepts the connection and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = FetchContext(ctx, []peer.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}, [20]byte{1}, [20]byte{2})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the connection to the peer was left open")
+	}
+}
+
+func TestDecodeDictReturnsTrailingData(t *testing.T) {
+	var m metadataMsg
+	rest, err := decodeDict([]byte("d8:msg_typei1e5:piecei2eeRAWDATA"), &m)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, m.MsgType)
+	assert.Equal(t, 2, m.Piece)
+	assert.Equal(t, []byte("RAWDATA"), rest)
+}
@@ -0,0 +1,43 @@
+package metadata
+
+import (
+	"bytes"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/client"
+)
+
+// Serve answers a ut_metadata message from c with the pieces of info, the
+// raw info dictionary. Pieces past its end are rejected, other messages ignored
+func Serve(c *client.Client, info []byte, payload []byte) error {
+	var m metadataMsg
+	_, err := decodeDict(payload, &m)
+	if err != nil {
+		return err
+	}
+	if m.MsgType != msgRequest {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	numPieces := (len(info) + blockSize - 1) / blockSize
+	if m.Piece < 0 || m.Piece >= numPieces {
+		err = bencode.Marshal(&buf, metadataMsg{MsgType: msgReject, Piece: m.Piece})
+		if err != nil {
+			return err
+		}
+		return c.SendExtended("ut_metadata", buf.Bytes())
+	}
+
+	begin := m.Piece * blockSize
+	end := begin + blockSize
+	if end > len(info) {
+		end = len(info)
+	}
+	err = bencode.Marshal(&buf, metadataMsg{MsgType: msgData, Piece: m.Piece, TotalSize: len(info)})
+	if err != nil {
+		return err
+	}
+	buf.Write(info[begin:end])
+	return c.SendExtended("ut_metadata", buf.Bytes())
+}
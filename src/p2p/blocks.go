@@ -0,0 +1,215 @@
+package p2p
+
+import (
+	"sync"
+
+	"github.com/brkss/btorrent/src/client"
+)
+
+// MAX_ENDGAME_DUPLICATES is the max number of peers a block is requested from in endgame
+const MAX_ENDGAME_DUPLICATES = 3
+
+const (
+	blockMissing = iota
+	blockRequested
+	blockReceived
+)
+
+type blockInfo struct {
+	state  int
+	owners []*client.Client // peers we requested the block from
+}
+
+// removeOwner forgets that c was asked for the block, returns false if it was not
+func (b *blockInfo) removeOwner(c *client.Client) bool {
+	for i, o := range b.owners {
+		if o == c {
+			b.owners = append(b.owners[:i], b.owners[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// partialPiece is a piece being assembled out of blocks coming from any peer
+type partialPiece struct {
+	index    int
+	buf      []byte
+	blocks   []blockInfo
+	received int
+}
+
+// blockRequest is a block to ask a peer for
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// requestManager hands out 16KiB blocks to peers. Partially downloaded
+// pieces are kept when a peer goes away so other peers can finish them, and
+// once every remaining block is requested (endgame) idle peers are asked for
+// the same blocks, the other requests get cancelled when one arrives
+type requestManager struct {
+	mu          sync.Mutex
+	picker      PiecePicker
+	pieceLength int
+	length      int
+	partial     map[int]*partialPiece
+	requests    map[*client.Client]int // outstanding requests per peer
+}
+
+func newRequestManager(picker PiecePicker, pieceLength, length int) *requestManager {
+	return &requestManager{
+		picker:      picker,
+		pieceLength: pieceLength,
+		length:      length,
+		partial:     make(map[int]*partialPiece),
+		requests:    make(map[*client.Client]int),
+	}
+}
+
+func (rm *requestManager) newPartial(index int) *partialPiece {
+	size := rm.pieceLength
+	if (index+1)*rm.pieceLength > rm.length {
+		size = rm.length - index*rm.pieceLength
+	}
+	numBlocks := (size + MAX_BACKLOG_SIZE - 1) / MAX_BACKLOG_SIZE
+	return &partialPiece{
+		index:  index,
+		buf:    make([]byte, size),
+		blocks: make([]blockInfo, numBlocks),
+	}
+}
+
+func (p *partialPiece) block(i int) blockRequest {
+	begin := i * MAX_BACKLOG_SIZE
+	length := MAX_BACKLOG_SIZE
+	if begin+length > len(p.buf) {
+		length = len(p.buf) - begin
+	}
+	return blockRequest{index: p.index, begin: begin, length: length}
+}
+
+func (rm *requestManager) request(c *client.Client, p *partialPiece, i int) blockRequest {
+	b := &p.blocks[i]
+	b.state = blockRequested
+	b.owners = append(b.owners, c)
+	rm.requests[c]++
+	return p.block(i)
+}
+
+// next returns the next block to request from c, ok is false when c has
+// enough requests in its pipeline or nothing we need
+func (rm *requestManager) next(c *client.Client) (blockRequest, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.requests[c] >= MAX_BACKLOG {
+		return blockRequest{}, false
+	}
+
+	// finish pieces already started before starting new ones
+	for _, p := range rm.partial {
+		if !c.Bitfield.HasPiece(p.index) {
+			continue
+		}
+		for i := range p.blocks {
+			if p.blocks[i].state == blockMissing {
+				return rm.request(c, p, i), true
+			}
+		}
+	}
+
+	if index, ok := rm.picker.Pick(c.Bitfield); ok {
+		p := rm.newPartial(index)
+		rm.partial[index] = p
+		return rm.request(c, p, 0), true
+	}
+
+	// endgame: every remaining piece is in flight and fully requested
+	if len(rm.partial) < rm.picker.Remaining() {
+		return blockRequest{}, false
+	}
+	for _, p := range rm.partial {
+		if !c.Bitfield.HasPiece(p.index) {
+			continue
+		}
+		for i := range p.blocks {
+			b := &p.blocks[i]
+			if b.state != blockRequested || len(b.owners) >= MAX_ENDGAME_DUPLICATES {
+				continue
+			}
+			mine := false
+			for _, o := range b.owners {
+				if o == c {
+					mine = true
+					break
+				}
+			}
+			if !mine {
+				return rm.request(c, p, i), true
+			}
+		}
+	}
+	return blockRequest{}, false
+}
+
+// requested returns the number of blocks c was asked for and did not send yet
+func (rm *requestManager) requested(c *client.Client) int {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.requests[c]
+}
+
+// received stores a block sent by c. It returns the whole piece once its
+// last block arrives, and the peers whose request for this block must be cancelled
+func (rm *requestManager) received(c *client.Client, index, begin int, data []byte) ([]byte, []*client.Client) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	p := rm.partial[index]
+	if p == nil || begin%MAX_BACKLOG_SIZE != 0 || begin/MAX_BACKLOG_SIZE >= len(p.blocks) {
+		return nil, nil // a piece we already have, or garbage
+	}
+	i := begin / MAX_BACKLOG_SIZE
+	if len(data) != p.block(i).length {
+		return nil, nil
+	}
+	b := &p.blocks[i]
+	if b.removeOwner(c) {
+		rm.requests[c]--
+	}
+	if b.state == blockReceived {
+		return nil, nil
+	}
+
+	copy(p.buf[begin:], data)
+	b.state = blockReceived
+	p.received++
+	cancels := b.owners
+	for _, o := range cancels {
+		rm.requests[o]--
+	}
+	b.owners = nil
+
+	if p.received < len(p.blocks) {
+		return nil, cancels
+	}
+	delete(rm.partial, index)
+	return p.buf, cancels
+}
+
+// release forgets every request sent to c, blocks nobody else was asked
+// for become missing again but the data received so far is kept
+func (rm *requestManager) release(c *client.Client) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for _, p := range rm.partial {
+		for i := range p.blocks {
+			b := &p.blocks[i]
+			if b.removeOwner(c) && len(b.owners) == 0 && b.state == blockRequested {
+				b.state = blockMissing
+			}
+		}
+	}
+	delete(rm.requests, c)
+}
@@ -0,0 +1,74 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/brkss/btorrent/src/bitfield"
+	"github.com/brkss/btorrent/src/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPeer(picker PiecePicker, bf bitfield.Bitfield) *client.Client {
+	picker.AddPeer(bf)
+	return &client.Client{Bitfield: bf}
+}
+
+func TestRequestManagerKeepsBlocksAcrossPeers(t *testing.T) {
+	// one piece of three blocks
+	picker := NewRarestFirstPicker(1)
+	rm := newRequestManager(picker, 3*MAX_BACKLOG_SIZE, 3*MAX_BACKLOG_SIZE)
+	first := newTestPeer(picker, bitfield.Bitfield{0x80})
+	second := newTestPeer(picker, bitfield.Bitfield{0x80})
+
+	for want := 0; want < 3; want++ {
+		req, ok := rm.next(first)
+		assert.True(t, ok)
+		assert.Equal(t, blockRequest{0, want * MAX_BACKLOG_SIZE, MAX_BACKLOG_SIZE}, req)
+	}
+	buf, cancels := rm.received(first, 0, 0, make([]byte, MAX_BACKLOG_SIZE))
+	assert.Nil(t, buf)
+	assert.Empty(t, cancels)
+	assert.Equal(t, 2, rm.requested(first))
+
+	// first goes away, second picks up the blocks it did not send
+	rm.release(first)
+	req, ok := rm.next(second)
+	assert.True(t, ok)
+	assert.Equal(t, MAX_BACKLOG_SIZE, req.begin)
+	req, ok = rm.next(second)
+	assert.True(t, ok)
+	assert.Equal(t, 2*MAX_BACKLOG_SIZE, req.begin)
+
+	rm.received(second, 0, MAX_BACKLOG_SIZE, make([]byte, MAX_BACKLOG_SIZE))
+	buf, _ = rm.received(second, 0, 2*MAX_BACKLOG_SIZE, make([]byte, MAX_BACKLOG_SIZE))
+	assert.Len(t, buf, 3*MAX_BACKLOG_SIZE)
+	assert.Equal(t, 0, rm.requested(second))
+}
+
+func TestRequestManagerEndgame(t *testing.T) {
+	// a single block piece, last of the torrent
+	picker := NewRarestFirstPicker(1)
+	rm := newRequestManager(picker, MAX_BACKLOG_SIZE, 100)
+	slow := newTestPeer(picker, bitfield.Bitfield{0x80})
+	fast := newTestPeer(picker, bitfield.Bitfield{0x80})
+
+	req, ok := rm.next(slow)
+	assert.True(t, ok)
+	assert.Equal(t, blockRequest{0, 0, 100}, req)
+	_, ok = rm.next(slow)
+	assert.False(t, ok)
+
+	// every block is requested, fast is asked for the same block
+	req, ok = rm.next(fast)
+	assert.True(t, ok)
+	assert.Equal(t, blockRequest{0, 0, 100}, req)
+
+	buf, cancels := rm.received(fast, 0, 0, make([]byte, 100))
+	assert.Len(t, buf, 100)
+	assert.Equal(t, []*client.Client{slow}, cancels)
+	assert.Equal(t, 0, rm.requested(slow))
+
+	// the slow copy arriving late is ignored
+	buf, _ = rm.received(slow, 0, 0, make([]byte, 100))
+	assert.Nil(t, buf)
+}
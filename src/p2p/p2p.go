@@ -2,20 +2,28 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"log"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/brkss/btorrent/src/bitfield"
 	"github.com/brkss/btorrent/src/client"
 	"github.com/brkss/btorrent/src/message"
 	"github.com/brkss/btorrent/src/peer"
+	"github.com/brkss/btorrent/src/ratelimit"
+	"github.com/brkss/btorrent/src/storage"
+	"github.com/brkss/btorrent/src/upload"
 )
 
 const (
-	MAX_BACKLOG_SIZE = 16384 // max number of bits a request can ask for
-	MAX_BACKLOG      = 5     // max number of unfulfilled request client have in its pipeline
+	MAX_BACKLOG_SIZE = 16384            // max number of bits a request can ask for
+	MAX_BACKLOG      = 5                // max number of unfulfilled request client have in its pipeline
+	IDLE_TIMEOUT     = time.Minute * 3  // how long we wait for a peer that has nothing for us to say something
+	REQUEST_TIMEOUT  = time.Second * 30 // how long we wait for a peer we have requests pending with
 )
 
 // hold data required to download a torrent from a list of peers
@@ -27,6 +35,78 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Storage     storage.Storage
+	Upload      *upload.Torrent    // optional, pieces we finish are offered to peers through it
+	NewPeers    <-chan []peer.Peer // optional, peers found while the download is running
+	Picker      PiecePicker        // optional, rarest first when nil
+	Completed   bitfield.Bitfield  // optional, pieces already verified on disk
+	MaxPeers    int                // optional, most peers we download from at once, no limit when 0
+	Limiter     *ratelimit.Limiter // optional, caps the download rate
+	OnPiece     func(index int)    // optional, called once a piece is verified and written
+	downloaded  int64
+	connected   int64
+}
+
+// peerSet tracks the peers we have a worker for, so a peer the tracker
+// gives us again is not connected twice. Peers over the limit wait for a
+// worker to exit
+type peerSet struct {
+	mu      sync.Mutex
+	active  map[string]bool
+	waiting []peer.Peer
+	queued  map[string]bool // the peers in waiting
+	max     int             // 0 for no limit
+}
+
+func newPeerSet(max int) *peerSet {
+	return &peerSet{active: make(map[string]bool), queued: make(map[string]bool), max: max}
+}
+
+// add reports whether a worker must be started for p. It is false when p
+// already has one or when there is no room for it, p then waits for a slot
+func (s *peerSet) add(p peer.Peer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := p.String()
+	if s.active[key] || s.queued[key] {
+		return false
+	}
+	if s.max > 0 && len(s.active) >= s.max {
+		s.waiting = append(s.waiting, p)
+		s.queued[key] = true
+		return false
+	}
+	s.active[key] = true
+	return true
+}
+
+// remove forgets the worker of p, its slot goes to the next waiting peer
+// which is returned with ok true
+func (s *peerSet) remove(p peer.Peer) (next peer.Peer, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, p.String())
+	for len(s.waiting) > 0 {
+		next, s.waiting = s.waiting[0], s.waiting[1:]
+		key := next.String()
+		delete(s.queued, key)
+		if !s.active[key] {
+			s.active[key] = true
+			return next, true
+		}
+	}
+	return peer.Peer{}, false
+}
+
+// Downloaded returns the number of verified bytes written so far
+func (t *Torrent) Downloaded() int64 {
+	return atomic.LoadInt64(&t.downloaded)
+}
+
+// ConnectedPeers returns the number of peers we completed a handshake with
+// and are still downloading from
+func (t *Torrent) ConnectedPeers() int {
+	return int(atomic.LoadInt64(&t.connected))
 }
 
 type pieceWork struct {
@@ -40,81 +120,70 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
-}
-
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read()
-	if err != nil {
-		return err
-	}
-
+// handleMessage reacts to a message from a peer we download from
+func (t *Torrent) handleMessage(c *client.Client, rm *requestManager, msg *message.Message, results chan *pieceResult, done <-chan struct{}) error {
 	if msg == nil {
 		return nil // as keep-alive message !
 	}
 
 	switch msg.ID {
 	case message.MsgChoke:
-		state.client.Choked = true
+		// a choking peer discards our requests, let other peers have the blocks
+		c.Choked = true
+		rm.release(c)
 	case message.MsgUnchoke:
-		state.client.Choked = false
+		c.Choked = false
 	case message.MsgHave:
 		index, err := message.ParseHave(msg)
 		if err != nil {
 			return nil
 		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
+		if !c.Bitfield.HasPiece(index) {
+			c.Bitfield.SetPiece(index)
+			if c.Bitfield.HasPiece(index) {
+				rm.picker.PeerHas(index)
+			}
+		}
+	case message.MsgExtended:
+		_, _, err := c.HandleExtended(msg)
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		state.backlog--
-	}
-	return nil
-}
-
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
-	}
-
-	// setting deadline help get unresponding client unstuck
-	// 30 second is more than enough time to download 262kb piece
-	c.Conn.SetDeadline(time.Now().Add(time.Second * 30))
-	defer c.Conn.SetDeadline(time.Time{})
-
-	for state.downloaded < pw.length {
-		// if the client is unchoked keep sending requests till we have enough unfulffiled requests
-		if !state.client.Choked {
-			for state.backlog < MAX_BACKLOG && state.requested < pw.length {
-				blockSize := MAX_BACKLOG_SIZE
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
-				err := c.SendRequest(state.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
+	case message.MsgRequest:
+		// peers we download from may ask us for pieces we already have
+		if t.Upload != nil {
+			err := t.Upload.HandleRequest(c, msg)
+			if err != nil {
+				log.Printf("ignoring request from peer: %s\n", err)
 			}
 		}
-		err := state.readMessage()
+	case message.MsgPiece:
+		index, begin, data, err := message.ParseBlock(msg)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		t.Limiter.Wait(len(data))
+		buf, cancels := rm.received(c, index, begin, data)
+		for _, other := range cancels {
+			other.SendCancel(index, begin, len(data))
+		}
+		if buf == nil {
+			return nil
+		}
+		pw := &pieceWork{index, t.PieceHashes[index], len(buf)}
+		err = checkIntergrity(pw, buf)
+		if err != nil {
+			log.Printf("failed to check piece [%d] integrity \n", pw.index)
+			rm.picker.Abort(pw.index)
+			return nil
+		}
+		c.SendHave(pw.index)
+		select {
+		case results <- &pieceResult{pw.index, buf}:
+		case <-done:
 		}
 	}
-	return state.buf, nil
+	return nil
 }
 
 func checkIntergrity(pw *pieceWork, buf []byte) error {
@@ -125,7 +194,7 @@ func checkIntergrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
-func (t *Torrent) startDownloaderWorker(peer peer.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
+func (t *Torrent) startDownloaderWorker(peer peer.Peer, rm *requestManager, results chan *pieceResult, done <-chan struct{}) {
 	c, err := client.New(peer, t.PeerID, t.InfoHash)
 	if err != nil {
 		//log.Println("err: ", err)
@@ -134,41 +203,77 @@ func (t *Torrent) startDownloaderWorker(peer peer.Peer, workQueue chan *pieceWor
 	}
 
 	defer c.Conn.Close()
+	atomic.AddInt64(&t.connected, 1)
+	defer atomic.AddInt64(&t.connected, -1)
+
+	// unblock reads as soon as the download stops
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-done:
+			c.Conn.Close()
+		case <-exited:
+		}
+	}()
 
 	log.Printf("Complete handshake successfuly with client %s\n", peer.IP)
 
+	rm.picker.AddPeer(c.Bitfield)
+	defer func() {
+		rm.release(c)
+		rm.picker.RemovePeer(c.Bitfield)
+	}()
+
 	c.SendUnchoke()
 	c.SendInterested()
 
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw
-			continue
+	for rm.picker.Remaining() > 0 {
+		select {
+		case <-done:
+			return
+		default:
 		}
 
-		buf, err := attemptDownloadPiece(c, pw)
+		// if the client is unchoked keep sending requests till we have enough unfulffiled requests
+		if !c.Choked {
+			for {
+				req, ok := rm.next(c)
+				if !ok {
+					break
+				}
+				err := c.SendRequest(req.index, req.begin, req.length)
+				if err != nil {
+					return
+				}
+			}
+		}
+
+		// setting deadline help get unresponding client unstuck, a peer
+		// that has nothing for us is given more time to announce new pieces
+		timeout := REQUEST_TIMEOUT
+		if rm.requested(c) == 0 {
+			timeout = IDLE_TIMEOUT
+		}
+		c.Conn.SetDeadline(time.Now().Add(timeout))
+		msg, err := c.Read()
 		if err != nil {
 			log.Printf("Exiting..")
-			workQueue <- pw
 			return
 		}
-
-		err = checkIntergrity(pw, buf)
+		err = t.handleMessage(c, rm, msg, results, done)
 		if err != nil {
-			log.Printf("failed to check piece [%d] integrity \n", pw.index)
-			workQueue <- pw
-			continue
+			log.Printf("Exiting..")
+			return
 		}
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
 	}
 }
 
 func (t *Torrent) calculateBoundsForPeice(index int) (begin, end int) {
 	begin = index * t.PieceLength
 	end = begin + t.PieceLength
-	if end > t.PieceLength {
-		end = t.PieceLength
+	if end > t.Length {
+		end = t.Length
 	}
 	return begin, end
 }
@@ -178,39 +283,97 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
-// Downloads downloads the torrent , it store the whole file in memory !
-func (t *Torrent) Download() ([]byte, error) {
-	log.Printf("Start downloading: %s\n", t.Name)
+// Download downloads the torrent, every verified piece is written to
+// t.Storage at its offset as soon as it arrives
+func (t *Torrent) Download() error {
+	return t.DownloadContext(context.Background())
+}
 
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
-	result := make(chan *pieceResult)
+// DownloadContext is Download returning ctx.Err() early when ctx is done.
+// Every peer connection is closed before it returns
+func (t *Torrent) DownloadContext(ctx context.Context) error {
+	if t.Storage == nil {
+		return fmt.Errorf("no storage to write %s into", t.Name)
+	}
+	log.Printf("Start downloading: %s\n", t.Name)
 
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+	picker := t.Picker
+	if picker == nil {
+		picker = NewRarestFirstPicker(len(t.PieceHashes))
 	}
+	for index := range t.PieceHashes {
+		if t.Completed.HasPiece(index) {
+			picker.Done(index)
+		}
+	}
+	rm := newRequestManager(picker, t.PieceLength, t.Length)
+	result := make(chan *pieceResult)
+	done := make(chan struct{})
+	var workers sync.WaitGroup
+	defer func() {
+		close(done)
+		workers.Wait()
+	}()
 
-	//fmt.Println("iterating on peers count : ", len(t.Peers))
 	// run threads to start downloading torrent
-	for _, peer := range t.Peers {
-		go t.startDownloaderWorker(peer, workQueue, result)
+	peers := newPeerSet(t.MaxPeers)
+	startWorker := func(p peer.Peer) {
+		if !peers.add(p) {
+			return
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				t.startDownloaderWorker(p, rm, result, done)
+				// move on to a peer that waited for a slot
+				next, ok := peers.remove(p)
+				if !ok {
+					return
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+				p = next
+			}
+		}()
+	}
+	for _, p := range t.Peers {
+		startWorker(p)
 	}
-	fmt.Println("pieces : ", len(t.PieceHashes))
-	// collect result into buffer untill full !
-	buf := make([]byte, t.Length)
-	donePieces := 0
-	for donePieces < len(t.PieceHashes) {
-		res := <-result
-		begin, end := t.calculateBoundsForPeice(res.index)
-		copy(buf[begin:end], res.buf[:])
-		donePieces++
+	// write results to storage untill every piece is done !
+	for picker.Remaining() > 0 {
+		var res *pieceResult
+		select {
+		case res = <-result:
+		case fresh := <-t.NewPeers:
+			for _, p := range fresh {
+				startWorker(p)
+			}
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		begin, _ := t.calculateBoundsForPeice(res.index)
+		_, err := t.Storage.WriteAt(res.buf, int64(begin))
+		if err != nil {
+			return fmt.Errorf("writing piece #%d: %w", res.index, err)
+		}
+		picker.Done(res.index)
+		if t.Upload != nil {
+			t.Upload.SetPiece(res.index)
+		}
+		atomic.AddInt64(&t.downloaded, int64(len(res.buf)))
+		if t.OnPiece != nil {
+			t.OnPiece(res.index)
+		}
 
+		donePieces := len(t.PieceHashes) - picker.Remaining()
 		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, t.ConnectedPeers())
 	}
 
-	close(workQueue)
-	fmt.Println("returning from Download()?")
-	return buf, nil
+	return nil
 }
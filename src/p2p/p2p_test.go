@@ -0,0 +1,162 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brkss/btorrent/src/peer"
+	"github.com/brkss/btorrent/src/storage"
+	"github.com/brkss/btorrent/src/upload"
+	"github.com/stretchr/testify/assert"
+)
+
+// seeders starts n upload servers sharing data, returns their addresses and the piece hashes
+func seeders(t *testing.T, data []byte, pieceLength, n int) ([]peer.Peer, [][20]byte, [20]byte) {
+	var hashes [][20]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+	infoHash := [20]byte{42}
+
+	store, err := storage.NewFile(filepath.Join(t.TempDir(), "seed"), int64(len(data)))
+	assert.Nil(t, err)
+	t.Cleanup(func() { store.Close() })
+	store.WriteAt(data, 0)
+
+	var peers []peer.Peer
+	for i := 0; i < n; i++ {
+		up := upload.NewTorrent(infoHash, pieceLength, len(data), len(hashes), store)
+		for index := range hashes {
+			up.SetPiece(index)
+		}
+		s := upload.NewServer([20]byte{byte(i)})
+		s.Add(up)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		go s.Serve(ln)
+		t.Cleanup(func() { s.Close() })
+		addr := ln.Addr().(*net.TCPAddr)
+		peers = append(peers, peer.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+	return peers, hashes, infoHash
+}
+
+func TestDownload(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.Read(data)
+	const pieceLength = 32768
+	peers, hashes, infoHash := seeders(t, data, pieceLength, 3)
+
+	path := filepath.Join(t.TempDir(), "out")
+	store, err := storage.NewFile(path, int64(len(data)))
+	assert.Nil(t, err)
+
+	torrent := Torrent{
+		Peers:       peers,
+		PeerID:      [20]byte{7},
+		InfoHash:    infoHash,
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        "test",
+		Storage:     store,
+	}
+	assert.Nil(t, torrent.Download())
+	assert.Equal(t, int64(len(data)), torrent.Downloaded())
+	assert.Nil(t, store.Close())
+
+	got, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, sha1.Sum(got) == sha1.Sum(data))
+}
+
+func TestDownloadContextCancel(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.Read(data)
+	const pieceLength = 32768
+	peers, hashes, infoHash := seeders(t, data, pieceLength, 1)
+	// a piece nobody can verify keeps the download going until it is cancelled
+	hashes[len(hashes)-1] = [20]byte{}
+
+	store, err := storage.NewFile(filepath.Join(t.TempDir(), "out"), int64(len(data)))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	var pieces []int
+	torrent := Torrent{
+		Peers:       peers,
+		PeerID:      [20]byte{7},
+		InfoHash:    infoHash,
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        "test",
+		Storage:     store,
+		OnPiece:     func(index int) { pieces = append(pieces, index) },
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = torrent.DownloadContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ElementsMatch(t, []int{0, 1, 2}, pieces)
+	assert.Equal(t, 0, torrent.ConnectedPeers())
+}
+
+func TestDownloadMaxPeersWaiting(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.Read(data)
+	const pieceLength = 32768
+	peers, hashes, infoHash := seeders(t, data, pieceLength, 1)
+	// nobody listens there, the seeder gets the slot once it fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	dead := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	store, err := storage.NewFile(filepath.Join(t.TempDir(), "out"), int64(len(data)))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	torrent := Torrent{
+		Peers:       []peer.Peer{dead, peers[0]},
+		PeerID:      [20]byte{7},
+		InfoHash:    infoHash,
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        "test",
+		Storage:     store,
+		MaxPeers:    1,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	assert.Nil(t, torrent.DownloadContext(ctx))
+	assert.Equal(t, int64(len(data)), torrent.Downloaded())
+}
+
+func TestPeerSet(t *testing.T) {
+	a, b := peer.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 1}, peer.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	s := newPeerSet(1)
+	assert.True(t, s.add(a))
+	assert.False(t, s.add(a))
+	assert.False(t, s.add(b))
+	assert.False(t, s.add(b))
+
+	next, ok := s.remove(a)
+	assert.True(t, ok)
+	assert.Equal(t, b, next)
+	_, ok = s.remove(b)
+	assert.False(t, ok)
+	assert.True(t, s.add(a))
+}
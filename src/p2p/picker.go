@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/brkss/btorrent/src/bitfield"
+)
+
+// PiecePicker decides which piece a peer should download next, it is
+// shared by every worker so implementations must be safe for concurrent use
+type PiecePicker interface {
+	// AddPeer and RemovePeer account for the pieces a connected peer has
+	AddPeer(bf bitfield.Bitfield)
+	RemovePeer(bf bitfield.Bitfield)
+	// PeerHas accounts for a Have message
+	PeerHas(index int)
+	// Pick hands out a piece peerHas has and nobody is downloading, ok is false if there is none
+	Pick(peerHas bitfield.Bitfield) (index int, ok bool)
+	// Done marks a piece as verified, Abort puts a picked piece back to be picked again
+	Done(index int)
+	Abort(index int)
+	// Remaining returns the number of pieces not verified yet
+	Remaining() int
+}
+
+const (
+	pieceMissing = iota
+	pieceInProgress
+	pieceDone
+)
+
+// pieceStates is the bookkeeping shared by the pickers
+type pieceStates struct {
+	mu           sync.Mutex
+	state        []int
+	availability []int // number of connected peers having each piece
+	remaining    int
+}
+
+func newPieceStates(numPieces int) pieceStates {
+	return pieceStates{
+		state:        make([]int, numPieces),
+		availability: make([]int, numPieces),
+		remaining:    numPieces,
+	}
+}
+
+func (p *pieceStates) AddPeer(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+func (p *pieceStates) RemovePeer(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if bf.HasPiece(i) && p.availability[i] > 0 {
+			p.availability[i]--
+		}
+	}
+}
+
+func (p *pieceStates) PeerHas(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+func (p *pieceStates) Done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.state) && p.state[index] != pieceDone {
+		p.state[index] = pieceDone
+		p.remaining--
+	}
+}
+
+func (p *pieceStates) Abort(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.state) && p.state[index] == pieceInProgress {
+		p.state[index] = pieceMissing
+	}
+}
+
+func (p *pieceStates) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remaining
+}
+
+// RarestFirstPicker picks the piece the fewest connected peers have, ties
+// are broken at random so peers don't all go after the same piece
+type RarestFirstPicker struct {
+	pieceStates
+}
+
+// NewRarestFirstPicker creates a rarest first picker for numPieces pieces
+func NewRarestFirstPicker(numPieces int) *RarestFirstPicker {
+	return &RarestFirstPicker{newPieceStates(numPieces)}
+}
+
+func (p *RarestFirstPicker) Pick(peerHas bitfield.Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best, ties := -1, 0
+	for i, state := range p.state {
+		if state != pieceMissing || !peerHas.HasPiece(i) {
+			continue
+		}
+		switch {
+		case best == -1 || p.availability[i] < p.availability[best]:
+			best, ties = i, 1
+		case p.availability[i] == p.availability[best]:
+			// reservoir sampling keeps every tie equally likely
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+	p.state[best] = pieceInProgress
+	return best, true
+}
+
+// SequentialPicker picks pieces in index order, useful for streaming
+type SequentialPicker struct {
+	pieceStates
+}
+
+// NewSequentialPicker creates a sequential picker for numPieces pieces
+func NewSequentialPicker(numPieces int) *SequentialPicker {
+	return &SequentialPicker{newPieceStates(numPieces)}
+}
+
+func (p *SequentialPicker) Pick(peerHas bitfield.Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, state := range p.state {
+		if state == pieceMissing && peerHas.HasPiece(i) {
+			p.state[i] = pieceInProgress
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,49 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/brkss/btorrent/src/bitfield"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRarestFirstPicker(t *testing.T) {
+	p := NewRarestFirstPicker(4)
+	p.AddPeer(bitfield.Bitfield{0xF0}) // has 0, 1, 2, 3
+	p.AddPeer(bitfield.Bitfield{0xD0}) // has 0, 1, 3
+	p.PeerHas(0)
+
+	// piece 2 is the only piece one peer has
+	index, ok := p.Pick(bitfield.Bitfield{0xF0})
+	assert.True(t, ok)
+	assert.Equal(t, 2, index)
+
+	// 1 and 3 are tied, 0 is the most available
+	index, ok = p.Pick(bitfield.Bitfield{0xF0})
+	assert.True(t, ok)
+	assert.Contains(t, []int{1, 3}, index)
+
+	p.Abort(2)
+	p.Done(index)
+	assert.Equal(t, 3, p.Remaining())
+
+	index, ok = p.Pick(bitfield.Bitfield{0x20})
+	assert.True(t, ok)
+	assert.Equal(t, 2, index)
+
+	// nothing left that this peer has
+	_, ok = p.Pick(bitfield.Bitfield{0x20})
+	assert.False(t, ok)
+}
+
+func TestSequentialPicker(t *testing.T) {
+	p := NewSequentialPicker(3)
+	p.AddPeer(bitfield.Bitfield{0xE0})
+	for want := 0; want < 3; want++ {
+		index, ok := p.Pick(bitfield.Bitfield{0xE0})
+		assert.True(t, ok)
+		assert.Equal(t, want, index)
+		p.Done(index)
+	}
+	assert.Equal(t, 0, p.Remaining())
+}
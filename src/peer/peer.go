@@ -29,6 +29,21 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 	return peers, nil
 }
 
+// Unmarshal6 parses compact IPv6 peers (BEP 7), 16 bytes of address and 2 of port each
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	const peerSize = 18
+	if len(peersBin)%peerSize != 0 {
+		return nil, fmt.Errorf("recieved malformed IPv6 peers !")
+	}
+	peers := make([]Peer, len(peersBin)/peerSize)
+	for i := range peers {
+		offset := i * peerSize
+		peers[i].IP = net.IP(peersBin[offset : offset+16])
+		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+16 : offset+18])
+	}
+	return peers, nil
+}
+
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
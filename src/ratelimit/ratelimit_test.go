@@ -0,0 +1,34 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	assert.Nil(t, New(0))
+	l.Wait(1 << 30)
+	assert.Equal(t, int64(0), l.Rate())
+}
+
+func TestWait(t *testing.T) {
+	l := New(100000)
+	start := time.Now()
+	var wg sync.WaitGroup
+	// the first second worth goes through at once, the rest waits
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Wait(40000)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 500*time.Millisecond, "took %s", elapsed)
+	assert.True(t, elapsed < 2*time.Second, "took %s", elapsed)
+}
@@ -0,0 +1,142 @@
+package resume
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/bitfield"
+)
+
+// FileInfo is the size and modification time of a file when progress was saved,
+// if they changed since the bitfield can't be trusted anymore
+type FileInfo struct {
+	Path  string `bencode:"path"`
+	Size  int64  `bencode:"size"`
+	MTime int64  `bencode:"mtime"`
+}
+
+// Data is what we persist about an unfinished download
+type Data struct {
+	InfoHash   [20]byte
+	Bitfield   bitfield.Bitfield
+	Files      []FileInfo
+	Uploaded   int64
+	Downloaded int64
+	Trackers   [][]string
+}
+
+type bencodeResume struct {
+	InfoHash   string     `bencode:"info-hash"`
+	Bitfield   string     `bencode:"bitfield"`
+	Files      []FileInfo `bencode:"files"`
+	Uploaded   int64      `bencode:"uploaded"`
+	Downloaded int64      `bencode:"downloaded"`
+	Trackers   [][]string `bencode:"trackers,omitempty"`
+}
+
+// StatFiles returns the current FileInfo of paths, an error is returned if one does not exist
+func StatFiles(paths []string) ([]FileInfo, error) {
+	infos := make([]FileInfo, len(paths))
+	for i, path := range paths {
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = FileInfo{Path: path, Size: st.Size(), MTime: st.ModTime().UnixNano()}
+	}
+	return infos, nil
+}
+
+// Matches reports whether files are exactly the ones recorded when the data was saved
+func (d *Data) Matches(files []FileInfo) bool {
+	if len(files) != len(d.Files) {
+		return false
+	}
+	for i := range files {
+		if files[i] != d.Files[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ChangedFiles reports which of files were modified since the data was
+// saved. ok is false when they don't have the recorded paths and sizes
+func (d *Data) ChangedFiles(files []FileInfo) (changed []bool, ok bool) {
+	if len(files) != len(d.Files) {
+		return nil, false
+	}
+	changed = make([]bool, len(files))
+	for i := range files {
+		if files[i].Path != d.Files[i].Path || files[i].Size != d.Files[i].Size {
+			return nil, false
+		}
+		changed[i] = files[i].MTime != d.Files[i].MTime
+	}
+	return changed, true
+}
+
+// Load reads the resume file at path
+func Load(path string) (*Data, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// we always write it canonical, anything else was damaged
+	br := bencodeResume{}
+	dec := bencode.NewDecoder(file)
+	dec.Strict = true
+	err = dec.Decode(&br)
+	if err != nil {
+		return nil, err
+	}
+	if len(br.InfoHash) != 20 {
+		return nil, fmt.Errorf("malformed resume file %s", path)
+	}
+	d := &Data{
+		Bitfield:   bitfield.Bitfield(br.Bitfield),
+		Files:      br.Files,
+		Uploaded:   br.Uploaded,
+		Downloaded: br.Downloaded,
+		Trackers:   br.Trackers,
+	}
+	copy(d.InfoHash[:], br.InfoHash)
+	return d, nil
+}
+
+// Save writes d to path, going through a temporary file so a crash never leaves a truncated resume file
+func (d *Data) Save(path string) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, bencodeResume{
+		InfoHash:   string(d.InfoHash[:]),
+		Bitfield:   string(d.Bitfield),
+		Files:      d.Files,
+		Uploaded:   d.Uploaded,
+		Downloaded: d.Downloaded,
+		Trackers:   d.Trackers,
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
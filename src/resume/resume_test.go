@@ -0,0 +1,66 @@
+package resume
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brkss/btorrent/src/bitfield"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	assert.Nil(t, os.WriteFile(data, []byte("hello"), 0644))
+	files, err := StatFiles([]string{data})
+	assert.Nil(t, err)
+
+	d := &Data{
+		InfoHash:   [20]byte{1, 2, 3},
+		Bitfield:   bitfield.Bitfield{0xA0},
+		Files:      files,
+		Uploaded:   10,
+		Downloaded: 5,
+		Trackers:   [][]string{{"http://a/announce"}},
+	}
+	path := filepath.Join(dir, "data.resume")
+	assert.Nil(t, d.Save(path))
+
+	got, err := Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, d, got)
+	assert.True(t, got.Matches(files))
+
+	changed, ok := got.ChangedFiles(files)
+	assert.True(t, ok)
+	assert.Equal(t, []bool{false}, changed)
+
+	// writing in place after the save keeps the size, not the mtime
+	later := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(data, later, later))
+	files, err = StatFiles([]string{data})
+	assert.Nil(t, err)
+	assert.False(t, got.Matches(files))
+	changed, ok = got.ChangedFiles(files)
+	assert.True(t, ok)
+	assert.Equal(t, []bool{true}, changed)
+
+	// touching the data makes the resume data stale
+	assert.Nil(t, os.WriteFile(data, []byte("hello world"), 0644))
+	files, err = StatFiles([]string{data})
+	assert.Nil(t, err)
+	assert.False(t, got.Matches(files))
+	_, ok = got.ChangedFiles(files)
+	assert.False(t, ok)
+}
+
+func TestLoadRejectsNonCanonical(t *testing.T) {
+	// the keys are out of order, we never write that
+	path := filepath.Join(t.TempDir(), "data.resume")
+	content := "d9:info-hash20:" + string(make([]byte, 20)) + "8:bitfield0:5:filesle8:uploadedi0e10:downloadedi0ee"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	_, err := Load(path)
+	assert.NotNil(t, err)
+}
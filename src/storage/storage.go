@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Storage is where verified pieces end up, addressed by their offset
+// in the torrent's contiguous piece space
+type Storage interface {
+	WriteAt(p []byte, off int64) (int, error)
+	ReadAt(p []byte, off int64) (int, error)
+	Close() error
+}
+
+// FileStorage is the default storage, it writes pieces straight into a file on disk
+type FileStorage struct {
+	file   *os.File // nil for padding
+	length int64
+}
+
+// NewFile opens (or creates) the file at path and grow it to length bytes
+func NewFile(path string, length int64) (*FileStorage, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(length)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileStorage{file: f, length: length}, nil
+}
+
+// WriteAt writes p at offset off, refuse writing past the end of the torrent
+func (s *FileStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.length {
+		return 0, fmt.Errorf("write out of bounds [%d:%d] for storage of length %d", off, off+int64(len(p)), s.length)
+	}
+	if s.file == nil {
+		return len(p), nil
+	}
+	return s.file.WriteAt(p, off)
+}
+
+// ReadAt reads len(p) bytes from offset off
+func (s *FileStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.length {
+		return 0, fmt.Errorf("read out of bounds [%d:%d] for storage of length %d", off, off+int64(len(p)), s.length)
+	}
+	if s.file == nil {
+		for i := range p {
+			p[i] = 0
+		}
+		return len(p), nil
+	}
+	return s.file.ReadAt(p, off)
+}
+
+// Close flushes and closes the underlying file
+func (s *FileStorage) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// FileEntry is one file of a multi-file torrent, files are laid out back
+// to back in the piece space in the order they appear in the torrent.
+// Pad entries (BEP 47) only take room in the piece space: nothing is
+// written to disk and they read as zeros
+type FileEntry struct {
+	Path   string
+	Length int64
+	Pad    bool
+}
+
+// MultiFileStorage maps the contiguous piece space onto several files
+type MultiFileStorage struct {
+	files   []*FileStorage
+	offsets []int64 // offset of each file in the piece space
+	length  int64
+}
+
+// NewMultiFile opens (or creates) every file in entries, creating parent directories as needed
+func NewMultiFile(entries []FileEntry) (*MultiFileStorage, error) {
+	s := &MultiFileStorage{}
+	for _, e := range entries {
+		if e.Pad {
+			s.files = append(s.files, &FileStorage{length: e.Length})
+			s.offsets = append(s.offsets, s.length)
+			s.length += e.Length
+			continue
+		}
+		f, err := NewFile(e.Path, e.Length)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+		s.offsets = append(s.offsets, s.length)
+		s.length += e.Length
+	}
+	return s, nil
+}
+
+// span calls fn for every file region covered by [off, off+n)
+func (s *MultiFileStorage) span(off int64, n int, fn func(f *FileStorage, fileOff int64, from, to int) error) error {
+	if off < 0 || off+int64(n) > s.length {
+		return fmt.Errorf("access out of bounds [%d:%d] for storage of length %d", off, off+int64(n), s.length)
+	}
+	done := 0
+	for i, f := range s.files {
+		if done == n {
+			break
+		}
+		start := s.offsets[i]
+		end := start + f.length
+		if off+int64(done) >= end || f.length == 0 {
+			continue
+		}
+		fileOff := off + int64(done) - start
+		count := n - done
+		if int64(count) > f.length-fileOff {
+			count = int(f.length - fileOff)
+		}
+		err := fn(f, fileOff, done, done+count)
+		if err != nil {
+			return err
+		}
+		done += count
+	}
+	return nil
+}
+
+// WriteAt writes p at offset off, splitting it across file boundaries
+func (s *MultiFileStorage) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	err := s.span(off, len(p), func(f *FileStorage, fileOff int64, from, to int) error {
+		written, err := f.WriteAt(p[from:to], fileOff)
+		n += written
+		return err
+	})
+	return n, err
+}
+
+// ReadAt reads len(p) bytes from offset off, possibly from several files
+func (s *MultiFileStorage) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	err := s.span(off, len(p), func(f *FileStorage, fileOff int64, from, to int) error {
+		read, err := f.ReadAt(p[from:to], fileOff)
+		n += read
+		return err
+	})
+	return n, err
+}
+
+// Close closes every file, returning the first error
+func (s *MultiFileStorage) Close() error {
+	var first error
+	for _, f := range s.files {
+		err := f.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorageWriteRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.iso")
+	s, err := NewFile(path, 10)
+	assert.Nil(t, err)
+
+	n, err := s.WriteAt([]byte("world"), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	_, err = s.WriteAt([]byte("hello"), 0)
+	assert.Nil(t, err)
+
+	buf := make([]byte, 4)
+	_, err = s.ReadAt(buf, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("lowo"), buf)
+
+	_, err = s.WriteAt([]byte("overflow"), 6)
+	assert.NotNil(t, err)
+	assert.Nil(t, s.Close())
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("helloworld"), content)
+}
+
+func TestMultiFileStorageSpansFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewMultiFile([]FileEntry{
+		{Path: filepath.Join(dir, "a.txt"), Length: 3},
+		{Path: filepath.Join(dir, "empty"), Length: 0},
+		{Path: filepath.Join(dir, "sub", "b.txt"), Length: 4},
+	})
+	assert.Nil(t, err)
+
+	n, err := s.WriteAt([]byte("abcdefg"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, n)
+
+	buf := make([]byte, 3)
+	_, err = s.ReadAt(buf, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("cde"), buf)
+	assert.Nil(t, s.Close())
+
+	a, _ := os.ReadFile(filepath.Join(dir, "a.txt"))
+	b, _ := os.ReadFile(filepath.Join(dir, "sub", "b.txt"))
+	assert.Equal(t, []byte("abc"), a)
+	assert.Equal(t, []byte("defg"), b)
+}
+
+func TestMultiFileStoragePadding(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewMultiFile([]FileEntry{
+		{Path: filepath.Join(dir, "a.txt"), Length: 3},
+		{Path: filepath.Join(dir, ".pad", "1"), Length: 1, Pad: true},
+		{Path: filepath.Join(dir, "b.txt"), Length: 2},
+	})
+	assert.Nil(t, err)
+
+	_, err = s.WriteAt([]byte("abcXde"), 0)
+	assert.Nil(t, err)
+	buf := make([]byte, 6)
+	_, err = s.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc\x00de"), buf)
+	assert.Nil(t, s.Close())
+
+	_, err = os.Stat(filepath.Join(dir, ".pad"))
+	assert.True(t, os.IsNotExist(err), "padding must not touch the disk")
+}
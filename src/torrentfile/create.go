@@ -0,0 +1,492 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/client"
+	"github.com/brkss/btorrent/src/storage"
+)
+
+// MetaVersion selects the kind of metainfo Create writes
+type MetaVersion int
+
+const (
+	MetaV1     MetaVersion = iota // BEP 3, SHA-1 hashes of pieces spanning files
+	MetaV2                        // BEP 52, a SHA-256 merkle tree per file
+	MetaHybrid                    // both at once, files are padded to piece boundaries
+)
+
+func (v MetaVersion) String() string {
+	switch v {
+	case MetaV1:
+		return "v1"
+	case MetaV2:
+		return "v2"
+	case MetaHybrid:
+		return "hybrid"
+	default:
+		return fmt.Sprintf("MetaVersion(%d)", int(v))
+	}
+}
+
+// ParseMetaVersion is the inverse of MetaVersion.String
+func ParseMetaVersion(s string) (MetaVersion, error) {
+	for _, v := range []MetaVersion{MetaV1, MetaV2, MetaHybrid} {
+		if v.String() == s {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown meta version %q, want v1, v2 or hybrid", s)
+}
+
+const (
+	MERKLE_BLOCK_SIZE = 16384    // size of the leaves of v2 merkle trees
+	MIN_PIECE_LENGTH  = 16384    // v2 pieces can't be smaller than a leaf
+	MAX_PIECE_LENGTH  = 16777216 // the automatic piece length stops growing here
+	TARGET_PIECES     = 1500     // the automatic piece length aims for about this many pieces
+)
+
+// CreateOptions are the settings of a new torrent, only the zero value of
+// Version (v1) is required
+type CreateOptions struct {
+	Version      MetaVersion
+	PieceLength  int        // power of two, 0 picks one from the total size
+	Name         string     // defaults to the base name of the shared path
+	AnnounceList [][]string // tracker tiers, the first tracker is also used as announce
+	URLList      []string   // web seeds (BEP 19)
+	Comment      string
+	CreatedBy    string    // defaults to client.ClientVersion
+	CreationDate time.Time // defaults to now
+	Private      bool      // no peers but the ones from the trackers (BEP 27)
+	Source       string    // tags the torrent for a tracker, changes the infohash
+}
+
+// createFile is a file found under the shared path
+type createFile struct {
+	path   string   // on disk
+	elems  []string // relative to the shared path, empty when sharing a single file
+	length int64
+}
+
+type createInfo struct {
+	FileTree    map[string]interface{} `bencode:"file tree,omitempty"`
+	Files       []bencodeFile          `bencode:"files,omitempty"`
+	Length      int64                  `bencode:"length,omitempty"`
+	MetaVersion int                    `bencode:"meta version,omitempty"`
+	Name        string                 `bencode:"name"`
+	PieceLength int                    `bencode:"piece length"`
+	Pieces      string                 `bencode:"pieces,omitempty"`
+	Private     int                    `bencode:"private,omitempty"`
+	Source      string                 `bencode:"source,omitempty"`
+}
+
+type createTorrent struct {
+	Announce     string                 `bencode:"announce,omitempty"`
+	AnnounceList [][]string             `bencode:"announce-list,omitempty"`
+	Comment      string                 `bencode:"comment,omitempty"`
+	CreatedBy    string                 `bencode:"created by,omitempty"`
+	CreationDate int64                  `bencode:"creation date,omitempty"`
+	Info         createInfo             `bencode:"info"`
+	PieceLayers  map[string]interface{} `bencode:"piece layers,omitempty"`
+	URLList      []string               `bencode:"url-list,omitempty"`
+}
+
+// Create makes the metainfo of a torrent sharing the file or directory at
+// path and returns it bencoded, ready to be written to a .torrent file
+func Create(path string, opts CreateOptions) ([]byte, error) {
+	name, files, err := walkFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name != "" {
+		name = opts.Name
+	}
+	if !validPathElem(name) {
+		return nil, fmt.Errorf("invalid torrent name %q", name)
+	}
+	var total int64
+	for _, f := range files {
+		total += f.length
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("nothing to share in %s", path)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = pieceLengthFor(total)
+	}
+	if pieceLength < MIN_PIECE_LENGTH || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d is not a power of two of at least %d", pieceLength, MIN_PIECE_LENGTH)
+	}
+
+	info := createInfo{Name: name, PieceLength: pieceLength, Source: opts.Source}
+	if opts.Private {
+		info.Private = 1
+	}
+	var layers map[string]interface{}
+	switch opts.Version {
+	case MetaV1:
+		info.Pieces, err = hashV1(files, pieceLength)
+		if err != nil {
+			return nil, err
+		}
+		setV1Files(&info, files, false)
+	case MetaV2, MetaHybrid:
+		hybrid := opts.Version == MetaHybrid
+		tree, err := hashV2(name, files, pieceLength, hybrid)
+		if err != nil {
+			return nil, err
+		}
+		info.MetaVersion = 2
+		info.FileTree = tree.fileTree
+		layers = tree.pieceLayers
+		if hybrid {
+			info.Pieces = tree.v1Pieces
+			setV1Files(&info, files, true)
+		}
+	default:
+		return nil, fmt.Errorf("unknown meta version %d", int(opts.Version))
+	}
+
+	bto := createTorrent{
+		Comment:     opts.Comment,
+		CreatedBy:   opts.CreatedBy,
+		Info:        info,
+		PieceLayers: layers,
+		URLList:     opts.URLList,
+	}
+	if bto.CreatedBy == "" {
+		bto.CreatedBy = client.ClientVersion
+	}
+	date := opts.CreationDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	bto.CreationDate = date.Unix()
+	for _, tier := range opts.AnnounceList {
+		if len(tier) > 0 {
+			bto.AnnounceList = append(bto.AnnounceList, tier)
+		}
+	}
+	if len(bto.AnnounceList) > 0 {
+		bto.Announce = bto.AnnounceList[0][0]
+	}
+	if len(bto.AnnounceList) == 1 && len(bto.AnnounceList[0]) == 1 {
+		bto.AnnounceList = nil
+	}
+
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, bto)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// walkFiles lists the regular files at path in the order both v1 and v2
+// expect them: sorted by path, like the keys of a bencoded dictionary
+func walkFiles(path string) (string, []createFile, error) {
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	name := filepath.Base(path)
+	if info.Mode().IsRegular() {
+		return name, []createFile{{path: path, length: info.Size()}}, nil
+	}
+	if !info.IsDir() {
+		return "", nil, fmt.Errorf("%s is neither a file nor a directory", path)
+	}
+
+	var files []createFile
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, createFile{
+			path:   p,
+			elems:  strings.Split(filepath.ToSlash(rel), "/"),
+			length: info.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(files) == 0 {
+		return "", nil, fmt.Errorf("no files in %s", path)
+	}
+	return name, files, nil
+}
+
+// pieceLengthFor picks the smallest power of two giving about TARGET_PIECES pieces
+func pieceLengthFor(total int64) int {
+	length := MIN_PIECE_LENGTH
+	for length < MAX_PIECE_LENGTH && total/int64(length) > TARGET_PIECES {
+		length *= 2
+	}
+	return length
+}
+
+// padLength returns the padding aligning the end of a file of length bytes
+// on a piece boundary
+func padLength(length int64, pieceLength int) int64 {
+	rest := length % int64(pieceLength)
+	if rest == 0 {
+		return 0
+	}
+	return int64(pieceLength) - rest
+}
+
+// padded reports whether files[i] is followed by a pad file in a hybrid
+// torrent: only when it doesn't end on a piece boundary and data follows
+func padded(files []createFile, i int, pieceLength int) bool {
+	if padLength(files[i].length, pieceLength) == 0 {
+		return false
+	}
+	for _, f := range files[i+1:] {
+		if f.length > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// setV1Files fills the v1 file list, with pad files (BEP 47) when hybrid
+func setV1Files(info *createInfo, files []createFile, hybrid bool) {
+	if len(files) == 1 && len(files[0].elems) == 0 {
+		info.Length = files[0].length
+		return
+	}
+	for i, f := range files {
+		info.Files = append(info.Files, bencodeFile{Length: int(f.length), Path: f.elems})
+		if hybrid && padded(files, i, info.PieceLength) {
+			pad := padLength(f.length, info.PieceLength)
+			info.Files = append(info.Files, bencodeFile{
+				Attr:   "p",
+				Length: int(pad),
+				Path:   []string{".pad", strconv.FormatInt(pad, 10)},
+			})
+		}
+	}
+}
+
+// hashV1 returns the SHA-1 hashes of the pieces of files laid out back to back
+func hashV1(files []createFile, pieceLength int) (string, error) {
+	entries := make([]storage.FileEntry, len(files))
+	var total int64
+	for i, f := range files {
+		entries[i] = storage.FileEntry{Path: f.path, Length: f.length}
+		total += f.length
+	}
+	r, err := openFileReader(entries)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	numPieces := int((total + int64(pieceLength) - 1) / int64(pieceLength))
+	pieces := make([]byte, numPieces*sha1.Size)
+	err = inParallel(numPieces, pieceLength, func(index int, buf []byte) error {
+		begin := int64(index) * int64(pieceLength)
+		end := begin + int64(pieceLength)
+		if end > total {
+			end = total
+		}
+		err := r.ReadAt(buf[:end-begin], begin)
+		if err == errPieceMissing {
+			return fmt.Errorf("files changed while hashing piece #%d", index)
+		}
+		if err != nil {
+			return err
+		}
+		sum := sha1.Sum(buf[:end-begin])
+		copy(pieces[index*sha1.Size:], sum[:])
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(pieces), nil
+}
+
+// v2Tree is what hashV2 found, the v1 pieces are only set for hybrid torrents
+type v2Tree struct {
+	fileTree    map[string]interface{}
+	pieceLayers map[string]interface{}
+	v1Pieces    string
+}
+
+// v2Piece is one piece of one file, v2 pieces never span files
+type v2Piece struct {
+	file   int
+	offset int64
+	length int
+}
+
+// hashV2 builds the merkle tree of every file (BEP 52). In a hybrid torrent
+// each v2 piece is also a v1 piece once zero padded, so both are hashed from
+// the same read. A single file is put in the file tree under name
+func hashV2(name string, files []createFile, pieceLength int, hybrid bool) (*v2Tree, error) {
+	var pieces []v2Piece
+	first := make([]int, len(files)) // index of the first piece of every file
+	for i, f := range files {
+		first[i] = len(pieces)
+		for off := int64(0); off < f.length; off += int64(pieceLength) {
+			length := int64(pieceLength)
+			if off+length > f.length {
+				length = f.length - off
+			}
+			pieces = append(pieces, v2Piece{file: i, offset: off, length: int(length)})
+		}
+	}
+
+	leavesPerPiece := pieceLength / MERKLE_BLOCK_SIZE
+	hashes := make([][32]byte, len(pieces))
+	var v1 []byte
+	if hybrid {
+		v1 = make([]byte, len(pieces)*sha1.Size)
+	}
+	err := inParallel(len(pieces), pieceLength, func(index int, buf []byte) error {
+		p := pieces[index]
+		err := readAt(files[p.file].path, buf[:p.length], p.offset)
+		if err != nil {
+			return err
+		}
+		var leaves [][32]byte
+		for off := 0; off < p.length; off += MERKLE_BLOCK_SIZE {
+			end := off + MERKLE_BLOCK_SIZE
+			if end > p.length {
+				end = p.length
+			}
+			leaves = append(leaves, sha256.Sum256(buf[off:end]))
+		}
+		if files[p.file].length <= int64(pieceLength) {
+			// a file of a single piece has no piece layer, its tree is only as wide as its blocks
+			hashes[index] = merkleRoot(leaves, nextPowerOfTwo(len(leaves)), [32]byte{})
+		} else {
+			hashes[index] = merkleRoot(leaves, leavesPerPiece, [32]byte{})
+		}
+
+		if hybrid {
+			v1Length := p.length
+			if index < len(pieces)-1 {
+				for i := p.length; i < pieceLength; i++ {
+					buf[i] = 0
+				}
+				v1Length = pieceLength
+			}
+			sum := sha1.Sum(buf[:v1Length])
+			copy(v1[index*sha1.Size:], sum[:])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &v2Tree{fileTree: map[string]interface{}{}, pieceLayers: map[string]interface{}{}}
+	padPiece := merkleRoot(nil, leavesPerPiece, [32]byte{})
+	for i, f := range files {
+		entry := map[string]interface{}{"length": f.length}
+		count := int((f.length + int64(pieceLength) - 1) / int64(pieceLength))
+		layer := hashes[first[i] : first[i]+count]
+		switch {
+		case f.length == 0:
+		case count == 1 && f.length <= int64(pieceLength):
+			entry["pieces root"] = string(layer[0][:])
+		default:
+			root := merkleRoot(layer, nextPowerOfTwo(count), padPiece)
+			entry["pieces root"] = string(root[:])
+			var concat []byte
+			for _, h := range layer {
+				concat = append(concat, h[:]...)
+			}
+			tree.pieceLayers[string(root[:])] = string(concat)
+		}
+
+		elems := f.elems
+		if len(elems) == 0 {
+			elems = []string{name}
+		}
+		dir := tree.fileTree
+		for _, elem := range elems {
+			sub, ok := dir[elem].(map[string]interface{})
+			if !ok {
+				sub = map[string]interface{}{}
+				dir[elem] = sub
+			}
+			dir = sub
+		}
+		dir[""] = entry
+	}
+	if hybrid {
+		tree.v1Pieces = string(v1)
+	}
+	return tree, nil
+}
+
+// readAt fills buf from the file at path, the file must still be long enough
+func readAt(path string, buf []byte, off int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(buf, off)
+	if err != nil {
+		return fmt.Errorf("%s changed while hashing: %w", path, err)
+	}
+	return nil
+}
+
+// merkleRoot hashes layer pairwise up to a single root, layer is first
+// padded to width nodes (a power of two) with pad
+func merkleRoot(layer [][32]byte, width int, pad [32]byte) [32]byte {
+	nodes := make([][32]byte, width)
+	copy(nodes, layer)
+	for i := len(layer); i < width; i++ {
+		nodes[i] = pad
+	}
+	var pair [64]byte
+	for len(nodes) > 1 {
+		for i := 0; i < len(nodes)/2; i++ {
+			copy(pair[:32], nodes[2*i][:])
+			copy(pair[32:], nodes[2*i+1][:])
+			nodes[i] = sha256.Sum256(pair[:])
+		}
+		nodes = nodes[:len(nodes)/2]
+	}
+	return nodes[0]
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
@@ -0,0 +1,162 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, files map[string][]byte) string {
+	root := filepath.Join(t.TempDir(), "share")
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, os.WriteFile(path, content, 0644))
+	}
+	return root
+}
+
+func pattern(n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(i % 251)
+	}
+	return buf
+}
+
+func createAndOpen(t *testing.T, root string, opts CreateOptions) (TorrentFile, map[string]interface{}) {
+	meta, err := Create(root, opts)
+	assert.Nil(t, err)
+	decoded, err := bencode.Decode(bytes.NewReader(meta))
+	assert.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "out.torrent")
+	assert.Nil(t, os.WriteFile(path, meta, 0644))
+	tf, err := Open(path)
+	assert.Nil(t, err)
+	return tf, decoded.(map[string]interface{})
+}
+
+func TestCreateV1(t *testing.T) {
+	root := writeFiles(t, map[string][]byte{
+		"b.bin":     pattern(30000),
+		"a/one.txt": []byte("hello"),
+	})
+	tf, meta := createAndOpen(t, root, CreateOptions{
+		PieceLength:  16384,
+		AnnounceList: [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+		URLList:      []string{"http://mirror/"},
+		Comment:      "nightly build",
+		CreationDate: time.Unix(1700000000, 0),
+		Source:       "ci",
+	})
+	assert.Equal(t, "share", tf.Name)
+	assert.Equal(t, 16384, tf.PieceLength)
+	assert.Equal(t, 30005, tf.Length)
+	assert.Equal(t, []File{
+		{Length: 5, Path: []string{"a", "one.txt"}},
+		{Length: 30000, Path: []string{"b.bin"}},
+	}, tf.Files)
+	assert.Len(t, tf.PieceHashes, 2)
+	assert.Equal(t, "http://a/announce", meta["announce"])
+	assert.Len(t, tf.AnnounceList, 2)
+	assert.Equal(t, "nightly build", meta["comment"])
+	assert.Equal(t, int64(1700000000), meta["creation date"])
+	assert.Equal(t, []interface{}{"http://mirror/"}, meta["url-list"])
+	assert.Equal(t, "ci", tf.Source)
+	assert.Equal(t, "nightly build", tf.Comment)
+	assert.Equal(t, []string{"http://mirror/"}, tf.URLList)
+
+	report, err := tf.Verify(filepath.Dir(root))
+	assert.Nil(t, err)
+	assert.True(t, report.Complete())
+}
+
+func TestCreateV2(t *testing.T) {
+	content := pattern(40000)
+	root := writeFiles(t, map[string][]byte{"data.bin": content})
+	meta, err := Create(filepath.Join(root, "data.bin"), CreateOptions{Version: MetaV2, PieceLength: 16384, Private: true})
+	assert.Nil(t, err)
+	decoded, err := bencode.Decode(bytes.NewReader(meta))
+	assert.Nil(t, err)
+	info := decoded.(map[string]interface{})["info"].(map[string]interface{})
+	assert.Equal(t, int64(2), info["meta version"])
+	assert.Equal(t, int64(1), info["private"])
+	assert.Nil(t, info["pieces"])
+
+	// one leaf per piece, three pieces padded with a zero leaf to four
+	l0 := sha256.Sum256(content[:16384])
+	l1 := sha256.Sum256(content[16384:32768])
+	l2 := sha256.Sum256(content[32768:])
+	h01 := sha256.Sum256(append(l0[:], l1[:]...))
+	h23 := sha256.Sum256(append(l2[:], make([]byte, 32)...))
+	root256 := sha256.Sum256(append(h01[:], h23[:]...))
+
+	file := info["file tree"].(map[string]interface{})["data.bin"].(map[string]interface{})[""].(map[string]interface{})
+	assert.Equal(t, int64(40000), file["length"])
+	assert.Equal(t, string(root256[:]), file["pieces root"])
+	layers := decoded.(map[string]interface{})["piece layers"].(map[string]interface{})
+	assert.Equal(t, string(l0[:])+string(l1[:])+string(l2[:]), layers[string(root256[:])])
+
+	// v2 only torrents can be inspected but not transferred
+	path := filepath.Join(t.TempDir(), "v2.torrent")
+	assert.Nil(t, os.WriteFile(path, meta, 0644))
+	tf, err := Open(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, tf.MetaVersion)
+	assert.Equal(t, sha256.Sum256(tf.InfoBytes), tf.InfoHashV2)
+	assert.Equal(t, 40000, tf.Length)
+	assert.Empty(t, tf.Files)
+	assert.True(t, tf.Private)
+	_, err = tf.Verify(root)
+	assert.Equal(t, ErrV2Only, err)
+}
+
+func TestCreateHybrid(t *testing.T) {
+	a := pattern(20000)
+	root := writeFiles(t, map[string][]byte{"a.bin": a, "b.txt": []byte("small")})
+	tf, meta := createAndOpen(t, root, CreateOptions{Version: MetaHybrid, PieceLength: 16384})
+	assert.Equal(t, []File{
+		{Length: 20000, Path: []string{"a.bin"}},
+		{Length: 12768, Path: []string{".pad", "12768"}, Pad: true},
+		{Length: 5, Path: []string{"b.txt"}},
+	}, tf.Files)
+	assert.Len(t, tf.PieceHashes, 3)
+	assert.Equal(t, 2, tf.MetaVersion)
+
+	// pieces of a.bin are a single leaf each, b.txt is smaller than a leaf
+	l0 := sha256.Sum256(a[:16384])
+	l1 := sha256.Sum256(a[16384:])
+	rootA := sha256.Sum256(append(l0[:], l1[:]...))
+	rootB := sha256.Sum256([]byte("small"))
+	tree := meta["info"].(map[string]interface{})["file tree"].(map[string]interface{})
+	fileA := tree["a.bin"].(map[string]interface{})[""].(map[string]interface{})
+	fileB := tree["b.txt"].(map[string]interface{})[""].(map[string]interface{})
+	assert.Equal(t, string(rootA[:]), fileA["pieces root"])
+	assert.Equal(t, string(rootB[:]), fileB["pieces root"])
+
+	// v1 clients see the padding as zeros without it ever hitting the disk
+	report, err := tf.Verify(filepath.Dir(root))
+	assert.Nil(t, err)
+	assert.True(t, report.Complete())
+	assert.Len(t, report.Files, 2)
+}
+
+func TestCreateInvalidPieceLength(t *testing.T) {
+	root := writeFiles(t, map[string][]byte{"a": []byte("a")})
+	_, err := Create(root, CreateOptions{PieceLength: 20000})
+	assert.NotNil(t, err)
+	_, err = Create(root, CreateOptions{PieceLength: 8192})
+	assert.NotNil(t, err)
+}
+
+func TestPieceLengthFor(t *testing.T) {
+	assert.Equal(t, MIN_PIECE_LENGTH, pieceLengthFor(1000))
+	assert.Equal(t, 1<<20, pieceLengthFor(1<<30))
+	assert.Equal(t, MAX_PIECE_LENGTH, pieceLengthFor(1<<50))
+}
@@ -0,0 +1,101 @@
+package torrentfile
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/brkss/btorrent/src/dht"
+	"github.com/brkss/btorrent/src/peer"
+)
+
+const (
+	DHT_ANNOUNCE_INTERVAL = time.Minute * 15 // how often a running torrent is announced on the DHT again
+	DHT_RETRY_INTERVAL    = time.Minute      // how soon a failed or fruitless DHT lookup is retried
+)
+
+// usesDHT reports whether the torrent looks for peers on the DHT, private
+// torrents only get peers from their trackers (BEP 27)
+func (t *TorrentFile) usesDHT(settings Settings) bool {
+	return settings.DHT != nil && t.AllowsPeerDiscovery()
+}
+
+// announceDHT announces the torrent on the DHT until ctx is done, the peers
+// found each time are sent on found when it isn't nil
+func (t *TorrentFile) announceDHT(ctx context.Context, d *dht.Server, port uint16, found chan<- []peer.Peer) {
+	// nodes given by the torrent help trackerless torrents join the network
+	for _, addr := range t.Nodes {
+		d.AddNode(addr)
+	}
+	for {
+		interval := DHT_ANNOUNCE_INTERVAL
+		peers, err := d.Announce(ctx, t.InfoHash, port)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("dht announce of %s failed: %s\n", t.Name, err)
+			interval = DHT_RETRY_INTERVAL
+		} else if len(peers) == 0 && found != nil {
+			// nobody else yet, someone may come soon
+			interval = DHT_RETRY_INTERVAL
+		}
+		if len(peers) > 0 && found != nil {
+			select {
+			case found <- peers:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// discoverPeers merges the peers found by the tracker session, which may be
+// nil, and the DHT into one channel until ctx is done
+func (t *TorrentFile) discoverPeers(ctx context.Context, session *TrackerSession, settings Settings) <-chan []peer.Peer {
+	if !t.usesDHT(settings) {
+		if session == nil {
+			return nil
+		}
+		return session.Peers
+	}
+	found := make(chan []peer.Peer)
+	go t.announceDHT(ctx, settings.DHT, settings.port(), found)
+	if session != nil {
+		go func() {
+			for {
+				select {
+				case peers := <-session.Peers:
+					select {
+					case found <- peers:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return found
+}
+
+// startDiscovery starts the tracker session then merges its peers with the
+// DHT ones, see discoverPeers. Unreachable trackers are only fatal when the
+// DHT can't be used instead, the returned session is nil in that case
+func (t *TorrentFile) startDiscovery(ctx context.Context, session *TrackerSession, settings Settings) ([]peer.Peer, <-chan []peer.Peer, *TrackerSession, error) {
+	peers, err := startSession(ctx, session)
+	if err != nil {
+		if !t.usesDHT(settings) || ctx.Err() != nil {
+			return nil, nil, nil, err
+		}
+		log.Printf("%s, looking for peers of %s on the dht only\n", err, t.Name)
+		session = nil
+	}
+	return peers, t.discoverPeers(ctx, session, settings), session, nil
+}
@@ -0,0 +1,43 @@
+package torrentfile
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/brkss/btorrent/src/dht"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsesDHT(t *testing.T) {
+	d, err := dht.New(dht.Config{})
+	assert.Nil(t, err)
+	defer d.Close()
+
+	public := TorrentFile{}
+	private := TorrentFile{Private: true}
+	assert.True(t, public.usesDHT(Settings{DHT: d}))
+	assert.False(t, private.usesDHT(Settings{DHT: d}))
+	assert.False(t, public.usesDHT(Settings{}))
+}
+
+func TestStartDiscoveryWithoutTracker(t *testing.T) {
+	d, err := dht.New(dht.Config{})
+	assert.Nil(t, err)
+	defer d.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a dead tracker is not fatal when the DHT can be used instead
+	public := TorrentFile{Name: "public"}
+	session := public.NewTrackerSession([20]byte{}, PORT, func() AnnounceStats { return AnnounceStats{} })
+	_, peers, session, err := public.startDiscovery(ctx, session, Settings{DHT: d})
+	assert.Nil(t, err)
+	assert.Nil(t, session)
+	assert.NotNil(t, peers)
+
+	private := TorrentFile{Name: "private", Private: true}
+	session = private.NewTrackerSession([20]byte{}, PORT, func() AnnounceStats { return AnnounceStats{} })
+	_, _, _, err = private.startDiscovery(ctx, session, Settings{DHT: d})
+	assert.True(t, errors.Is(err, ErrTrackerUnreachable))
+}
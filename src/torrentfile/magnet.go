@@ -0,0 +1,119 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+
+	"github.com/brkss/btorrent/src/magnet"
+	"github.com/brkss/btorrent/src/metadata"
+	"github.com/brkss/btorrent/src/peer"
+)
+
+// OpenMagnet resolves a magnet link into a full TorrentFile, peers are found
+// through the link's trackers (and x.pe hints) then asked for the info dictionary
+func OpenMagnet(uri string) (TorrentFile, error) {
+	return OpenMagnetWith(context.Background(), uri, Settings{})
+}
+
+// OpenMagnetContext is OpenMagnet giving up with ctx.Err() once ctx is done
+func OpenMagnetContext(ctx context.Context, uri string) (TorrentFile, error) {
+	return OpenMagnetWith(ctx, uri, Settings{})
+}
+
+// OpenMagnetWith is OpenMagnetContext also looking for peers on settings.DHT,
+// which is how links without trackers get resolved. Links of updatable
+// torrents (BEP 46) open the torrent their DHT item currently points to. Once ctx is done the
+// tracker announces and metadata download are aborted
+func OpenMagnetWith(ctx context.Context, uri string, settings Settings) (TorrentFile, error) {
+	type opened struct {
+		tf  TorrentFile
+		err error
+	}
+	result := make(chan opened, 1)
+	go func() {
+		tf, err := openMagnet(ctx, uri, settings)
+		result <- opened{tf, err}
+	}()
+	select {
+	case r := <-result:
+		return r.tf, r.err
+	case <-ctx.Done():
+		return TorrentFile{}, ctx.Err()
+	}
+}
+
+func openMagnet(ctx context.Context, uri string, settings Settings) (TorrentFile, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	if m.Mutable() {
+		m.InfoHash, _, err = ResolveMutable(ctx, settings.DHT, m.PublicKey, m.Salt)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+	}
+
+	var peerID [20]byte
+	_, err = rand.Read(peerID[:])
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	var dhtPeers chan []peer.Peer
+	if settings.DHT != nil {
+		dhtPeers = make(chan []peer.Peer, 1)
+		go func() {
+			found, err := settings.DHT.GetPeers(ctx, m.InfoHash)
+			if err != nil {
+				log.Printf("could not get peers from the dht: %s\n", err)
+			}
+			dhtPeers <- found
+		}()
+	}
+
+	// every tracker of the link gets its own tier so peers are merged from all of them
+	var tiers [][]string
+	for _, tr := range m.Trackers {
+		tiers = append(tiers, []string{tr})
+	}
+	peers := append([]peer.Peer{}, m.Peers...)
+	if len(tiers) > 0 {
+		partial := TorrentFile{AnnounceList: tiers, InfoHash: m.InfoHash, Name: m.Name}
+		found, err := partial.requestPeers(ctx, peerID, settings.port())
+		if err != nil {
+			log.Printf("could not get peers from trackers: %s\n", err)
+		}
+		peers = append(peers, found...)
+	}
+	if dhtPeers != nil {
+		peers = append(peers, <-dhtPeers...)
+	}
+	if len(peers) == 0 {
+		return TorrentFile{}, fmt.Errorf("%w for %x", ErrNoPeers, m.InfoHash)
+	}
+
+	info, err := metadata.FetchContext(ctx, peers, peerID, m.InfoHash)
+	if err != nil {
+		return TorrentFile{}, fmt.Errorf("%w: %s", ErrMetadataUnavailable, err)
+	}
+
+	announce := ""
+	if len(m.Trackers) > 0 {
+		announce = m.Trackers[0]
+	}
+	t, err := fromInfo(info, announce)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	t.AnnounceList = tiers
+	return t, nil
+}
+
+// fromInfo builds a TorrentFile out of a raw bencoded info dictionary
+func fromInfo(info []byte, announce string) (TorrentFile, error) {
+	bto := bencodeTorrent{Announce: announce, Info: info}
+	return bto.toTorrentFile()
+}
@@ -0,0 +1,120 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+
+	"github.com/brkss/btorrent/src/bencode"
+	"github.com/brkss/btorrent/src/dht"
+)
+
+// ErrNoDHT is returned when resolving the link of an updatable torrent
+// without a DHT node to look it up with
+var ErrNoDHT = errors.New("updatable torrents need the DHT")
+
+// mutableTorrent is the value of the DHT item an updatable torrent link
+// points to (BEP 46)
+type mutableTorrent struct {
+	InfoHash string `bencode:"ih"`
+}
+
+// ResolveMutable returns the infohash of the current torrent of an updatable
+// torrent link, and the seq of the item it was read from
+func ResolveMutable(ctx context.Context, d *dht.Server, pub ed25519.PublicKey, salt []byte) ([20]byte, int64, error) {
+	var infoHash [20]byte
+	if d == nil {
+		return infoHash, 0, ErrNoDHT
+	}
+	item, err := d.GetMutable(ctx, pub, salt)
+	if err != nil {
+		return infoHash, 0, err
+	}
+	var mt mutableTorrent
+	err = bencode.Unmarshal(bytes.NewReader(item.V), &mt)
+	if err != nil || len(mt.InfoHash) != len(infoHash) {
+		return infoHash, 0, fmt.Errorf("item of %x is not an updatable torrent", []byte(pub))
+	}
+	copy(infoHash[:], mt.InfoHash)
+	return infoHash, item.Seq, nil
+}
+
+// PublishMutable points the updatable torrent of priv and salt to infoHash
+// and returns the seq of the item. Publishing the current torrent again only
+// keeps the item alive on the DHT, nodes forget it after dht.ITEM_TTL
+func PublishMutable(ctx context.Context, d *dht.Server, priv ed25519.PrivateKey, salt []byte, infoHash [20]byte) (int64, error) {
+	v, err := bencode.EncodeBytes(mutableTorrent{InfoHash: string(infoHash[:])})
+	if err != nil {
+		return 0, err
+	}
+	item := &dht.Item{V: v, Salt: salt}
+	current, err := d.GetMutable(ctx, priv.Public().(ed25519.PublicKey), salt)
+	switch {
+	case errors.Is(err, dht.ErrItemNotFound):
+		item.Sign(priv)
+		return item.Seq, d.Put(ctx, item)
+	case err != nil:
+		return 0, err
+	case bytes.Equal(current.V, v):
+		return current.Seq, d.Put(ctx, current)
+	}
+	item.Seq = current.Seq + 1
+	item.Sign(priv)
+	return item.Seq, d.CompareAndPut(ctx, item, current.Seq)
+}
+
+// ReusePieces copies into the download of t at path the pieces previous,
+// downloaded at previousPath, has too: same hash and same length. Each one is
+// checked against its hash on the way and the resume file records them, so
+// the download starts with them. It returns how many pieces were reused
+func (t *TorrentFile) ReusePieces(path string, previous *TorrentFile, previousPath string) (int, error) {
+	if len(t.PieceHashes) == 0 || len(previous.PieceHashes) == 0 {
+		return 0, ErrV2Only
+	}
+	old := make(map[[20]byte]int, len(previous.PieceHashes))
+	for i, h := range previous.PieceHashes {
+		old[h] = i
+	}
+	reader, err := openFileReader(previous.storageEntries(previousPath))
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	store, up, progress, err := t.openWithProgress(path)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	reused := 0
+	buf := make([]byte, t.PieceLength)
+	for i, h := range t.PieceHashes {
+		j, ok := old[h]
+		if !ok || up.HasPiece(i) {
+			continue
+		}
+		begin, end := t.pieceBounds(i)
+		oldBegin, oldEnd := previous.pieceBounds(j)
+		if end-begin != oldEnd-oldBegin {
+			continue
+		}
+		piece := buf[:end-begin]
+		if reader.ReadAt(piece, int64(oldBegin)) != nil || sha1.Sum(piece) != h {
+			continue
+		}
+		_, err = store.WriteAt(piece, int64(begin))
+		if err != nil {
+			return reused, err
+		}
+		up.SetPiece(i)
+		reused++
+	}
+	if reused == 0 {
+		return 0, nil
+	}
+	return reused, t.saveResume(path, up, progress.Uploaded, progress.Downloaded)
+}
@@ -0,0 +1,105 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brkss/btorrent/src/dht"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishResolveMutable(t *testing.T) {
+	var bootstrap []string
+	var nodes []*dht.Server
+	for i := 0; i < 3; i++ {
+		d, err := dht.New(dht.Config{NoIPv6: true, Bootstrap: bootstrap})
+		assert.Nil(t, err)
+		defer d.Close()
+		nodes = append(nodes, d)
+		bootstrap = []string{fmt.Sprintf("127.0.0.1:%d", d.Port())}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	// the first node learns of the others as they join through it
+	for _, d := range nodes[1:] {
+		assert.Nil(t, d.Bootstrap(ctx))
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	salt := []byte("nightly")
+
+	_, _, err = ResolveMutable(ctx, nil, pub, salt)
+	assert.ErrorIs(t, err, ErrNoDHT)
+	_, _, err = ResolveMutable(ctx, nodes[2], pub, salt)
+	assert.ErrorIs(t, err, dht.ErrItemNotFound)
+
+	first, second := [20]byte{1}, [20]byte{2}
+	seq, err := PublishMutable(ctx, nodes[0], priv, salt, first)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), seq)
+	// the same torrent again only refreshes the item
+	seq, err = PublishMutable(ctx, nodes[1], priv, salt, first)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), seq)
+	seq, err = PublishMutable(ctx, nodes[0], priv, salt, second)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), seq)
+
+	infoHash, seq, err := ResolveMutable(ctx, nodes[2], pub, salt)
+	assert.Nil(t, err)
+	assert.Equal(t, second, infoHash)
+	assert.Equal(t, int64(1), seq)
+
+	// items that aren't torrents are refused
+	other := &dht.Item{V: []byte("i1e"), Salt: []byte("other")}
+	other.Sign(priv)
+	assert.Nil(t, nodes[0].Put(ctx, other))
+	_, _, err = ResolveMutable(ctx, nodes[2], pub, []byte("other"))
+	assert.NotNil(t, err)
+}
+
+func TestReusePieces(t *testing.T) {
+	dir := t.TempDir()
+	// the last piece of the old data got corrupted on disk
+	oldContent := []byte("aaaabbbbcc")
+	previous := &TorrentFile{
+		Name:        "data",
+		PieceLength: 4,
+		Length:      len(oldContent),
+		PieceHashes: [][20]byte{sha1.Sum(oldContent[0:4]), sha1.Sum(oldContent[4:8]), sha1.Sum(oldContent[8:10])},
+	}
+	previousPath := filepath.Join(dir, "old")
+	assert.Nil(t, os.WriteFile(previousPath, []byte("aaaabbbbcX"), 0644))
+
+	content := []byte("bbbbxxxxaaaacc")
+	tf := &TorrentFile{
+		Name:        "data",
+		PieceLength: 4,
+		Length:      len(content),
+		PieceHashes: [][20]byte{sha1.Sum(content[0:4]), sha1.Sum(content[4:8]), sha1.Sum(content[8:12]), sha1.Sum(content[12:14])},
+	}
+	path := filepath.Join(dir, "new")
+	reused, err := tf.ReusePieces(path, previous, previousPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, reused)
+
+	// the resume file vouches for the copied pieces
+	store, up, _, err := tf.openWithProgress(path)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.True(t, up.HasPiece(0))
+	assert.False(t, up.HasPiece(1))
+	assert.True(t, up.HasPiece(2))
+	assert.False(t, up.HasPiece(3))
+	got := make([]byte, 12)
+	_, err = store.ReadAt(got, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bbbb"), got[0:4])
+	assert.Equal(t, []byte("aaaa"), got[8:12])
+}
@@ -0,0 +1,144 @@
+package torrentfile
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brkss/btorrent/src/upload"
+)
+
+// PROGRESS_INTERVAL is how often progress is reported between completed pieces
+const PROGRESS_INTERVAL = time.Second
+
+// Progress is a snapshot of a running download or seed
+type Progress struct {
+	Piece        int           // the piece that just completed, -1 for periodic reports
+	PiecesDone   int           // pieces verified on disk
+	Pieces       int           // pieces in the torrent
+	Downloaded   int64         // verified bytes downloaded since the transfer started
+	Uploaded     int64         // bytes uploaded since the transfer started
+	Left         int64         // bytes still to download
+	Peers        int           // peers we are downloading from
+	DownloadRate int64         // bytes per second over the last PROGRESS_INTERVAL
+	UploadRate   int64         // bytes per second over the last PROGRESS_INTERVAL
+	ETA          time.Duration // time left at the current download rate, 0 when unknown or done
+}
+
+// progressReporter turns the counters of a transfer into Progress reports.
+// Reports are taken where send is called but delivered by their own
+// goroutine, so a slow report function never holds up the transfer, and
+// they are never sent concurrently
+type progressReporter struct {
+	mu       sync.Mutex
+	report   func(Progress)
+	up       *upload.Torrent
+	pieces   int
+	counters func() (downloaded int64, peers int)
+
+	last             time.Time
+	lastDownloaded   int64
+	lastUploaded     int64
+	downRate, upRate int64
+
+	queue []Progress // reports waiting to be delivered
+	wake  chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newProgressReporter(report func(Progress), up *upload.Torrent, pieces int, counters func() (int64, int)) *progressReporter {
+	return &progressReporter{
+		report:   report,
+		up:       up,
+		pieces:   pieces,
+		counters: counters,
+		last:     time.Now(),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// send queues a progress report, rates are only measured again on periodic
+// reports so a burst of pieces doesn't skew them
+func (r *progressReporter) send(piece int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	downloaded, peers := r.counters()
+	uploaded := r.up.Uploaded()
+	if piece < 0 {
+		now := time.Now()
+		if elapsed := now.Sub(r.last).Seconds(); elapsed > 0 {
+			r.downRate = int64(float64(downloaded-r.lastDownloaded) / elapsed)
+			r.upRate = int64(float64(uploaded-r.lastUploaded) / elapsed)
+		}
+		r.last, r.lastDownloaded, r.lastUploaded = now, downloaded, uploaded
+	}
+
+	p := Progress{
+		Piece:        piece,
+		PiecesDone:   r.up.Pieces(),
+		Pieces:       r.pieces,
+		Downloaded:   downloaded,
+		Uploaded:     uploaded,
+		Left:         r.up.Left(),
+		Peers:        peers,
+		DownloadRate: r.downRate,
+		UploadRate:   r.upRate,
+	}
+	if p.Left > 0 && p.DownloadRate > 0 {
+		p.ETA = time.Duration(p.Left/p.DownloadRate) * time.Second
+	}
+	r.queue = append(r.queue, p)
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start delivers the queued reports and sends periodic ones until stop
+func (r *progressReporter) start() {
+	if r == nil {
+		return
+	}
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(PROGRESS_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.send(-1)
+			case <-r.wake:
+				r.deliver()
+			case <-r.stop:
+				r.deliver()
+				return
+			}
+		}
+	}()
+}
+
+// deliver calls report with the queued reports
+func (r *progressReporter) deliver() {
+	r.mu.Lock()
+	queue := r.queue
+	r.queue = nil
+	r.mu.Unlock()
+	for _, p := range queue {
+		r.report(p)
+	}
+}
+
+// stopReports stops periodic reports and returns once the queued ones are delivered
+func (r *progressReporter) stopReports() {
+	if r == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+}
@@ -0,0 +1,40 @@
+package torrentfile
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brkss/btorrent/src/upload"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressReporterDoesNotBlock(t *testing.T) {
+	up := upload.NewTorrent([20]byte{1}, 4, 12, 3, nil)
+	release := make(chan struct{})
+	var got []Progress
+	r := newProgressReporter(func(p Progress) {
+		<-release
+		got = append(got, p)
+	}, up, 3, func() (int64, int) { return 0, 1 })
+	r.start()
+
+	// a stuck report function doesn't hold up the pieces coming in
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		up.SetPiece(i)
+		r.send(i)
+	}
+	assert.Less(t, time.Since(start), time.Second)
+
+	close(release)
+	r.stopReports()
+	var pieces []int
+	for _, p := range got {
+		if p.Piece >= 0 {
+			pieces = append(pieces, p.Piece)
+		}
+	}
+	assert.Equal(t, []int{0, 1, 2}, pieces)
+	assert.Equal(t, 3, got[len(got)-1].PiecesDone)
+	assert.Equal(t, int64(0), got[len(got)-1].Left)
+}
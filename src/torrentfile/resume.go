@@ -0,0 +1,228 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/brkss/btorrent/src/bitfield"
+	"github.com/brkss/btorrent/src/resume"
+	"github.com/brkss/btorrent/src/storage"
+	"github.com/brkss/btorrent/src/upload"
+)
+
+// RESUME_SAVE_INTERVAL is how often progress is saved while downloading
+const RESUME_SAVE_INTERVAL = time.Second * 30
+
+// storageEntries lists the files of the torrent as laid out under path, see storage()
+func (t *TorrentFile) storageEntries(path string) []storage.FileEntry {
+	if len(t.Files) == 0 {
+		return []storage.FileEntry{{Path: path, Length: int64(t.Length)}}
+	}
+	entries := make([]storage.FileEntry, len(t.Files))
+	for i, f := range t.Files {
+		elems := append([]string{path, t.Name}, f.Path...)
+		entries[i] = storage.FileEntry{
+			Path:   filepath.Join(elems...),
+			Length: int64(f.Length),
+			Pad:    f.Pad,
+		}
+	}
+	return entries
+}
+
+// storagePaths lists the files of the torrent that are actually on disk
+func (t *TorrentFile) storagePaths(path string) []string {
+	var paths []string
+	for _, e := range t.storageEntries(path) {
+		if !e.Pad {
+			paths = append(paths, e.Path)
+		}
+	}
+	return paths
+}
+
+// DataPath returns the path to download into so the data lands in dir: a
+// single file torrent is dir/<name>, a multi-file one already gets its own
+// directory under the path
+func (t *TorrentFile) DataPath(dir string) string {
+	if len(t.Files) > 0 {
+		return dir
+	}
+	// the name comes from the torrent, don't let it point outside of dir
+	name := filepath.Base(t.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = hex.EncodeToString(t.InfoHash[:])
+	}
+	return filepath.Join(dir, name)
+}
+
+// RootPath returns the file or directory holding the data of a download
+// into path, nothing else under path belongs to the torrent
+func (t *TorrentFile) RootPath(path string) string {
+	if len(t.Files) == 0 {
+		return path
+	}
+	return filepath.Join(path, t.Name)
+}
+
+// ResumePath returns where the progress of a download into path is saved
+func (t *TorrentFile) ResumePath(path string) string {
+	return t.RootPath(path) + ".resume"
+}
+
+// loadResume returns the resume data of a download into path if it can be
+// trusted, recheck is true when there is data on disk it can't vouch for.
+// With both, files were modified after the last save, as when the process
+// was killed while writing: the bitfield of d is cut down to the pieces of
+// the files left untouched, the others need hashing
+func (t *TorrentFile) loadResume(path string) (d *resume.Data, recheck bool) {
+	paths := t.storagePaths(path)
+	files, err := resume.StatFiles(paths)
+	if err != nil {
+		for _, p := range paths {
+			if _, err := os.Stat(p); err == nil {
+				return nil, true
+			}
+		}
+		return nil, false
+	}
+	d, err = resume.Load(t.ResumePath(path))
+	if err != nil {
+		return nil, true
+	}
+	if d.InfoHash != t.InfoHash || len(d.Bitfield) != (len(t.PieceHashes)+7)/8 {
+		log.Printf("resume data of %s is stale\n", t.Name)
+		return nil, true
+	}
+	if d.Matches(files) {
+		return d, false
+	}
+	changed, ok := d.ChangedFiles(files)
+	if !ok {
+		log.Printf("resume data of %s is stale\n", t.Name)
+		return nil, true
+	}
+
+	// the pieces of a modified file may have been written or damaged since
+	untouched := make([]bool, len(t.PieceHashes))
+	for i := range untouched {
+		untouched[i] = true
+	}
+	var offset int64
+	i := 0
+	for _, e := range t.storageEntries(path) {
+		if !e.Pad {
+			if changed[i] && e.Length > 0 {
+				first := offset / int64(t.PieceLength)
+				last := (offset + e.Length - 1) / int64(t.PieceLength)
+				for p := first; p <= last && p < int64(len(untouched)); p++ {
+					untouched[p] = false
+				}
+			}
+			i++
+		}
+		offset += e.Length
+	}
+	trusted := make(bitfield.Bitfield, len(d.Bitfield))
+	for p, ok := range untouched {
+		if ok && d.Bitfield.HasPiece(p) {
+			trusted.SetPiece(p)
+		}
+	}
+	d.Bitfield = trusted
+	return d, true
+}
+
+// openWithProgress opens the storage at path and marks in the returned upload
+// torrent the pieces already there, trusting the resume file when it is fresh
+// and hashing the data on disk otherwise
+func (t *TorrentFile) openWithProgress(path string) (storage.Storage, *upload.Torrent, *resume.Data, error) {
+	d, recheck := t.loadResume(path)
+
+	store, err := t.storage(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	up := upload.NewTorrent(t.InfoHash, t.PieceLength, t.Length, len(t.PieceHashes), store)
+	up.Metadata = t.InfoBytes
+
+	var known bitfield.Bitfield
+	if d != nil {
+		known = d.Bitfield
+		for i := range t.PieceHashes {
+			if d.Bitfield.HasPiece(i) {
+				up.SetPiece(i)
+			}
+		}
+		if sameTiers(d.Trackers, t.AnnounceList) {
+			t.AnnounceList = d.Trackers
+		}
+	}
+	if recheck {
+		if d != nil {
+			log.Printf("Checking the pieces of %s in files modified since progress was saved\n", t.Name)
+		} else {
+			log.Printf("Checking existing data of %s\n", t.Name)
+		}
+		_, err = t.checkPieces(store, up, known)
+		if err != nil {
+			store.Close()
+			return nil, nil, nil, err
+		}
+	}
+	if d == nil {
+		d = &resume.Data{InfoHash: t.InfoHash}
+	}
+	return store, up, d, nil
+}
+
+// saveResume records the verified pieces of up and the transfer totals
+func (t *TorrentFile) saveResume(path string, up *upload.Torrent, uploaded, downloaded int64) error {
+	files, err := resume.StatFiles(t.storagePaths(path))
+	if err != nil {
+		return err
+	}
+	tiersMu.Lock()
+	var trackers [][]string
+	for _, tier := range t.AnnounceList {
+		trackers = append(trackers, append([]string{}, tier...))
+	}
+	tiersMu.Unlock()
+
+	d := &resume.Data{
+		InfoHash:   t.InfoHash,
+		Bitfield:   up.Bitfield(),
+		Files:      files,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Trackers:   trackers,
+	}
+	return d.Save(t.ResumePath(path))
+}
+
+// sameTiers reports whether saved holds the same trackers in the same tiers as
+// current, maybe in another order
+func sameTiers(saved, current [][]string) bool {
+	if len(saved) == 0 || len(saved) != len(current) {
+		return false
+	}
+	for i := range saved {
+		a := append([]string{}, saved[i]...)
+		b := append([]string{}, current[i]...)
+		if len(a) != len(b) {
+			return false
+		}
+		sort.Strings(a)
+		sort.Strings(b)
+		for j := range a {
+			if a[j] != b[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenWithProgress(t *testing.T) {
+	content := []byte("aaaabbbbcc")
+	tf := &TorrentFile{
+		Name:        "data",
+		PieceLength: 4,
+		Length:      len(content),
+		PieceHashes: [][20]byte{sha1.Sum(content[0:4]), sha1.Sum(content[4:8]), sha1.Sum(content[8:10])},
+	}
+	path := filepath.Join(t.TempDir(), "data")
+
+	// nothing on disk yet
+	store, up, _, err := tf.openWithProgress(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), up.Left())
+	store.Close()
+
+	// data without a resume file gets hashed, the second piece is corrupt
+	corrupt := []byte("aaaaXbbbcc")
+	assert.Nil(t, os.WriteFile(path, corrupt, 0644))
+	store, up, _, err = tf.openWithProgress(path)
+	assert.Nil(t, err)
+	assert.True(t, up.HasPiece(0))
+	assert.False(t, up.HasPiece(1))
+	assert.True(t, up.HasPiece(2))
+	assert.Nil(t, tf.saveResume(path, up, 7, 6))
+	store.Close()
+
+	// a fresh resume file is trusted without hashing
+	store, up, progress, err := tf.openWithProgress(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), up.Left())
+	assert.Equal(t, int64(7), progress.Uploaded)
+	assert.Equal(t, int64(6), progress.Downloaded)
+	store.Close()
+
+	// the file was written in place after the save, a missing piece but
+	// also a recorded one: none of its pieces are trusted anymore
+	assert.Nil(t, os.WriteFile(path, []byte("Xaaabbbbcc"), 0644))
+	later := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(path, later, later))
+	store, up, _, err = tf.openWithProgress(path)
+	assert.Nil(t, err)
+	assert.False(t, up.HasPiece(0))
+	assert.True(t, up.HasPiece(1))
+	assert.True(t, up.HasPiece(2))
+	store.Close()
+
+	// once the size changes behind our back the resume file is stale
+	assert.Nil(t, os.WriteFile(path, []byte("aaaaXbbbcc--"), 0644))
+	store, up, _, err = tf.openWithProgress(path)
+	assert.Nil(t, err)
+	assert.False(t, up.HasPiece(1))
+	store.Close()
+}
+
+func TestOpenWithProgressModifiedFile(t *testing.T) {
+	tf := &TorrentFile{
+		Name:        "set",
+		PieceLength: 4,
+		Length:      8,
+		PieceHashes: [][20]byte{sha1.Sum([]byte("aaaa")), sha1.Sum([]byte("bbbb"))},
+		Files: []File{
+			{Length: 4, Path: []string{"a"}},
+			{Length: 4, Path: []string{"b"}},
+		},
+	}
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "set", "a"), filepath.Join(dir, "set", "b")
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "set"), 0755))
+	assert.Nil(t, os.WriteFile(a, []byte("aaaa"), 0644))
+	assert.Nil(t, os.WriteFile(b, []byte("bbbb"), 0644))
+	store, up, _, err := tf.openWithProgress(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), up.Left())
+	assert.Nil(t, tf.saveResume(dir, up, 0, 0))
+	store.Close()
+
+	// a is damaged, b is too but keeps its mtime so it isn't hashed again
+	st, err := os.Stat(b)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(a, []byte("aXaa"), 0644))
+	later := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(a, later, later))
+	assert.Nil(t, os.WriteFile(b, []byte("bXbb"), 0644))
+	assert.Nil(t, os.Chtimes(b, st.ModTime(), st.ModTime()))
+
+	store, up, _, err = tf.openWithProgress(dir)
+	assert.Nil(t, err)
+	assert.False(t, up.HasPiece(0))
+	assert.True(t, up.HasPiece(1))
+	store.Close()
+}
@@ -0,0 +1,62 @@
+package torrentfile
+
+import (
+	"context"
+	"log"
+)
+
+// Seed serves the data at path with the default settings
+func (t *TorrentFile) Seed(path string) error {
+	return t.SeedWith(context.Background(), path, Settings{})
+}
+
+// SeedWith serves the data at path (laid out as DownloadToFile would write it)
+// to the swarm, only pieces matching their hash are offered. It runs until ctx
+// is done, or listening or announcing fails
+func (t *TorrentFile) SeedWith(ctx context.Context, path string, settings Settings) error {
+	if len(t.PieceHashes) == 0 {
+		return ErrV2Only
+	}
+	store, up, _, err := t.openWithProgress(path)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	log.Printf("Seeding %s: %d bytes missing\n", t.Name, up.Left())
+
+	up.Limiter = settings.UploadLimiter
+	peerID, stopServing, err := settings.serve(up)
+	defer stopServing()
+	if err != nil {
+		return err
+	}
+
+	// let the trackers know we are here, peers will come to us
+	session := t.NewTrackerSession(peerID, settings.port(), func() AnnounceStats {
+		return AnnounceStats{Uploaded: up.Uploaded(), Left: up.Left()}
+	})
+	_, newPeers, session, err := t.startDiscovery(ctx, session, settings)
+	if err != nil {
+		return err
+	}
+	if session != nil {
+		defer session.Stop()
+	}
+
+	var reporter *progressReporter
+	if settings.OnProgress != nil {
+		reporter = newProgressReporter(settings.OnProgress, up, len(t.PieceHashes), func() (int64, int) {
+			return 0, 0
+		})
+		reporter.start()
+		defer reporter.stopReports()
+	}
+	for {
+		select {
+		case <-newPeers:
+			// we only wait for incoming peers
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/brkss/btorrent/src/peer"
+)
+
+const (
+	DEFAULT_ANNOUNCE_INTERVAL = time.Minute * 30 // used when the tracker gives no interval
+	MIN_ANNOUNCE_INTERVAL     = time.Minute      // never hammer a tracker more often than this
+	STOPPED_TIMEOUT           = time.Second * 10 // don't hang on exit waiting for the stopped announce
+)
+
+// AnnounceStats are the byte counters reported to trackers
+type AnnounceStats struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+}
+
+// TrackerSession keeps announcing a torrent to its trackers for as long as
+// it runs, peers found on re-announce are sent on Peers
+type TrackerSession struct {
+	Peers chan []peer.Peer
+
+	t         *TorrentFile
+	peerID    [20]byte
+	port      uint16
+	stats     func() AnnounceStats
+	completed chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	once      sync.Once
+	unsent    string // event run was still retrying when it stopped, read once done is closed
+}
+
+// NewTrackerSession creates a session, stats is called before every announce
+func (t *TorrentFile) NewTrackerSession(peerID [20]byte, port uint16, stats func() AnnounceStats) *TrackerSession {
+	return &TrackerSession{
+		Peers:     make(chan []peer.Peer),
+		t:         t,
+		peerID:    peerID,
+		port:      port,
+		stats:     stats,
+		completed: make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (s *TrackerSession) announce(event string) (*announceResponse, error) {
+	stats := s.stats()
+	return s.t.announce(context.Background(), announceRequest{
+		PeerID:     s.peerID,
+		Port:       s.port,
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Left:       stats.Left,
+		Event:      event,
+	})
+}
+
+// next returns when to announce again according to the tracker
+func (res *announceResponse) next() time.Duration {
+	interval := DEFAULT_ANNOUNCE_INTERVAL
+	if res.Interval > 0 {
+		interval = time.Duration(res.Interval) * time.Second
+	}
+	if minInterval := time.Duration(res.MinInterval) * time.Second; interval < minInterval {
+		interval = minInterval
+	}
+	if interval < MIN_ANNOUNCE_INTERVAL {
+		interval = MIN_ANNOUNCE_INTERVAL
+	}
+	return interval
+}
+
+// Start sends the started announce and keeps re-announcing in the background,
+// the peers of the first announce are returned directly
+func (s *TrackerSession) Start() ([]peer.Peer, error) {
+	res, err := s.announce(EventStarted)
+	if err != nil {
+		close(s.done)
+		return nil, fmt.Errorf("%w: %s", ErrTrackerUnreachable, err)
+	}
+	go s.run(res.next())
+	return res.Peers, nil
+}
+
+// startSession is s.Start giving up with ctx.Err() once ctx is done, the
+// session is stopped as soon as the pending announce completes
+func startSession(ctx context.Context, s *TrackerSession) ([]peer.Peer, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	type started struct {
+		peers []peer.Peer
+		err   error
+	}
+	result := make(chan started, 1)
+	go func() {
+		peers, err := s.Start()
+		result <- started{peers, err}
+	}()
+	select {
+	case r := <-result:
+		return r.peers, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-result; r.err == nil {
+				s.Stop()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *TrackerSession) run(interval time.Duration) {
+	pending := EventNone // a completed event that failed is retried on the next announce
+	defer close(s.done)
+	defer func() { s.unsent = pending }()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		event := pending
+		select {
+		case <-s.stop:
+			return
+		case <-s.completed:
+			event = EventCompleted
+		case <-timer.C:
+		}
+
+		res, err := s.announce(event)
+		if err != nil {
+			log.Printf("re-announce failed: %s\n", err)
+			pending = event
+		} else {
+			pending = EventNone
+			interval = res.next()
+			select {
+			case s.Peers <- res.Peers:
+			case <-s.stop:
+				return
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Completed tells the trackers we finished downloading, only the first call counts
+func (s *TrackerSession) Completed() {
+	s.once.Do(func() {
+		s.completed <- struct{}{}
+	})
+}
+
+// Stop stops re-announcing and sends the stopped announce, preceded by the
+// completed one when it wasn't sent yet
+func (s *TrackerSession) Stop() {
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+	close(s.stop)
+	<-s.done
+	completed := s.unsent == EventCompleted
+	select {
+	case <-s.completed:
+		completed = true
+	default:
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		if completed {
+			_, err := s.announce(EventCompleted)
+			if err != nil {
+				log.Printf("completed announce failed: %s\n", err)
+			}
+		}
+		_, err := s.announce(EventStopped)
+		if err != nil {
+			log.Printf("stopped announce failed: %s\n", err)
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(STOPPED_TIMEOUT):
+	}
+}
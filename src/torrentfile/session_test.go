@@ -0,0 +1,79 @@
+package torrentfile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackerSessionEvents(t *testing.T) {
+	var mu sync.Mutex
+	var events, downloaded []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		downloaded = append(downloaded, r.URL.Query().Get("downloaded"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali900e12:min intervali60e5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE1}) + "e"))
+	}))
+	defer ts.Close()
+
+	tf := TorrentFile{Announce: ts.URL, Length: 100}
+	var stats AnnounceStats
+	s := tf.NewTrackerSession([20]byte{1}, 6881, func() AnnounceStats {
+		return stats
+	})
+	peers, err := s.Start()
+	assert.Nil(t, err)
+	assert.Len(t, peers, 1)
+
+	stats = AnnounceStats{Downloaded: 100}
+	s.Completed()
+	assert.Len(t, <-s.Peers, 1)
+	s.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{EventStarted, EventCompleted, EventStopped}, events)
+	assert.Equal(t, []string{"0", "100", "100"}, downloaded)
+}
+
+func TestTrackerSessionCompletedThenStopped(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	// stopping right after completing, as a finished download does, still
+	// tells the trackers it completed
+	for i := 0; i < 20; i++ {
+		mu.Lock()
+		events = nil
+		mu.Unlock()
+		tf := TorrentFile{Announce: ts.URL, Length: 100}
+		s := tf.NewTrackerSession([20]byte{1}, 6881, func() AnnounceStats { return AnnounceStats{} })
+		_, err := s.Start()
+		assert.Nil(t, err)
+		s.Completed()
+		s.Stop()
+
+		mu.Lock()
+		assert.Equal(t, []string{EventStarted, EventCompleted, EventStopped}, events)
+		mu.Unlock()
+	}
+}
+
+func TestAnnounceResponseNext(t *testing.T) {
+	assert.Equal(t, DEFAULT_ANNOUNCE_INTERVAL, (&announceResponse{}).next())
+	assert.Equal(t, MIN_ANNOUNCE_INTERVAL, (&announceResponse{Interval: 5}).next())
+	assert.Equal(t, 900*time.Second, (&announceResponse{Interval: 600, MinInterval: 900}).next())
+}
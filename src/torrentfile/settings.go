@@ -0,0 +1,48 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+
+	"github.com/brkss/btorrent/src/dht"
+	"github.com/brkss/btorrent/src/ratelimit"
+	"github.com/brkss/btorrent/src/upload"
+)
+
+// Settings tune DownloadWith and SeedWith, the zero value gives the defaults
+type Settings struct {
+	Port            uint16             // announced to trackers and listened on, PORT when 0
+	MaxPeers        int                // peers we download from at once, no limit when 0
+	DownloadLimiter *ratelimit.Limiter // optional, may be shared by several torrents
+	UploadLimiter   *ratelimit.Limiter // optional, may be shared by several torrents
+	MaxConnections  int                // incoming peers at once when not using Server, see upload.Server
+	Server          *upload.Server     // optional, already listening on Port, shared by several torrents
+	OnProgress      func(Progress)     // optional, called every PROGRESS_INTERVAL and for every piece
+	DHT             *dht.Server        // optional, peers are also looked up and announced there
+}
+
+func (s Settings) port() uint16 {
+	if s.Port == 0 {
+		return PORT
+	}
+	return s.Port
+}
+
+// serve makes up available to incoming peers, through the shared server when
+// there is one or a server of its own otherwise. The returned peer id is the
+// one to announce and stop must be called once done, even on error
+func (s Settings) serve(up *upload.Torrent) (peerID [20]byte, stop func(), err error) {
+	if s.Server != nil {
+		s.Server.Add(up)
+		return s.Server.PeerID, func() { s.Server.Remove(up.InfoHash) }, nil
+	}
+
+	_, err = rand.Read(peerID[:])
+	if err != nil {
+		return peerID, func() {}, err
+	}
+	server := upload.NewServer(peerID)
+	server.MaxConnections = s.MaxConnections
+	server.Add(up)
+	err = server.Listen(s.port())
+	return peerID, func() { server.Close() }, err
+}
@@ -2,76 +2,257 @@ package torrentfile
 
 import (
 	"bytes"
-	"crypto/rand"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/brkss/btorrent/src/bencode"
 	"github.com/brkss/btorrent/src/p2p"
-	"github.com/jackpal/bencode-go"
+	"github.com/brkss/btorrent/src/storage"
 )
 
 const PORT uint16 = 6881
 
+var (
+	// ErrV2Only is returned when transferring a torrent that has no v1 pieces,
+	// only the metadata of v2 only torrents can be used for now
+	ErrV2Only = errors.New("v2 only torrents can't be transferred yet")
+	// ErrTrackerUnreachable is returned when no tracker answered our first announce
+	ErrTrackerUnreachable = errors.New("no tracker could be reached")
+	// ErrNoPeers is returned when a magnet link leads to no peer at all
+	ErrNoPeers = errors.New("no peers found")
+	// ErrMetadataUnavailable is returned when no peer gave us the info dictionary of a magnet link
+	ErrMetadataUnavailable = errors.New("could not fetch metadata")
+)
+
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+	Announce     string
+	AnnounceList [][]string // tracker tiers (BEP 12), Announce is ignored when set
+	InfoHash     [20]byte
+	InfoBytes    []byte   // the info dictionary exactly as bencoded in the torrent, InfoHash is its hash
+	InfoHashV2   [32]byte // SHA-256 of InfoBytes for v2 and hybrid torrents (BEP 52), zero otherwise
+	MetaVersion  int      // 2 for v2 and hybrid torrents, 1 otherwise
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Files        []File // empty for single file torrents
+
+	Private      bool   // peers only come from the trackers (BEP 27)
+	Source       string // tags the torrent for a tracker, part of the infohash
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // zero when unknown
+	Encoding     string    // of the strings of the info dictionary, UTF-8 when empty
+	URLList      []string  // web seeds (BEP 19)
+	HTTPSeeds    []string  // web seeds (BEP 17)
+	Nodes        []string  // DHT nodes to bootstrap from, as host:port
+}
+
+// AllowsPeerDiscovery reports whether peers may be found other than through
+// the trackers: DHT, peer exchange and local discovery must stay off for
+// private torrents so they only ever talk to the tracker's swarm
+func (t *TorrentFile) AllowsPeerDiscovery() bool {
+	return !t.Private
+}
+
+// File is one file of a multi-file torrent, Path is relative to the torrent Name.
+// Pad files (BEP 47) only align the next file on a piece boundary and are never written
+type File struct {
+	Length int
+	Path   []string
+	Pad    bool
+}
+
+type bencodeFile struct {
+	Attr   string   `bencode:"attr,omitempty"`
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 type bencodeInfo struct {
-	Pieces       string `bencode:"pieces"`
-	PiecesLength int    `bencode:"piece length"`
-	Length       int    `bencode:"length"`
-	Name         string `bencode:"name"`
+	Pieces       string        `bencode:"pieces"`
+	PiecesLength int           `bencode:"piece length"`
+	Length       int           `bencode:"length,omitempty"`
+	Files        []bencodeFile `bencode:"files,omitempty"`
+	Name         string        `bencode:"name"`
+	Private      int           `bencode:"private,omitempty"`
+	Source       string        `bencode:"source,omitempty"`
+	MetaVersion  int           `bencode:"meta version,omitempty"`
+	FileTree     interface{}   `bencode:"file tree,omitempty"`
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string             `bencode:"announce"`
+	AnnounceList [][]string         `bencode:"announce-list"`
+	Info         bencode.RawMessage `bencode:"info"` // hashed as is, keys we don't know included
+	Comment      string             `bencode:"comment"`
+	CreatedBy    string             `bencode:"created by"`
+	CreationDate interface{}        `bencode:"creation date"` // an integer, ignored otherwise
+	Encoding     string             `bencode:"encoding"`
+	URLList      interface{}        `bencode:"url-list"`  // a single URL or a list of them
+	HTTPSeeds    interface{}        `bencode:"httpseeds"` // a single URL or a list of them
+	Nodes        interface{}        `bencode:"nodes"`     // a list of [host, port] pairs
+}
+
+// stringList accepts a single string or a list of strings, like url-list
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, elem := range v {
+			if s, ok := elem.(string); ok && s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// nodeList formats the valid [host, port] pairs of nodes as host:port
+func nodeList(v interface{}) []string {
+	nodes, _ := v.([]interface{})
+	var list []string
+	for _, elem := range nodes {
+		node, ok := elem.([]interface{})
+		if !ok || len(node) != 2 {
+			continue
+		}
+		host, ok := node[0].(string)
+		port, ok2 := node[1].(int64)
+		if !ok || !ok2 || host == "" || port <= 0 || port > 65535 {
+			continue
+		}
+		list = append(list, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+	return list
+}
+
+// storage opens the storage for the torrent, single file torrents are written
+// to path, multi-file torrents to a directory tree under path/Name
+func (t *TorrentFile) storage(path string) (storage.Storage, error) {
+	if len(t.Files) == 0 {
+		return storage.NewFile(path, int64(t.Length))
+	}
+	return storage.NewMultiFile(t.storageEntries(path))
 }
 
+// DownloadToFile downloads the torrent into path with the default settings
 func (t *TorrentFile) DownloadToFile(path string) error {
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+	return t.DownloadWith(context.Background(), path, Settings{})
+}
+
+// DownloadWith downloads the torrent into path, see storage() for the layout.
+// Progress is saved next to it so an interrupted download continues where it
+// stopped, which is also what happens when ctx is done
+func (t *TorrentFile) DownloadWith(ctx context.Context, path string, settings Settings) error {
+	if len(t.PieceHashes) == 0 {
+		return ErrV2Only
+	}
+	store, up, progress, err := t.openWithProgress(path)
 	if err != nil {
-		return nil
+		return err
 	}
+	defer store.Close()
 
-	peers, err := t.requestPeers(peerID, PORT)
+	up.Limiter = settings.UploadLimiter
+	peerID, stopServing, err := settings.serve(up)
 	if err != nil {
-		return err
+		log.Printf("could not listen on port %d, not uploading: %s\n", settings.port(), err)
 	}
+	defer stopServing()
 
 	torrent := p2p.Torrent{
-		Peers:       peers,
 		PeerID:      peerID,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		Storage:     store,
+		Upload:      up,
+		Completed:   up.Bitfield(),
+		MaxPeers:    settings.MaxPeers,
+		Limiter:     settings.DownloadLimiter,
 	}
 
-	buf, err := torrent.Download()
-	if err != nil {
-		return err
+	var reporter *progressReporter
+	if settings.OnProgress != nil {
+		reporter = newProgressReporter(settings.OnProgress, up, len(t.PieceHashes), func() (int64, int) {
+			return torrent.Downloaded(), torrent.ConnectedPeers()
+		})
+		torrent.OnPiece = reporter.send
+		reporter.start()
+		defer reporter.stopReports()
+	}
+
+	save := func() {
+		err := t.saveResume(path, up, progress.Uploaded+up.Uploaded(), progress.Downloaded+torrent.Downloaded())
+		if err != nil {
+			log.Printf("could not save progress: %s\n", err)
+		}
 	}
+	stopSaving := make(chan struct{})
+	savingDone := make(chan struct{})
+	go func() {
+		defer close(savingDone)
+		ticker := time.NewTicker(RESUME_SAVE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-stopSaving:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stopSaving)
+		<-savingDone
+		save()
+	}()
 
-	outFile, err := os.Create(path)
+	session := t.NewTrackerSession(peerID, settings.port(), func() AnnounceStats {
+		return AnnounceStats{
+			Uploaded:   up.Uploaded(),
+			Downloaded: torrent.Downloaded(),
+			Left:       up.Left(),
+		}
+	})
+	discoveryCtx, stopDiscovery := context.WithCancel(ctx)
+	defer stopDiscovery()
+	torrent.Peers, torrent.NewPeers, session, err = t.startDiscovery(discoveryCtx, session, settings)
 	if err != nil {
 		return err
 	}
+	if session != nil {
+		defer session.Stop()
+	}
 
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
+	err = torrent.DownloadContext(ctx)
 	if err != nil {
 		return err
 	}
-
+	reporter.send(-1)
+	if session != nil {
+		session.Completed()
+	}
 	return nil
 }
 
@@ -90,16 +271,6 @@ func Open(path string) (TorrentFile, error) {
 	return bto.toTorrentFile()
 }
 
-func (b *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *b)
-	if err != nil {
-		return [20]byte{}, err
-	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
-}
-
 func (b *bencodeInfo) splitPieceHash() ([][20]byte, error) {
 	hashlen := 20
 	buf := []byte(b.Pieces)
@@ -113,26 +284,167 @@ func (b *bencodeInfo) splitPieceHash() ([][20]byte, error) {
 	for i := 0; i < numHashes; i++ {
 		copy(hashes[i][:], buf[(i*hashlen):(i+1)*hashlen])
 	}
-	fmt.Println("hashes length : ", len(hashes))
 	return hashes, nil
 }
 
+// validPathElem refuses path elements that could escape the download directory
+func validPathElem(elem string) bool {
+	if elem == "" || elem == "." || elem == ".." {
+		return false
+	}
+	return !strings.ContainsAny(elem, "/\\\x00")
+}
+
+// fileTree lists the files of a v2 file tree (BEP 52) in order, a tree
+// holding only a file called name is a single file torrent
+func fileTree(tree interface{}, name string) ([]File, int, error) {
+	root, ok := tree.(map[string]interface{})
+	if !ok {
+		return nil, 0, fmt.Errorf("torrent has neither pieces nor a file tree")
+	}
+	var files []File
+	length := 0
+	var walk func(node map[string]interface{}, path []string) error
+	walk = func(node map[string]interface{}, path []string) error {
+		keys := make([]string, 0, len(node))
+		for k := range node {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child, ok := node[k].(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("invalid file tree entry %q", k)
+			}
+			if k == "" {
+				size, ok := child["length"].(int64)
+				if !ok || size < 0 || len(path) == 0 {
+					return fmt.Errorf("invalid file %q in file tree", strings.Join(path, "/"))
+				}
+				files = append(files, File{Length: int(size), Path: append([]string{}, path...)})
+				length += int(size)
+				continue
+			}
+			if !validPathElem(k) {
+				return fmt.Errorf("file tree has invalid path element %q", k)
+			}
+			err := walk(child, append(path, k))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(root, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == name {
+		return nil, length, nil
+	}
+	return files, length, nil
+}
+
+func (b *bencodeInfo) files() ([]File, int, error) {
+	if len(b.Files) == 0 {
+		return nil, b.Length, nil
+	}
+	files := make([]File, len(b.Files))
+	length := 0
+	for i, f := range b.Files {
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("file #%d has negative length %d", i, f.Length)
+		}
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("file #%d has an empty path", i)
+		}
+		for _, elem := range f.Path {
+			if !validPathElem(elem) {
+				return nil, 0, fmt.Errorf("file #%d has invalid path element %q", i, elem)
+			}
+		}
+		files[i] = File{Length: f.Length, Path: f.Path, Pad: strings.Contains(f.Attr, "p")}
+		length += f.Length
+	}
+	return files, length, nil
+}
+
+// checkPieceLayout makes sure the pieces cover the data exactly, pieces are
+// cut and checked relying on it
+func (t *TorrentFile) checkPieceLayout() error {
+	if t.PieceLength <= 0 {
+		return fmt.Errorf("invalid piece length %d", t.PieceLength)
+	}
+	if want := (t.Length + t.PieceLength - 1) / t.PieceLength; len(t.PieceHashes) > 0 && len(t.PieceHashes) != want {
+		return fmt.Errorf("torrent has %d piece hashes for %d pieces", len(t.PieceHashes), want)
+	}
+	return nil
+}
+
 func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
+	if len(bto.Info) == 0 {
+		return TorrentFile{}, fmt.Errorf("torrent has no info dictionary")
+	}
+	info := bencodeInfo{}
+	err := bencode.Unmarshal(bytes.NewReader(bto.Info), &info)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	pieceHashes, err := info.splitPieceHash()
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	pieceHashes, err := bto.Info.splitPieceHash()
+	files, length, err := info.files()
 	if err != nil {
 		return TorrentFile{}, err
 	}
+	if !validPathElem(info.Name) {
+		return TorrentFile{}, fmt.Errorf("invalid torrent name %q", info.Name)
+	}
+	var tiers [][]string
+	for _, tier := range bto.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, append([]string{}, tier...))
+		}
+	}
+	shuffleTiers(tiers)
 	t := TorrentFile{
-		Announce:    bto.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PiecesLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+		Announce:     bto.Announce,
+		AnnounceList: tiers,
+		InfoHash:     sha1.Sum(bto.Info),
+		InfoBytes:    bto.Info,
+		PieceHashes:  pieceHashes,
+		PieceLength:  info.PiecesLength,
+		Length:       length,
+		Name:         info.Name,
+		Files:        files,
+		Private:      info.Private == 1,
+		Source:       info.Source,
+		Comment:      bto.Comment,
+		CreatedBy:    bto.CreatedBy,
+		Encoding:     bto.Encoding,
+		URLList:      stringList(bto.URLList),
+		HTTPSeeds:    stringList(bto.HTTPSeeds),
+		Nodes:        nodeList(bto.Nodes),
+	}
+	if date, ok := bto.CreationDate.(int64); ok && date > 0 {
+		t.CreationDate = time.Unix(date, 0)
+	}
+	err = t.checkPieceLayout()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	t.MetaVersion = 1
+	if info.MetaVersion == 2 {
+		t.MetaVersion = 2
+		t.InfoHashV2 = sha256.Sum256(bto.Info)
+		if len(pieceHashes) == 0 {
+			// v2 only, the files are only listed in the file tree
+			t.Files, t.Length, err = fileTree(info.FileTree, info.Name)
+			if err != nil {
+				return TorrentFile{}, err
+			}
+		}
 	}
 	return t, nil
 }
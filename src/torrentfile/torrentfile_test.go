@@ -0,0 +1,187 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTorrent(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	err := os.WriteFile(path, []byte(content), 0644)
+	assert.Nil(t, err)
+	return path
+}
+
+func TestOpenMultiFile(t *testing.T) {
+	path := writeTorrent(t, "d"+
+		"8:announce"+"23:http://tracker/announce"+
+		"4:info"+"d"+
+		"5:files"+"l"+
+		"d6:lengthi3e4:pathl5:a.txteed6:lengthi5e4:pathl3:sub5:b.txtee"+
+		"e"+
+		"4:name"+"3:dir"+
+		"12:piece length"+"i4e"+
+		"6:pieces"+"40:"+strings.Repeat("x", 40)+
+		"e"+
+		"e")
+	tf, err := Open(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, tf.Length)
+	assert.Equal(t, "dir", tf.Name)
+	assert.Equal(t, []File{
+		{Length: 3, Path: []string{"a.txt"}},
+		{Length: 5, Path: []string{"sub", "b.txt"}},
+	}, tf.Files)
+	assert.Len(t, tf.PieceHashes, 2)
+}
+
+func TestOpenRejectsPathTraversal(t *testing.T) {
+	path := writeTorrent(t, "d"+
+		"4:info"+"d"+
+		"5:files"+"l"+"d6:lengthi3e4:pathl2:..6:passwdee"+"e"+
+		"4:name"+"3:dir"+
+		"12:piece length"+"i4e"+
+		"6:pieces"+"20:"+strings.Repeat("x", 20)+
+		"e"+
+		"e")
+	_, err := Open(path)
+	assert.NotNil(t, err)
+}
+
+func TestOpenRejectsBadPieces(t *testing.T) {
+	torrent := func(pieceLength int, hashes int) string {
+		return "d4:infod" +
+			"6:lengthi100e" +
+			"4:name1:a" +
+			"12:piece lengthi" + strconv.Itoa(pieceLength) + "e" +
+			"6:pieces" + strconv.Itoa(20*hashes) + ":" + strings.Repeat("x", 20*hashes) +
+			"ee"
+	}
+	_, err := Open(writeTorrent(t, torrent(16, 7)))
+	assert.Nil(t, err)
+	_, err = Open(writeTorrent(t, torrent(0, 1)))
+	assert.NotNil(t, err)
+	_, err = Open(writeTorrent(t, torrent(16, 1)))
+	assert.NotNil(t, err)
+	_, err = Open(writeTorrent(t, torrent(16, 8)))
+	assert.NotNil(t, err)
+}
+
+func TestOpenHashesRawInfo(t *testing.T) {
+	// keys we don't decode still count in the infohash
+	info := "d" +
+		"6:lengthi8e" +
+		"6:md5sum32:" + strings.Repeat("0", 32) +
+		"4:name" + "4:file" +
+		"12:piece length" + "i4e" +
+		"6:pieces" + "40:" + strings.Repeat("x", 40) +
+		"7:private" + "i1e" +
+		"6:source" + "3:abc" +
+		"e"
+	path := writeTorrent(t, "d"+
+		"8:announce"+"23:http://tracker/announce"+
+		"4:info"+info+
+		"e")
+	tf, err := Open(path)
+	assert.Nil(t, err)
+	assert.Equal(t, sha1.Sum([]byte(info)), tf.InfoHash)
+	assert.Equal(t, []byte(info), tf.InfoBytes)
+}
+
+func TestOpenMetadata(t *testing.T) {
+	path := writeTorrent(t, "d"+
+		"8:announce"+"23:http://tracker/announce"+
+		"7:comment"+"5:hello"+
+		"10:created by"+"8:btorrent"+
+		"13:creation date"+"i1700000000e"+
+		"8:encoding"+"5:UTF-8"+
+		"9:httpseeds"+"l"+"14:http://seed/hs"+"e"+
+		"4:info"+"d"+
+		"6:lengthi8e"+
+		"4:name"+"4:file"+
+		"12:piece length"+"i4e"+
+		"6:pieces"+"40:"+strings.Repeat("x", 40)+
+		"7:private"+"i1e"+
+		"6:source"+"3:abc"+
+		"e"+
+		"5:nodes"+"l"+"l9:127.0.0.1i6881ee"+"l3:::1i0ee"+"e"+
+		"8:url-list"+"14:http://mirror/"+
+		"e")
+	tf, err := Open(path)
+	assert.Nil(t, err)
+	assert.True(t, tf.Private)
+	assert.False(t, tf.AllowsPeerDiscovery())
+	assert.Equal(t, "abc", tf.Source)
+	assert.Equal(t, "hello", tf.Comment)
+	assert.Equal(t, "btorrent", tf.CreatedBy)
+	assert.Equal(t, int64(1700000000), tf.CreationDate.Unix())
+	assert.Equal(t, "UTF-8", tf.Encoding)
+	assert.Equal(t, []string{"http://mirror/"}, tf.URLList)
+	assert.Equal(t, []string{"http://seed/hs"}, tf.HTTPSeeds)
+	assert.Equal(t, []string{"127.0.0.1:6881"}, tf.Nodes)
+}
+
+func TestOpenMalformedMetadata(t *testing.T) {
+	path := writeTorrent(t, "d"+
+		"8:announce"+"23:http://tracker/announce"+
+		"13:creation date"+"5:today"+
+		"9:httpseeds"+"14:http://seed/hs"+
+		"4:info"+"d"+
+		"6:lengthi8e"+
+		"4:name"+"4:file"+
+		"12:piece length"+"i4e"+
+		"6:pieces"+"40:"+strings.Repeat("x", 40)+
+		"e"+
+		"5:nodes"+"l"+"9:127.0.0.1"+"l9:127.0.0.1i6881ee"+"e"+
+		"e")
+	tf, err := Open(path)
+	assert.Nil(t, err)
+	assert.True(t, tf.CreationDate.IsZero())
+	assert.Equal(t, []string{"http://seed/hs"}, tf.HTTPSeeds)
+	assert.Equal(t, []string{"127.0.0.1:6881"}, tf.Nodes)
+
+	path = writeTorrent(t, "d"+
+		"8:announce"+"23:http://tracker/announce"+
+		"9:httpseeds"+"i1e"+
+		"4:info"+"d"+
+		"6:lengthi8e"+
+		"4:name"+"4:file"+
+		"12:piece length"+"i4e"+
+		"6:pieces"+"40:"+strings.Repeat("x", 40)+
+		"e"+
+		"5:nodes"+"5:nodes"+
+		"e")
+	tf, err = Open(path)
+	assert.Nil(t, err)
+	assert.Nil(t, tf.HTTPSeeds)
+	assert.Nil(t, tf.Nodes)
+}
+
+func TestStringList(t *testing.T) {
+	assert.Equal(t, []string{"a"}, stringList("a"))
+	assert.Equal(t, []string{"a", "b"}, stringList([]interface{}{"a", int64(1), "b"}))
+	assert.Nil(t, stringList(nil))
+}
+
+func TestFileTree(t *testing.T) {
+	file := func(n int64) map[string]interface{} {
+		return map[string]interface{}{"": map[string]interface{}{"length": n}}
+	}
+	tree := map[string]interface{}{
+		"b.txt": file(2),
+		"a":     map[string]interface{}{"x": file(1)},
+	}
+	files, length, err := fileTree(tree, "dir")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, length)
+	assert.Equal(t, []File{{Length: 1, Path: []string{"a", "x"}}, {Length: 2, Path: []string{"b.txt"}}}, files)
+
+	_, _, err = fileTree(map[string]interface{}{"..": file(1)}, "dir")
+	assert.NotNil(t, err)
+}
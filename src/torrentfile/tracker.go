@@ -1,57 +1,263 @@
 package torrentfile
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/brkss/btorrent/src/bencode"
 	"github.com/brkss/btorrent/src/peer"
-	"github.com/jackpal/bencode-go"
+)
+
+const (
+	TIERS_TIMEOUT        = time.Second * 30 // how long an announce waits for slow tiers once it has some peers
+	ANNOUNCE_TIMEOUT     = time.Minute      // how long an announce waits for any tier to answer
+	MAX_TRACKER_RESPONSE = 2 << 20          // bytes of an HTTP tracker response we read, 300k compact peers fit
+)
+
+// promotions of trackers inside tiers may come from several announces at once
+var tiersMu sync.Mutex
+
+// announce events, the empty event is a regular re-announce
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
 )
 
 type bencodeTrackerRsp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason string `bencode:"failure reason"`
+	Interval      int    `bencode:"interval"`
+	MinInterval   int    `bencode:"min interval"`
+	Peers         string `bencode:"peers"`
+}
+
+// announceRequest is what we tell the tracker about ourselves
+type announceRequest struct {
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+}
+
+// announceResponse is what the tracker tells us back, intervals are in seconds
+type announceResponse struct {
+	Interval    int
+	MinInterval int
+	Peers       []peer.Peer
 }
 
-func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
-	base, err := url.Parse(t.Announce)
+func (t *TorrentFile) buildTrackerURL(announce string, req announceRequest) (string, error) {
+	base, err := url.Parse(announce)
 	if err != nil {
 		return "", err
 	}
 
 	params := url.Values{
 		"info_hash":  []string{string(t.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"peer_id":    []string{string(req.PeerID[:])},
+		"port":       []string{strconv.Itoa(int(req.Port))},
+		"uploaded":   []string{strconv.FormatInt(req.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(req.Downloaded, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.Length)},
+		"left":       []string{strconv.FormatInt(req.Left, 10)},
+	}
+	if req.Event != EventNone {
+		params.Set("event", req.Event)
 	}
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peer.Peer, error) {
-	url, err := t.buildTrackerURL(peerID, port)
+// trackerTiers returns the announce-list tiers, or Announce alone if the torrent has none
+func (t *TorrentFile) trackerTiers() [][]string {
+	if len(t.AnnounceList) > 0 {
+		return t.AnnounceList
+	}
+	if t.Announce == "" {
+		return nil
+	}
+	return [][]string{{t.Announce}}
+}
+
+// shuffleTiers randomizes the order of trackers inside every tier (BEP 12)
+func shuffleTiers(tiers [][]string) {
+	for _, tier := range tiers {
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+	}
+}
+
+// announceTier tries the trackers of a tier in order, the first that answers
+// is moved to the front of the tier so it is tried first next time
+func (t *TorrentFile) announceTier(ctx context.Context, tier []string, req announceRequest) (*announceResponse, error) {
+	tiersMu.Lock()
+	trackers := append([]string{}, tier...)
+	tiersMu.Unlock()
+
+	var err error
+	for _, tracker := range trackers {
+		var res *announceResponse
+		res, err = t.announceTo(ctx, tracker, req)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("tracker %s failed: %s\n", tracker, err)
+			continue
+		}
+		tiersMu.Lock()
+		for i, tr := range tier {
+			if tr == tracker {
+				copy(tier[1:i+1], tier[0:i])
+				tier[0] = tracker
+				break
+			}
+		}
+		tiersMu.Unlock()
+		return res, nil
+	}
+	return nil, err
+}
+
+// announce announces to every tier at once and merges the answers of all the
+// tiers that respond, the shortest interval wins so no tier is announced late.
+// Tiers still silent after ANNOUNCE_TIMEOUT are left behind, all of them once ctx is done
+func (t *TorrentFile) announce(ctx context.Context, req announceRequest) (*announceResponse, error) {
+	tiers := t.trackerTiers()
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("torrent has no tracker")
+	}
+
+	type tierResult struct {
+		res *announceResponse
+		err error
+	}
+	results := make(chan tierResult, len(tiers))
+	for _, tier := range tiers {
+		go func(tier []string) {
+			res, err := t.announceTier(ctx, tier, req)
+			results <- tierResult{res, err}
+		}(tier)
+	}
+
+	var merged *announceResponse
+	var lastErr error
+	seen := make(map[string]bool)
+	var timeout <-chan time.Time
+	deadline := time.After(ANNOUNCE_TIMEOUT)
+	for pending := len(tiers); pending > 0; pending-- {
+		var r tierResult
+		select {
+		case r = <-results:
+		case <-timeout:
+			return merged, nil
+		case <-deadline:
+			if merged != nil {
+				return merged, nil
+			}
+			return nil, fmt.Errorf("no tracker answered within %s", ANNOUNCE_TIMEOUT)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if merged == nil {
+			merged = &announceResponse{Interval: r.res.Interval, MinInterval: r.res.MinInterval}
+			timeout = time.After(TIERS_TIMEOUT)
+		}
+		if r.res.Interval > 0 && (merged.Interval <= 0 || r.res.Interval < merged.Interval) {
+			merged.Interval = r.res.Interval
+		}
+		if r.res.MinInterval > merged.MinInterval {
+			merged.MinInterval = r.res.MinInterval
+		}
+		for _, p := range r.res.Peers {
+			if !seen[p.String()] {
+				seen[p.String()] = true
+				merged.Peers = append(merged.Peers, p)
+			}
+		}
+	}
+	if merged == nil {
+		return nil, lastErr
+	}
+	return merged, nil
+}
+
+// requestPeers does a one-shot announce and returns the peers every tier gave us
+func (t *TorrentFile) requestPeers(ctx context.Context, peerID [20]byte, port uint16) ([]peer.Peer, error) {
+	res, err := t.announce(ctx, announceRequest{PeerID: peerID, Port: port, Left: int64(t.Length)})
+	if err != nil {
+		return nil, err
+	}
+	return res.Peers, nil
+}
+
+// announceTo announces to a single tracker, picking the protocol from the URL scheme
+func (t *TorrentFile) announceTo(ctx context.Context, announce string, req announceRequest) (*announceResponse, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch base.Scheme {
+	case "http", "https":
+		return t.announceHTTP(ctx, announce, req)
+	case "udp":
+		return t.announceUDP(ctx, announce, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", base.Scheme)
+	}
+}
+
+func (t *TorrentFile) announceHTTP(ctx context.Context, announce string, req announceRequest) (*announceResponse, error) {
+	url, err := t.buildTrackerURL(announce, req)
 	if err != nil {
 		return nil, err
 	}
 
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
 	c := http.Client{Timeout: time.Second * 15}
-	resp, err := c.Get(url)
+	resp, err := c.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	trackerResp := bencodeTrackerRsp{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
+	d := bencode.NewDecoder(io.LimitReader(resp.Body, MAX_TRACKER_RESPONSE))
+	d.MaxStringLength = MAX_TRACKER_RESPONSE
+	err = d.Decode(&trackerResp)
 	if err != nil {
 		return nil, err
 	}
+	if trackerResp.FailureReason != "" {
+		return nil, fmt.Errorf("tracker failure: %s", trackerResp.FailureReason)
+	}
 
-	return peer.Unmarshal([]byte(trackerResp.Peers))
+	peers, err := peer.Unmarshal([]byte(trackerResp.Peers))
+	if err != nil {
+		return nil, err
+	}
+	return &announceResponse{
+		Interval:    trackerResp.Interval,
+		MinInterval: trackerResp.MinInterval,
+		Peers:       peers,
+	}, nil
 }
@@ -1,9 +1,11 @@
 package torrentfile
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
 	"github.com/brkss/btorrent/src/peer"
@@ -24,7 +26,7 @@ func TestBuildTrackerURL(t *testing.T) {
 	}
 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 	const port uint16 = 6882
-	url, err := to.buildTrackerURL(peerID, port)
+	url, err := to.buildTrackerURL(to.Announce, announceRequest{PeerID: peerID, Port: port, Left: int64(to.Length)})
 	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6882&uploaded=0"
 	assert.Nil(t, err)
 	assert.Equal(t, url, expected)
@@ -60,7 +62,52 @@ func TestRequestPeers(t *testing.T) {
 		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
 		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
 	}
-	p, err := tf.requestPeers(peerID, port)
+	p, err := tf.requestPeers(context.Background(), peerID, port)
 	assert.Nil(t, err)
 	assert.Equal(t, expected, p)
 }
+
+func TestRequestPeersTiers(t *testing.T) {
+	serve := func(peers []byte) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("d8:intervali900e5:peers" + strconv.Itoa(len(peers)) + ":" + string(peers) + "e"))
+		}))
+	}
+	first := serve([]byte{192, 0, 2, 1, 0x1A, 0xE1})
+	defer first.Close()
+	second := serve([]byte{192, 0, 2, 1, 0x1A, 0xE1, 192, 0, 2, 2, 0x1A, 0xE1})
+	defer second.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer dead.Close()
+
+	tf := TorrentFile{
+		AnnounceList: [][]string{
+			{dead.URL, first.URL},
+			{"wss://unsupported", second.URL},
+		},
+		Length: 100,
+	}
+	p, err := tf.requestPeers(context.Background(), [20]byte{1}, 6881)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []peer.Peer{
+		{IP: net.IP{192, 0, 2, 1}, Port: 6881},
+		{IP: net.IP{192, 0, 2, 2}, Port: 6881},
+	}, p)
+	// trackers that answered are promoted to the front of their tier
+	assert.Equal(t, []string{first.URL, dead.URL}, tf.AnnounceList[0])
+	assert.Equal(t, []string{second.URL, "wss://unsupported"}, tf.AnnounceList[1])
+}
+
+func TestRequestPeersHugeResponse(t *testing.T) {
+	// a tracker announcing a gigabyte string is cut short, not buffered
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers1073741824:"))
+		w.Write(make([]byte, 1<<16))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL, Length: 100}
+	_, err := tf.announceHTTP(context.Background(), ts.URL, announceRequest{})
+	assert.ErrorContains(t, err, "longer than")
+}
@@ -0,0 +1,300 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/brkss/btorrent/src/peer"
+)
+
+const (
+	udpProtocolID     uint64 = 0x41727101980 // magic constant of the connect request
+	udpConnIDLifetime        = time.Minute   // a connection id can be used for one minute
+)
+
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+// a request is retransmitted after udpTimeout * 2^n, n going from 0 to udpMaxRetries (BEP 15),
+// BEP 15 goes up to 8 retransmissions which is over two hours so fewer are tried here
+var (
+	udpTimeout    = 15 * time.Second
+	udpMaxRetries = 2
+)
+
+type udpConnID struct {
+	id       uint64
+	obtained time.Time
+}
+
+// connection ids are cached per tracker so consecutive announces skip the connect step
+var udpConnIDs = struct {
+	sync.Mutex
+	ids map[string]udpConnID
+}{ids: make(map[string]udpConnID)}
+
+// ScrapeResult hold a tracker's statistics about a torrent
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+type udpTracker struct {
+	host string
+	conn net.Conn
+}
+
+func dialUDPTracker(announce string) (*udpTracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTracker{host: u.Host, conn: conn}, nil
+}
+
+func newTransactionID() (uint32, error) {
+	var buf [4]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+// transact sends the packet built by build until a response to it comes back,
+// build is called before every (re)transmission with a fresh connection id
+func (u *udpTracker) transact(action uint32, build func(txID uint32) ([]byte, error)) ([]byte, error) {
+	for n := 0; n <= udpMaxRetries; n++ {
+		txID, err := newTransactionID()
+		if err != nil {
+			return nil, err
+		}
+		req, err := build(txID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = u.conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+
+		u.conn.SetReadDeadline(time.Now().Add(udpTimeout * time.Duration(1<<n)))
+		res, err := u.readResponse(action, txID)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			continue
+		}
+		return res, err
+	}
+	return nil, fmt.Errorf("udp tracker %s did not answer after %d retransmissions", u.host, udpMaxRetries)
+}
+
+// readResponse reads until a packet matching txID arrives, stray packets are dropped
+func (u *udpTracker) readResponse(action, txID uint32) ([]byte, error) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := u.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != txID {
+			continue
+		}
+		res := buf[:n]
+		gotAction := binary.BigEndian.Uint32(res[0:4])
+		if gotAction == udpActionError {
+			// the error may be about an expired connection id, the next request connects again
+			udpConnIDs.Lock()
+			delete(udpConnIDs.ids, u.host)
+			udpConnIDs.Unlock()
+			return nil, fmt.Errorf("udp tracker error: %s", string(res[8:]))
+		}
+		if gotAction != action {
+			return nil, fmt.Errorf("expected udp tracker action %d got %d", action, gotAction)
+		}
+		return res, nil
+	}
+}
+
+// connectionID returns a valid connection id, connecting to the tracker if the cached one expired
+func (u *udpTracker) connectionID() (uint64, error) {
+	udpConnIDs.Lock()
+	cached, ok := udpConnIDs.ids[u.host]
+	udpConnIDs.Unlock()
+	if ok && time.Since(cached.obtained) < udpConnIDLifetime {
+		return cached.id, nil
+	}
+
+	res, err := u.transact(udpActionConnect, func(txID uint32) ([]byte, error) {
+		req := make([]byte, 16)
+		binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		return req, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(res) < 16 {
+		return 0, fmt.Errorf("udp connect response too short %d < 16", len(res))
+	}
+	id := binary.BigEndian.Uint64(res[8:16])
+
+	udpConnIDs.Lock()
+	udpConnIDs.ids[u.host] = udpConnID{id: id, obtained: time.Now()}
+	udpConnIDs.Unlock()
+	return id, nil
+}
+
+// udpEvents maps announce events to their BEP 15 codes
+var udpEvents = map[string]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+func (u *udpTracker) announce(infoHash [20]byte, ar announceRequest) (*announceResponse, error) {
+	var key [4]byte
+	_, err := rand.Read(key[:])
+	if err != nil {
+		return nil, err
+	}
+	res, err := u.transact(udpActionAnnounce, func(txID uint32) ([]byte, error) {
+		connID, err := u.connectionID()
+		if err != nil {
+			return nil, err
+		}
+		req := make([]byte, 98)
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionAnnounce)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		copy(req[16:36], infoHash[:])
+		copy(req[36:56], ar.PeerID[:])
+		binary.BigEndian.PutUint64(req[56:64], uint64(ar.Downloaded))
+		binary.BigEndian.PutUint64(req[64:72], uint64(ar.Left))
+		binary.BigEndian.PutUint64(req[72:80], uint64(ar.Uploaded))
+		binary.BigEndian.PutUint32(req[80:84], udpEvents[ar.Event])
+		binary.BigEndian.PutUint32(req[84:88], 0) // ip: let the tracker see it
+		copy(req[88:92], key[:])
+		binary.BigEndian.PutUint32(req[92:96], 0xFFFFFFFF) // num_want: -1 for default
+		binary.BigEndian.PutUint16(req[96:98], ar.Port)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) < 20 {
+		return nil, fmt.Errorf("udp announce response too short %d < 20", len(res))
+	}
+	peers, err := peer.Unmarshal(res[20:])
+	if err != nil {
+		return nil, err
+	}
+	return &announceResponse{
+		Interval: int(binary.BigEndian.Uint32(res[8:12])),
+		Peers:    peers,
+	}, nil
+}
+
+func (u *udpTracker) scrape(infoHashes ...[20]byte) ([]ScrapeResult, error) {
+	res, err := u.transact(udpActionScrape, func(txID uint32) ([]byte, error) {
+		connID, err := u.connectionID()
+		if err != nil {
+			return nil, err
+		}
+		req := make([]byte, 16, 16+20*len(infoHashes))
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		for _, h := range infoHashes {
+			req = append(req, h[:]...)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("udp scrape response too short %d < %d", len(res), 8+12*len(infoHashes))
+	}
+	results := make([]ScrapeResult, len(infoHashes))
+	for i := range results {
+		offset := 8 + 12*i
+		results[i] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(res[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(res[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(res[offset+8 : offset+12])),
+		}
+	}
+	return results, nil
+}
+
+func (u *udpTracker) Close() error {
+	return u.conn.Close()
+}
+
+// announceUDP announces to a udp tracker, the socket is closed as soon as ctx is done
+func (t *TorrentFile) announceUDP(ctx context.Context, announce string, req announceRequest) (*announceResponse, error) {
+	tracker, err := dialUDPTracker(announce)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			tracker.Close()
+		case <-done:
+		}
+	}()
+	res, err := tracker.announce(t.InfoHash, req)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return res, err
+}
+
+// Scrape asks the first tracker for the swarm statistics of the torrent
+func (t *TorrentFile) Scrape() (ScrapeResult, error) {
+	tiers := t.trackerTiers()
+	if len(tiers) == 0 || len(tiers[0]) == 0 {
+		return ScrapeResult{}, fmt.Errorf("torrent has no tracker")
+	}
+	announce := tiers[0][0]
+	u, err := url.Parse(announce)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	if u.Scheme != "udp" {
+		return ScrapeResult{}, fmt.Errorf("scrape is not supported for %s trackers", u.Scheme)
+	}
+	tracker, err := dialUDPTracker(announce)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	defer tracker.Close()
+	results, err := tracker.scrape(t.InfoHash)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	return results[0], nil
+}
@@ -0,0 +1,155 @@
+package torrentfile
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brkss/btorrent/src/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUDPTracker answers connect/announce/scrape, dropping the first `drop` packets
+func fakeUDPTracker(t *testing.T, drop int) (string, *int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	var connects int32
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if drop > 0 {
+				drop--
+				continue
+			}
+			req := buf[:n]
+			action := binary.BigEndian.Uint32(req[8:12])
+			txID := req[12:16]
+			var res []byte
+			switch action {
+			case udpActionConnect:
+				atomic.AddInt32(&connects, 1)
+				res = make([]byte, 16)
+				copy(res[4:8], txID)
+				binary.BigEndian.PutUint64(res[8:16], 0xCAFE)
+			case udpActionAnnounce:
+				if binary.BigEndian.Uint64(req[0:8]) != 0xCAFE {
+					res = append([]byte{0, 0, 0, 3}, txID...)
+					res = append(res, []byte("bad connection id")...)
+					break
+				}
+				res = make([]byte, 20)
+				binary.BigEndian.PutUint32(res[0:4], udpActionAnnounce)
+				copy(res[4:8], txID)
+				binary.BigEndian.PutUint32(res[8:12], 1800)
+				res = append(res, 192, 0, 2, 123, 0x1A, 0xE1)
+			case udpActionScrape:
+				res = make([]byte, 20)
+				binary.BigEndian.PutUint32(res[0:4], udpActionScrape)
+				copy(res[4:8], txID)
+				binary.BigEndian.PutUint32(res[8:12], 5)
+				binary.BigEndian.PutUint32(res[12:16], 10)
+				binary.BigEndian.PutUint32(res[16:20], 3)
+			}
+			conn.WriteTo(res, addr)
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String() + "/announce", &connects
+}
+
+// setUDPTimeouts shortens the UDP tracker timeouts for the test
+func setUDPTimeouts(t *testing.T, timeout time.Duration, retries int) {
+	oldTimeout, oldRetries := udpTimeout, udpMaxRetries
+	udpTimeout, udpMaxRetries = timeout, retries
+	t.Cleanup(func() {
+		udpTimeout, udpMaxRetries = oldTimeout, oldRetries
+	})
+}
+
+func TestRequestPeersUDP(t *testing.T) {
+	setUDPTimeouts(t, 50*time.Millisecond, 8)
+	announce, connects := fakeUDPTracker(t, 1)
+	tf := TorrentFile{Announce: announce, InfoHash: [20]byte{1}, Length: 100}
+
+	p, err := tf.requestPeers(context.Background(), [20]byte{2}, 6881)
+	assert.Nil(t, err)
+	assert.Equal(t, []peer.Peer{{IP: net.IP{192, 0, 2, 123}, Port: 6881}}, p)
+
+	// the connection id is cached, announcing again skips connect
+	_, err = tf.requestPeers(context.Background(), [20]byte{2}, 6881)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(connects))
+
+	res, err := tf.Scrape()
+	assert.Nil(t, err)
+	assert.Equal(t, ScrapeResult{Seeders: 5, Completed: 10, Leechers: 3}, res)
+}
+
+func TestRequestPeersUDPRetries(t *testing.T) {
+	setUDPTimeouts(t, 50*time.Millisecond, 2)
+	// a tracker that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	tf := TorrentFile{Announce: "udp://" + conn.LocalAddr().String() + "/announce", InfoHash: [20]byte{1}, Length: 100}
+
+	tracker, err := dialUDPTracker(tf.Announce)
+	assert.Nil(t, err)
+	defer tracker.Close()
+	start := time.Now()
+	_, err = tracker.announce(tf.InfoHash, announceRequest{})
+	assert.ErrorContains(t, err, "after 2 retransmissions")
+	assert.Less(t, time.Since(start), time.Second*2)
+}
+
+func TestRequestPeersUDPCanceled(t *testing.T) {
+	setUDPTimeouts(t, time.Minute, 2)
+	// a tracker that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	tf := TorrentFile{Announce: "udp://" + conn.LocalAddr().String() + "/announce", InfoHash: [20]byte{1}, Length: 100}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = tf.announceUDP(ctx, tf.Announce, announceRequest{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRequestPeersUDPErrorEvictsConnectionID(t *testing.T) {
+	setUDPTimeouts(t, 50*time.Millisecond, 8)
+	announce, connects := fakeUDPTracker(t, 0)
+	tf := TorrentFile{Announce: announce, InfoHash: [20]byte{1}, Length: 100}
+	host := strings.TrimSuffix(strings.TrimPrefix(announce, "udp://"), "/announce")
+
+	// a connection id the tracker no longer accepts
+	udpConnIDs.Lock()
+	udpConnIDs.ids[host] = udpConnID{id: 0xDEAD, obtained: time.Now()}
+	udpConnIDs.Unlock()
+
+	_, err := tf.announceUDP(context.Background(), announce, announceRequest{})
+	assert.ErrorContains(t, err, "bad connection id")
+	assert.Equal(t, int32(0), atomic.LoadInt32(connects))
+
+	p, err := tf.announceUDP(context.Background(), announce, announceRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, []peer.Peer{{IP: net.IP{192, 0, 2, 123}, Port: 6881}}, p.Peers)
+	assert.Equal(t, int32(1), atomic.LoadInt32(connects))
+}
+
+func TestRequestPeersUnsupportedScheme(t *testing.T) {
+	tf := TorrentFile{Announce: "wss://tracker/announce"}
+	_, err := tf.requestPeers(context.Background(), [20]byte{2}, 6881)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,379 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/brkss/btorrent/src/bitfield"
+	"github.com/brkss/btorrent/src/resume"
+	"github.com/brkss/btorrent/src/storage"
+	"github.com/brkss/btorrent/src/upload"
+)
+
+// PieceStatus is what Verify found on disk for a piece or a file
+type PieceStatus int
+
+const (
+	PieceGood       PieceStatus = iota // matches its hash
+	PieceMissing                       // not on disk, or only partly
+	PieceCorrupt                       // on disk but the hash doesn't match
+	PieceIncomplete                    // files only: some of their pieces are good, others missing
+)
+
+func (s PieceStatus) String() string {
+	switch s {
+	case PieceGood:
+		return "good"
+	case PieceMissing:
+		return "missing"
+	case PieceCorrupt:
+		return "corrupt"
+	case PieceIncomplete:
+		return "incomplete"
+	default:
+		return fmt.Sprintf("PieceStatus(%d)", int(s))
+	}
+}
+
+// FileStatus is the state of one file of the torrent, a file is only as good
+// as the pieces it shares bytes with
+type FileStatus struct {
+	Path   string // relative to the download path
+	Length int
+	Status PieceStatus
+}
+
+// VerifyReport is the result of checking data on disk against the torrent
+type VerifyReport struct {
+	Pieces []PieceStatus
+	Files  []FileStatus
+}
+
+// Good returns the number of pieces matching their hash
+func (r *VerifyReport) Good() int {
+	good := 0
+	for _, s := range r.Pieces {
+		if s == PieceGood {
+			good++
+		}
+	}
+	return good
+}
+
+// Complete reports whether every piece is good
+func (r *VerifyReport) Complete() bool {
+	return r.Good() == len(r.Pieces)
+}
+
+// Bitfield returns the good pieces
+func (r *VerifyReport) Bitfield() bitfield.Bitfield {
+	bf := make(bitfield.Bitfield, (len(r.Pieces)+7)/8)
+	for i, s := range r.Pieces {
+		if s == PieceGood {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+// errPieceMissing is returned by piece readers when the data isn't on disk
+var errPieceMissing = errors.New("piece is missing")
+
+// pieceBounds returns the offsets of piece index in the torrent
+func (t *TorrentFile) pieceBounds(index int) (begin, end int) {
+	begin = index * t.PieceLength
+	end = begin + t.PieceLength
+	if end > t.Length {
+		end = t.Length
+	}
+	return begin, end
+}
+
+// inParallel calls fn for every index below n with one worker per CPU, each
+// worker reuses its own buffer of bufSize bytes. The first error stops it
+func inParallel(n, bufSize int, fn func(index int, buf []byte) error) error {
+	indexes := make(chan int)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, bufSize)
+			for index := range indexes {
+				err := fn(index, buf)
+				if err != nil {
+					select {
+					case errs <- err:
+						close(done)
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for index := 0; index < n; index++ {
+		select {
+		case indexes <- index:
+		case <-done:
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// hashPieces reads and hashes every piece in parallel, read fills buf with
+// the piece data or returns errPieceMissing. Any other error stops it
+func (t *TorrentFile) hashPieces(read func(index int, buf []byte) error) ([]PieceStatus, error) {
+	statuses := make([]PieceStatus, len(t.PieceHashes))
+	err := inParallel(len(t.PieceHashes), t.PieceLength, func(index int, buf []byte) error {
+		begin, end := t.pieceBounds(index)
+		err := read(index, buf[:end-begin])
+		if err == errPieceMissing {
+			statuses[index] = PieceMissing
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading piece #%d: %w", index, err)
+		}
+		sum := sha1.Sum(buf[:end-begin])
+		if bytes.Equal(sum[:], t.PieceHashes[index][:]) {
+			statuses[index] = PieceGood
+		} else {
+			statuses[index] = PieceCorrupt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// checkPieces hashes the pieces in store that known, which may be nil,
+// doesn't have and marks the valid ones in up
+func (t *TorrentFile) checkPieces(store storage.Storage, up *upload.Torrent, known bitfield.Bitfield) (int, error) {
+	statuses, err := t.hashPieces(func(index int, buf []byte) error {
+		if known.HasPiece(index) {
+			return errPieceMissing
+		}
+		begin, _ := t.pieceBounds(index)
+		_, err := store.ReadAt(buf, int64(begin))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	have := 0
+	for i, s := range statuses {
+		if s == PieceGood {
+			up.SetPiece(i)
+			have++
+		}
+	}
+	return have, nil
+}
+
+// fileReader reads the piece space from the files on disk without creating
+// or changing them, data missing from disk reads as errPieceMissing
+type fileReader struct {
+	entries []storage.FileEntry
+	files   []*os.File
+	sizes   []int64
+	offsets []int64
+}
+
+func openFileReader(entries []storage.FileEntry) (*fileReader, error) {
+	r := &fileReader{
+		entries: entries,
+		files:   make([]*os.File, len(entries)),
+		sizes:   make([]int64, len(entries)),
+		offsets: make([]int64, len(entries)),
+	}
+	var offset int64
+	for i, e := range entries {
+		r.offsets[i] = offset
+		offset += e.Length
+		if e.Pad {
+			continue
+		}
+		f, err := os.Open(e.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.files[i] = f
+		info, err := f.Stat()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.sizes[i] = info.Size()
+	}
+	return r, nil
+}
+
+// ReadAt fills buf with the bytes at offset off of the piece space
+func (r *fileReader) ReadAt(buf []byte, off int64) error {
+	done := 0
+	for i, e := range r.entries {
+		if done == len(buf) {
+			break
+		}
+		if off+int64(done) >= r.offsets[i]+e.Length || e.Length == 0 {
+			continue
+		}
+		fileOff := off + int64(done) - r.offsets[i]
+		count := len(buf) - done
+		if int64(count) > e.Length-fileOff {
+			count = int(e.Length - fileOff)
+		}
+		if e.Pad {
+			for j := done; j < done+count; j++ {
+				buf[j] = 0
+			}
+			done += count
+			continue
+		}
+		if r.files[i] == nil || r.sizes[i] < fileOff+int64(count) {
+			return errPieceMissing
+		}
+		_, err := r.files[i].ReadAt(buf[done:done+count], fileOff)
+		if err == io.EOF {
+			return errPieceMissing
+		}
+		if err != nil {
+			return err
+		}
+		done += count
+	}
+	return nil
+}
+
+func (r *fileReader) Close() {
+	for _, f := range r.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// Verify checks the data at path (laid out as DownloadToFile would write it)
+// against the piece hashes. Nothing is created or modified on disk
+func (t *TorrentFile) Verify(path string) (*VerifyReport, error) {
+	if len(t.PieceHashes) == 0 {
+		return nil, ErrV2Only
+	}
+	err := t.checkPieceLayout()
+	if err != nil {
+		return nil, err
+	}
+	entries := t.storageEntries(path)
+	r, err := openFileReader(entries)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	statuses, err := t.hashPieces(func(index int, buf []byte) error {
+		begin, _ := t.pieceBounds(index)
+		return r.ReadAt(buf, int64(begin))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{Pieces: statuses}
+	for i, e := range entries {
+		if e.Pad {
+			continue
+		}
+		rel := t.Name
+		if len(t.Files) > 0 {
+			rel = filepath.Join(t.Files[i].Path...)
+		}
+		status := PieceGood
+		if e.Length == 0 {
+			if r.files[i] == nil {
+				status = PieceMissing
+			}
+		} else {
+			status = t.fileStatus(statuses, r.offsets[i], e.Length)
+		}
+		report.Files = append(report.Files, FileStatus{Path: rel, Length: int(e.Length), Status: status})
+	}
+	return report, nil
+}
+
+// fileStatus sums up the pieces covering [offset, offset+length)
+func (t *TorrentFile) fileStatus(statuses []PieceStatus, offset, length int64) PieceStatus {
+	first := int(offset / int64(t.PieceLength))
+	last := int((offset + length - 1) / int64(t.PieceLength))
+	good, missing := 0, 0
+	for _, s := range statuses[first : last+1] {
+		switch s {
+		case PieceCorrupt:
+			return PieceCorrupt
+		case PieceGood:
+			good++
+		case PieceMissing:
+			missing++
+		}
+	}
+	switch {
+	case missing == 0:
+		return PieceGood
+	case good == 0:
+		return PieceMissing
+	default:
+		return PieceIncomplete
+	}
+}
+
+// SaveVerified records the good pieces of report as the resume data of a
+// download into path, so DownloadToFile only fetches the others
+func (t *TorrentFile) SaveVerified(path string, report *VerifyReport) error {
+	files, err := resume.StatFiles(t.storagePaths(path))
+	if err != nil {
+		return err
+	}
+	d := &resume.Data{
+		InfoHash: t.InfoHash,
+		Bitfield: report.Bitfield(),
+		Files:    files,
+		Trackers: t.AnnounceList,
+	}
+	existing, err := resume.Load(t.ResumePath(path))
+	if err == nil && existing.InfoHash == t.InfoHash {
+		d.Uploaded = existing.Uploaded
+		d.Downloaded = existing.Downloaded
+	}
+	return d.Save(t.ResumePath(path))
+}
@@ -0,0 +1,71 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	// pieces straddle the files: "aaaa" "bbbb" "cc"
+	content := []byte("aaaabbbbcc")
+	tf := &TorrentFile{
+		Name:        "dir",
+		PieceLength: 4,
+		Length:      len(content),
+		PieceHashes: [][20]byte{sha1.Sum(content[0:4]), sha1.Sum(content[4:8]), sha1.Sum(content[8:10])},
+		Files: []File{
+			{Length: 3, Path: []string{"a"}},
+			{Length: 3, Path: []string{"b"}},
+			{Length: 4, Path: []string{"sub", "c"}},
+		},
+	}
+	path := t.TempDir()
+	root := filepath.Join(path, "dir")
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "sub"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "a"), []byte("aaa"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "b"), []byte("Xbb"), 0644))
+
+	report, err := tf.Verify(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []PieceStatus{PieceCorrupt, PieceMissing, PieceMissing}, report.Pieces)
+	assert.Equal(t, []FileStatus{
+		{Path: "a", Length: 3, Status: PieceCorrupt},
+		{Path: "b", Length: 3, Status: PieceCorrupt},
+		{Path: filepath.Join("sub", "c"), Length: 4, Status: PieceMissing},
+	}, report.Files)
+	_, err = os.Stat(filepath.Join(root, "sub", "c"))
+	assert.True(t, os.IsNotExist(err), "verify must not create files")
+
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "b"), []byte("abb"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "sub", "c"), []byte("bbcX"), 0644))
+	report, err = tf.Verify(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []PieceStatus{PieceGood, PieceGood, PieceCorrupt}, report.Pieces)
+	assert.Equal(t, PieceGood, report.Files[0].Status)
+	assert.Equal(t, PieceCorrupt, report.Files[2].Status)
+	assert.False(t, report.Complete())
+
+	// the good pieces are trusted by the next download
+	assert.Nil(t, tf.SaveVerified(path, report))
+	store, up, _, err := tf.openWithProgress(path)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.True(t, up.HasPiece(0))
+	assert.True(t, up.HasPiece(1))
+	assert.False(t, up.HasPiece(2))
+}
+
+func TestVerifyBadPieceLayout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a")
+	assert.Nil(t, os.WriteFile(path, make([]byte, 100), 0644))
+
+	// neither a zero piece length nor too few hashes make it panic
+	_, err := (&TorrentFile{Name: "a", Length: 100, PieceHashes: [][20]byte{{}}}).Verify(path)
+	assert.NotNil(t, err)
+	_, err = (&TorrentFile{Name: "a", Length: 100, PieceLength: 16, PieceHashes: [][20]byte{{}}}).Verify(path)
+	assert.NotNil(t, err)
+}
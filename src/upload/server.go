@@ -0,0 +1,241 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/brkss/btorrent/src/client"
+	"github.com/brkss/btorrent/src/message"
+	"github.com/brkss/btorrent/src/metadata"
+)
+
+const (
+	MAX_UPLOAD_SLOTS = 8  // max number of peers we keep unchoked at the same time
+	MAX_CONNECTIONS  = 50 // max number of incoming connections
+)
+
+// ErrServerClosed is returned by Listen and Serve once the server is closed
+var ErrServerClosed = errors.New("upload: server closed")
+
+// Server listens for incoming peers and serves the torrents added to it
+type Server struct {
+	PeerID         [20]byte
+	MaxConnections int // incoming peers at once, MAX_CONNECTIONS when 0
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	conns    map[net.Conn]struct{}
+	unchoked int
+	listener net.Listener
+	closed   bool
+}
+
+// NewServer creates a server with no torrent
+func NewServer(peerID [20]byte) *Server {
+	return &Server{
+		PeerID:   peerID,
+		torrents: make(map[[20]byte]*Torrent),
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// Add makes t available to incoming peers
+func (s *Server) Add(t *Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[t.InfoHash] = t
+}
+
+// Remove stops serving infoHash to new peers
+func (s *Server) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+func (s *Server) torrent(infoHash [20]byte) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.torrents[infoHash]
+}
+
+// Listen starts accepting peers on port in the background
+func (s *Server) Listen(port uint16) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	err = s.setListener(ln)
+	if err != nil {
+		return err
+	}
+	go s.serve(ln)
+	return nil
+}
+
+// Serve accepts peers on ln until the server is closed
+func (s *Server) Serve(ln net.Listener) error {
+	err := s.setListener(ln)
+	if err != nil {
+		return err
+	}
+	return s.serve(ln)
+}
+
+// setListener records ln so Close closes it, ln is closed right away when
+// the server already is
+func (s *Server) setListener(ln net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listener = ln
+	return nil
+}
+
+func (s *Server) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		limit := s.MaxConnections
+		if limit <= 0 {
+			limit = MAX_CONNECTIONS
+		}
+		full := len(s.conns) >= limit || s.closed
+		if !full {
+			s.conns[conn] = struct{}{}
+		}
+		s.mu.Unlock()
+		if full {
+			conn.Close()
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops listening and disconnects every peer
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// takeSlot reserves an upload slot, returns false if every slot is taken
+func (s *Server) takeSlot() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unchoked >= MAX_UPLOAD_SLOTS {
+		return false
+	}
+	s.unchoked++
+	return true
+}
+
+func (s *Server) releaseSlot() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unchoked--
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	c, err := client.Accept(conn, s.PeerID, func(infoHash [20]byte) bool {
+		return s.torrent(infoHash) != nil
+	})
+	if err != nil {
+		log.Printf("rejected incoming peer %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	t := s.torrent(c.InfoHash())
+	if t == nil {
+		return
+	}
+	log.Printf("Incoming peer %s for %x\n", c.Peer(), t.InfoHash)
+
+	if c.SupportsExtensions() {
+		extensions := map[string]int{}
+		if len(t.Metadata) > 0 {
+			extensions["ut_metadata"] = metadata.UtMetadataID
+		}
+		err = c.SendExtendedHandshake(extensions, len(t.Metadata))
+		if err != nil {
+			return
+		}
+	}
+	err = c.SendBitfield(t.Bitfield())
+	if err != nil {
+		return
+	}
+
+	unchoked := false
+	defer func() {
+		if unchoked {
+			s.releaseSlot()
+		}
+	}()
+	for {
+		// peers are expected to send at least a keep-alive every 2 minutes
+		conn.SetReadDeadline(time.Now().Add(time.Minute * 3))
+		msg, err := c.Read()
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgInterested:
+			if !unchoked && s.takeSlot() {
+				unchoked = true
+				err = c.SendUnchoke()
+			}
+		case message.MsgNotInterested:
+			if unchoked {
+				unchoked = false
+				s.releaseSlot()
+				err = c.SendChoke()
+			}
+		case message.MsgRequest:
+			if unchoked {
+				err = t.HandleRequest(c, msg)
+			}
+		case message.MsgExtended:
+			var id uint8
+			var payload []byte
+			id, payload, err = c.HandleExtended(msg)
+			if err == nil && id == metadata.UtMetadataID && len(t.Metadata) > 0 {
+				err = metadata.Serve(c, t.Metadata, payload)
+			}
+		}
+		if err != nil {
+			log.Printf("dropping incoming peer %s: %s\n", c.Peer(), err)
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brkss/btorrent/src/client"
+	"github.com/brkss/btorrent/src/message"
+	"github.com/brkss/btorrent/src/metadata"
+	"github.com/brkss/btorrent/src/peer"
+	"github.com/brkss/btorrent/src/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeRequest(t *testing.T) {
+	store, err := storage.NewFile(filepath.Join(t.TempDir(), "data"), 6)
+	assert.Nil(t, err)
+	defer store.Close()
+	store.WriteAt([]byte("abcdef"), 0)
+
+	infoHash := [20]byte{1, 2, 3}
+	up := NewTorrent(infoHash, 4, 6, 2, store)
+	up.SetPiece(1)
+
+	s := NewServer([20]byte{9})
+	s.Add(up)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.Serve(ln)
+	defer s.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	c, err := client.New(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, [20]byte{7}, infoHash)
+	assert.Nil(t, err)
+	defer c.Conn.Close()
+	assert.False(t, c.Bitfield.HasPiece(0))
+	assert.True(t, c.Bitfield.HasPiece(1))
+
+	assert.Nil(t, c.SendInterested())
+	msg, err := c.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, message.MsgUnchoke, msg.ID)
+
+	assert.Nil(t, c.SendRequest(1, 0, 2))
+	msg, err = c.Read()
+	assert.Nil(t, err)
+	buf := make([]byte, 2)
+	n, err := message.ParsePiece(1, buf, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []byte("ef"), buf)
+	assert.Equal(t, int64(2), up.Uploaded())
+}
+
+func TestTorrentCounters(t *testing.T) {
+	up := NewTorrent([20]byte{1}, 4, 10, 3, nil)
+	assert.Equal(t, int64(10), up.Left())
+	up.SetPiece(2)
+	up.SetPiece(0)
+	up.SetPiece(0)
+	assert.Equal(t, 2, up.Pieces())
+	assert.Equal(t, int64(4), up.Left())
+}
+
+func TestServeRejectsUnknownInfoHash(t *testing.T) {
+	s := NewServer([20]byte{9})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.Serve(ln)
+	defer s.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	_, err = client.New(peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, [20]byte{7}, [20]byte{4, 5, 6})
+	assert.NotNil(t, err)
+}
+
+func TestServeMetadata(t *testing.T) {
+	store, err := storage.NewFile(filepath.Join(t.TempDir(), "data"), 6)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	// larger than a metadata piece so it takes several requests
+	info := []byte("d4:name4:data6:pieces" + "20000:" + strings.Repeat("x", 20000) + "e")
+	infoHash := sha1.Sum(info)
+	up := NewTorrent(infoHash, 4, 6, 2, store)
+	up.Metadata = info
+
+	s := NewServer([20]byte{9})
+	s.Add(up)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.Serve(ln)
+	defer s.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	got, err := metadata.Fetch([]peer.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}, [20]byte{7}, infoHash)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(info, got))
+}
+
+func TestCloseRightAfterListen(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		ln, err := net.Listen("tcp", ":0")
+		assert.Nil(t, err)
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+
+		s := NewServer([20]byte{9})
+		assert.Nil(t, s.Listen(uint16(port)))
+		assert.Nil(t, s.Close())
+		// the port is free again once Close returns
+		ln, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+		assert.Nil(t, err)
+		ln.Close()
+	}
+
+	s := NewServer([20]byte{9})
+	s.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	assert.ErrorIs(t, s.Serve(ln), ErrServerClosed)
+}
@@ -0,0 +1,127 @@
+package upload
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/brkss/btorrent/src/bitfield"
+	"github.com/brkss/btorrent/src/client"
+	"github.com/brkss/btorrent/src/message"
+	"github.com/brkss/btorrent/src/ratelimit"
+	"github.com/brkss/btorrent/src/storage"
+)
+
+// MAX_BLOCK_SIZE is the largest block we agree to send in one piece message
+const MAX_BLOCK_SIZE = 131072
+
+// Torrent is a torrent we can serve blocks of, pieces become available as
+// soon as they are marked with SetPiece
+type Torrent struct {
+	InfoHash    [20]byte
+	PieceLength int
+	Length      int
+	Storage     storage.Storage
+	Metadata    []byte             // raw info dictionary served over ut_metadata, optional
+	Limiter     *ratelimit.Limiter // caps the upload rate, optional
+
+	mu       sync.RWMutex
+	have     bitfield.Bitfield
+	done     int   // pieces in have
+	left     int64 // bytes of the pieces not in have
+	uploaded int64
+}
+
+// NewTorrent creates a servable torrent with no piece available yet
+func NewTorrent(infoHash [20]byte, pieceLength, length, numPieces int, store storage.Storage) *Torrent {
+	return &Torrent{
+		InfoHash:    infoHash,
+		PieceLength: pieceLength,
+		Length:      length,
+		Storage:     store,
+		have:        make(bitfield.Bitfield, (numPieces+7)/8),
+		left:        int64(length),
+	}
+}
+
+// SetPiece marks piece index as verified and available for upload
+func (t *Torrent) SetPiece(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.have.HasPiece(index) || index*t.PieceLength >= t.Length {
+		return
+	}
+	t.have.SetPiece(index)
+	t.done++
+	size := t.PieceLength
+	if (index+1)*t.PieceLength > t.Length {
+		size = t.Length - index*t.PieceLength
+	}
+	t.left -= int64(size)
+}
+
+// HasPiece reports whether piece index is available for upload
+func (t *Torrent) HasPiece(index int) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.have.HasPiece(index)
+}
+
+// Bitfield returns a copy of the pieces we have
+func (t *Torrent) Bitfield() bitfield.Bitfield {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	bf := make(bitfield.Bitfield, len(t.have))
+	copy(bf, t.have)
+	return bf
+}
+
+// Pieces returns the number of pieces we have
+func (t *Torrent) Pieces() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.done
+}
+
+// Left returns the number of bytes of the pieces we don't have yet
+func (t *Torrent) Left() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.left
+}
+
+// Uploaded returns the number of bytes sent to peers so far
+func (t *Torrent) Uploaded() int64 {
+	return atomic.LoadInt64(&t.uploaded)
+}
+
+// HandleRequest answers a request message with the requested block, read from storage
+func (t *Torrent) HandleRequest(c *client.Client, msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if !t.HasPiece(index) {
+		return fmt.Errorf("peer requested piece #%d we do not have", index)
+	}
+	pieceSize := t.PieceLength
+	if (index+1)*t.PieceLength > t.Length {
+		pieceSize = t.Length - index*t.PieceLength
+	}
+	if length <= 0 || length > MAX_BLOCK_SIZE || begin < 0 || begin+length > pieceSize {
+		return fmt.Errorf("invalid request for piece #%d [%d:%d]", index, begin, begin+length)
+	}
+
+	t.Limiter.Wait(length)
+	block := make([]byte, length)
+	_, err = t.Storage.ReadAt(block, int64(index*t.PieceLength+begin))
+	if err != nil {
+		return err
+	}
+	err = c.SendPiece(index, begin, block)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&t.uploaded, int64(length))
+	return nil
+}
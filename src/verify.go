@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// verify prints which files of a torrent are good and records the good
+// pieces so a later download only fetches the others:
+// btorrent verify [flags] <torrent> <path>
+func verify(args []string) error {
+	flags := newFlagSet("verify", "<torrent> <path>")
+	err := parseFlags(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	tf, err := openTorrent(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	path := flags.Arg(1)
+
+	report, err := tf.Verify(path)
+	if err != nil {
+		return fmt.Errorf("verifying %s: %w", path, err)
+	}
+	for _, f := range report.Files {
+		fmt.Printf("%-10s %s\n", f.Status, f.Path)
+	}
+	fmt.Printf("%d/%d pieces good\n", report.Good(), len(report.Pieces))
+	if report.Good() > 0 {
+		err = tf.SaveVerified(path, report)
+		if err != nil {
+			log.Printf("could not save resume data: %s\n", err)
+		}
+	}
+	if !report.Complete() {
+		return errIncomplete
+	}
+	return nil
+}